@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const EmojiSleeping = "\xF0\x9F\x92\xA4"
+
+const defaultSnoozeDuration = "24h"
+
+// actionLinkValidity is how long acknowledge and snooze links can be used
+const actionLinkValidity = 7 * 24 * time.Hour
+
+// linkSigner signs action links, so that only links sent by the plugin are accepted
+type linkSigner struct {
+	mu     sync.Mutex
+	secret []byte
+	mac    hash.Hash // reused for every link, reset before each use
+	sum    []byte
+}
+
+func newLinkSigner() *linkSigner {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &linkSigner{secret: secret, mac: hmac.New(sha256.New, secret)}
+}
+
+func (ls *linkSigner) setSecret(secret string) error {
+	bytes, err := hex.DecodeString(secret)
+	if err != nil {
+		return err
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.secret = bytes
+	ls.mac = hmac.New(sha256.New, bytes)
+	return nil
+}
+
+func (ls *linkSigner) getSecret() string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return hex.EncodeToString(ls.secret)
+}
+
+func (ls *linkSigner) sign(action, key string) string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.mac.Reset()
+	io.WriteString(ls.mac, action)
+	io.WriteString(ls.mac, ":")
+	io.WriteString(ls.mac, key)
+	ls.sum = ls.mac.Sum(ls.sum[:0])
+	return base64.RawURLEncoding.EncodeToString(ls.sum)
+}
+
+func (ls *linkSigner) verify(action, key, token string) bool {
+	return hmac.Equal([]byte(ls.sign(action, key)), []byte(token))
+}
+
+// signedPayload is the part of an action link covered by its token: the key
+// and all query parameters, so that none of them can be changed
+func signedPayload(key string, params url.Values) string {
+	return key + "?" + params.Encode()
+}
+
+// actionURL builds a signed link to one of the plugin's action routes
+func (p *Plugin) actionURL(baseURL, action, key string, params url.Values) string {
+	encodedKey := base64.RawURLEncoding.EncodeToString([]byte(key))
+	query := url.Values{}
+	for name, values := range params {
+		query[name] = values
+	}
+	query.Set("token", p.signer.sign(action, signedPayload(key, params)))
+	return fmt.Sprintf("%s%s%s/%s/%s?%s", baseURL, p.basePath, routeName, action, encodedKey, query.Encode())
+}
+
+// addActionLinks appends acknowledge and snooze links to the notification.
+// Acknowledge links are only added for problems tracked by the escalation.
+func (p *Plugin) addActionLinks(config *PluginConfig, notification *GotifyMessage) {
+	baseURL := config.publicURL()
+	if baseURL == "" {
+		return
+	}
+	expires := strconv.FormatInt(timeNow().Add(actionLinkValidity).Unix(), 10)
+	var links []string
+	if p.escalation.tracks(&config.Escalation, notification.problem) {
+		params := url.Values{"expires": {expires}}
+		links = append(links, fmt.Sprintf("[Acknowledge](%s)", p.actionURL(baseURL, "ack", notification.problem, params)))
+	}
+	for _, key := range notification.muteKeys {
+		kind, name, _ := strings.Cut(key, ":")
+		params := url.Values{"for": {defaultSnoozeDuration}, "expires": {expires}}
+		links = append(links, fmt.Sprintf("[Snooze %s %s for %s](%s)", kind, name, defaultSnoozeDuration, p.actionURL(baseURL, "snooze", key, params)))
+	}
+	if len(links) > 0 {
+		notification.Message += "\n\n---\n\n" + strings.Join(links, " · ")
+	}
+}
+
+// publicURL returns the external URL of Gotify used for action links. It is
+// empty if public_url is not configured, the Host header of requests is not
+// trusted for links.
+func (c *PluginConfig) publicURL() string {
+	return strings.TrimRight(c.PublicURL, "/")
+}
+
+// actionKey decodes and verifies the key and query parameters of an action request
+func (p *Plugin) actionKey(c *gin.Context, action string) (string, bool) {
+	bytes, err := base64.RawURLEncoding.DecodeString(c.Param("key"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid key")
+		return "", false
+	}
+	key := string(bytes)
+	params := c.Request.URL.Query()
+	token := params.Get("token")
+	params.Del("token")
+	if !p.signer.verify(action, signedPayload(key, params), token) {
+		c.String(http.StatusForbidden, "invalid token")
+		return "", false
+	}
+	if expires := params.Get("expires"); expires != "" {
+		unix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || !timeNow().Before(time.Unix(unix, 0)) {
+			c.String(http.StatusGone, "the link has expired")
+			return "", false
+		}
+	}
+	return key, true
+}
+
+var actionConfirmation = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<p>{{.Title}}?</p>
+<form method="post"><button type="submit">{{.Action}}</button></form>
+</body>
+</html>
+`))
+
+// confirmed reports whether an action link was submitted with POST. For other
+// methods it renders a confirmation form instead, so that link previews and
+// prefetching have no effect.
+func confirmed(c *gin.Context, title, action string) bool {
+	if c.Request.Method == http.MethodPost {
+		return true
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	actionConfirmation.Execute(c.Writer, map[string]string{"Title": title, "Action": action})
+	return false
+}
+
+func (p *Plugin) ackHandler(c *gin.Context) {
+	key, ok := p.actionKey(c, "ack")
+	if !ok || !confirmed(c, "Acknowledge "+key, "acknowledge") {
+		return
+	}
+	if !p.escalation.acknowledge(key) {
+		c.String(http.StatusNotFound, "problem is not ongoing anymore")
+		return
+	}
+	c.String(http.StatusOK, "Acknowledged, no further reminders will be sent for this problem.")
+}
+
+func (p *Plugin) snoozeHandler(c *gin.Context) {
+	key, ok := p.actionKey(c, "snooze")
+	if !ok {
+		return
+	}
+	duration, err := parseDuration(c.DefaultQuery("for", defaultSnoozeDuration))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid duration")
+		return
+	}
+	if !confirmed(c, fmt.Sprintf("Snooze %s for %s", key, duration), "snooze") {
+		return
+	}
+	until := p.snoozes.snooze(key, duration)
+	p.markDirty()
+	if duration <= 0 {
+		c.String(http.StatusOK, "Snooze of %s lifted.", key)
+		return
+	}
+	c.String(http.StatusOK, "Snoozed %s until %s.", key, until.Format("2006-01-02 15:04 MST"))
+}
+
+// snoozeList keeps muted notification keys like "sender:mail@example.com"
+type snoozeList struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newSnoozeList() *snoozeList {
+	return &snoozeList{until: map[string]time.Time{}}
+}
+
+// snooze mutes the key for the given duration, a duration <= 0 lifts the snooze
+func (sl *snoozeList) snooze(key string, duration time.Duration) time.Time {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if duration <= 0 {
+		delete(sl.until, key)
+		return time.Time{}
+	}
+	until := timeNow().Add(duration)
+	sl.until[key] = until
+	return until
+}
+
+// snoozed reports whether any of the keys is muted
+func (sl *snoozeList) snoozed(keys ...string) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	now := timeNow()
+	for _, key := range keys {
+		if until, ok := sl.until[key]; ok && now.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+// active returns all snoozes that did not expire yet
+func (sl *snoozeList) active() map[string]time.Time {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	now := timeNow()
+	result := map[string]time.Time{}
+	for key, until := range sl.until {
+		if now.Before(until) {
+			result[key] = until
+		} else {
+			delete(sl.until, key)
+		}
+	}
+	return result
+}
+
+func (sl *snoozeList) restore(until map[string]time.Time) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.until = map[string]time.Time{}
+	for key, t := range until {
+		sl.until[key] = t
+	}
+}
+
+// display returns a markdown list of active snoozes
+func (sl *snoozeList) display() string {
+	active := sl.active()
+	if len(active) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(active))
+	for key := range active {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(EmojiSleeping + " **Active snoozes:**\n\n")
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "- %s until %s\n", key, active[key].Format("2006-01-02 15:04 MST"))
+	}
+	return sb.String()
+}
+
+// senderMuteKeys returns the keys that can be snoozed for messages of a sender
+func senderMuteKeys(from string) []string {
+	domain := addressDomain(from)
+	if domain == "" {
+		return nil
+	}
+	return []string{"sender:" + bareAddress(from), "domain:" + domain}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotify/plugin-api"
+)
+
+type recordingMessageHandler struct {
+	messages []plugin.Message
+}
+
+func (r *recordingMessageHandler) SendMessage(msg plugin.Message) error {
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+// newTestPlugin returns a configured plugin with its routes registered on a gin engine
+func newTestPlugin(t testing.TB, configure func(*PluginConfig)) (*Plugin, *gin.Engine, *recordingMessageHandler) {
+	gin.SetMode(gin.TestMode)
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	handler := &recordingMessageHandler{}
+	p.SetMessageHandler(handler)
+	config := p.DefaultConfig().(*PluginConfig)
+	config.PublicURL = "https://gotify.example.com"
+	if configure != nil {
+		configure(config)
+	}
+	if err := p.ValidateAndSetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	p.RegisterWebhook("/plugin/1/custom/abc/", engine.Group("/plugin/1/custom/abc/"))
+	return p, engine, handler
+}
+
+func serve(engine *gin.Engine, method, target, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	engine.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// findLink returns the path and query of the markdown link with the given text prefix
+func findLink(t *testing.T, markdown, textPrefix string) string {
+	for _, match := range markdownLinkRegex.FindAllStringSubmatch(markdown, -1) {
+		if strings.HasPrefix(match[1], textPrefix) {
+			u, err := url.Parse(match[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return u.RequestURI()
+		}
+	}
+	t.Fatal("No link starting with '" + textPrefix + "' in: " + markdown)
+	return ""
+}
+
+func TestSnoozeLink(t *testing.T) {
+	p, engine, handler := newTestPlugin(t, nil)
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", string(messageSentEvent))
+	if len(handler.messages) != 1 {
+		t.Fatal("Expected one message, got: ", len(handler.messages))
+	}
+	link := findLink(t, handler.messages[0].Message, "Snooze sender sales@awesomeapp.com")
+
+	if rec := serve(engine, http.MethodGet, strings.Replace(link, "token=", "token=x", 1), ""); rec.Code != http.StatusForbidden {
+		t.Fatal("Tampered token was accepted, status: ", rec.Code)
+	}
+	if rec := serve(engine, http.MethodGet, strings.Replace(link, "for=24h", "for=8760h", 1), ""); rec.Code != http.StatusForbidden {
+		t.Fatal("Changed snooze duration was accepted, status: ", rec.Code)
+	}
+	if rec := serve(engine, http.MethodGet, link, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<form method="post">`) {
+		t.Fatal("GET did not render a confirmation, status: ", rec.Code)
+	}
+	if p.snoozes.snoozed("sender:sales@awesomeapp.com") {
+		t.Fatal("GET snoozed the sender")
+	}
+	if rec := serve(engine, http.MethodPost, link, ""); rec.Code != http.StatusOK {
+		t.Fatal("Snooze failed, status: ", rec.Code)
+	}
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", string(messageSentEvent))
+	if len(handler.messages) != 1 {
+		t.Fatal("Snoozed sender was not muted")
+	}
+	if display := p.GetDisplay(nil); !strings.Contains(display, "sender:sales@awesomeapp.com until") {
+		t.Fatal("Snooze not listed in display: ", display)
+	}
+}
+
+func TestAcknowledgeLink(t *testing.T) {
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Escalation.Enabled = true
+	})
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", string(domainDNSErrorEvent))
+	link := findLink(t, handler.messages[0].Message, "Acknowledge")
+	if rec := serve(engine, http.MethodGet, link, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<form method="post">`) {
+		t.Fatal("GET did not render a confirmation, status: ", rec.Code)
+	}
+	if rec := serve(engine, http.MethodPost, link, ""); rec.Code != http.StatusOK {
+		t.Fatal("Acknowledge failed, status: ", rec.Code)
+	}
+}
+
+func TestActionLinksExpire(t *testing.T) {
+	fixed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Escalation.Enabled = true
+	})
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", string(domainDNSErrorEvent))
+	message := handler.messages[0].Message
+
+	fixed = fixed.Add(actionLinkValidity)
+	for _, text := range []string{"Acknowledge", "Snooze"} {
+		link := findLink(t, message, text)
+		if rec := serve(engine, http.MethodPost, link, ""); rec.Code != http.StatusGone {
+			t.Fatal(text+" link did not expire, status: ", rec.Code)
+		}
+		if rec := serve(engine, http.MethodPost, strings.Replace(link, "expires=", "expires=9", 1), ""); rec.Code != http.StatusForbidden {
+			t.Fatal("Changed expiry of "+text+" link was accepted, status: ", rec.Code)
+		}
+	}
+}
+
+func TestAcknowledgeLinkRequiresEscalation(t *testing.T) {
+	_, engine, handler := newTestPlugin(t, nil)
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", string(domainDNSErrorEvent))
+	if strings.Contains(handler.messages[0].Message, "[Acknowledge]") {
+		t.Fatal("Acknowledge link added without escalation: ", handler.messages[0].Message)
+	}
+}
+
+func TestActionLinksRequirePublicURL(t *testing.T) {
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.PublicURL = ""
+		c.Escalation.Enabled = true
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/plugin/1/custom/abc/postal", strings.NewReader(string(domainDNSErrorEvent)))
+	req.Host = "attacker.example.com"
+	engine.ServeHTTP(httptest.NewRecorder(), req)
+	if message := handler.messages[0].Message; strings.Contains(message, "](") {
+		t.Fatal("Action links added without public_url: ", message)
+	}
+}
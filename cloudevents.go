@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsTypePrefix  = "com.postal."
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventLogSize      = 200
+)
+
+// CloudEvent is a CloudEvents 1.0 envelope in structured JSON format
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// binaryHeaders returns the attributes as HTTP headers for the binary content mode
+func (ce *CloudEvent) binaryHeaders() map[string]string {
+	return map[string]string{
+		"Content-Type":   ce.DataContentType,
+		"ce-specversion": ce.SpecVersion,
+		"ce-id":          ce.ID,
+		"ce-source":      ce.Source,
+		"ce-type":        ce.Type,
+		"ce-time":        ce.Time.Format(time.RFC3339Nano),
+	}
+}
+
+// newCloudEvent wraps a delivery event into a CloudEvent carrying the payload as
+// received. Inbound messages carry the request body as data. Events without an
+// ID, like inbound messages, get a random one, since CloudEvents requires it.
+func newCloudEvent(event *DeliveryEvent, raw []byte, source string) (*CloudEvent, error) {
+	ce := &CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              event.ID,
+		Source:          source,
+		Type:            cloudEventsTypePrefix + event.Event,
+		Time:            event.Timestamp.UTC(),
+		DataContentType: "application/json",
+		Data:            event.Payload,
+	}
+
+	switch event.Kind {
+	case KindUnknown:
+		return nil, fmt.Errorf("unknown event name '%s'", event.Event)
+	case KindReceived:
+		ce.Data = raw
+	}
+	if ce.ID == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		ce.ID = hex.EncodeToString(id)
+	}
+	if !json.Valid(ce.Data) {
+		return nil, fmt.Errorf("%s payload is no JSON", event.Event)
+	}
+	return ce, nil
+}
+
+// cloudEventSource identifies the origin of an event by its provider and the
+// profile. The profile is only included if it is configured, since the name is
+// taken from the request.
+func cloudEventSource(config *PluginConfig, event *DeliveryEvent) string {
+	source := "/" + event.Provider
+	if slices.Contains(config.profileNames(), event.Profile) {
+		source += "/" + url.PathEscape(event.Profile)
+	}
+	return source
+}
+
+// cloudEventLog keeps the most recent CloudEvents for the event history endpoint
+type cloudEventLog struct {
+	mu     sync.Mutex
+	events []*CloudEvent // oldest first
+}
+
+func (cl *cloudEventLog) add(ce *CloudEvent) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.events = append(cl.events, ce)
+	if len(cl.events) > cloudEventLogSize {
+		cl.events = cl.events[len(cl.events)-cloudEventLogSize:]
+	}
+}
+
+// recent returns up to limit events, newest first, optionally filtered by type
+func (cl *cloudEventLog) recent(eventType string, limit int) []*CloudEvent {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	result := []*CloudEvent{}
+	for i := len(cl.events) - 1; i >= 0 && len(result) < limit; i-- {
+		if eventType == "" || cl.events[i].Type == eventType {
+			result = append(result, cl.events[i])
+		}
+	}
+	return result
+}
+
+// eventHistoryHandler returns the recent events as a JSON array of CloudEvents
+// (batched content mode). Supports ?type= and ?limit=.
+func (p *Plugin) eventHistoryHandler(c *gin.Context) {
+	if !p.authorizeAPI(c) {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+	c.Header("Content-Type", "application/cloudevents-batch+json")
+	c.JSON(http.StatusOK, p.cloudEvents.recent(c.Query("type"), limit))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+func TestCloudEventFromWebhook(t *testing.T) {
+	event, errMessage := decodeWebhook(messageLoadedEvent)
+	if errMessage != nil {
+		t.Fatal(errMessage.Message)
+	}
+	event.ID = "a1b2c3"
+	event.Timestamp = unixTime(1477945177.5)
+	event.Profile = "main"
+
+	ce, err := newCloudEvent(event, nil, "/postal/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ce.ID != "a1b2c3" || ce.Source != "/postal/main" || ce.Type != "com.postal.MessageLoaded" || ce.SpecVersion != "1.0" {
+		t.Fatal("Unexpected attributes: ", ce)
+	}
+	if !ce.Time.Equal(time.Unix(1477945177, 5e8)) {
+		t.Fatal("Unexpected time: ", ce.Time)
+	}
+	var data postal.MessageLoadedEvent
+	if err := json.Unmarshal(ce.Data, &data); err != nil || data.IPAddress != "185.22.208.2" || data.Message.ID != 12345 {
+		t.Fatal("Unexpected data: ", string(ce.Data))
+	}
+}
+
+func TestCloudEventIDAndSource(t *testing.T) {
+	config := &PluginConfig{Profiles: []ServerProfile{{Name: "main"}}}
+	event := newDeliveryEvent("mailgun", KindDelivered, "", timeNow(), []byte(`{}`))
+	event.Profile = "main"
+	if source := cloudEventSource(config, event); source != "/mailgun/main" {
+		t.Fatal("Unexpected source of configured profile: ", source)
+	}
+	event.Profile = "<script>"
+	if source := cloudEventSource(config, event); source != "/mailgun" {
+		t.Fatal("Unconfigured profile used as source: ", source)
+	}
+
+	ce, err := newCloudEvent(event, nil, "/mailgun")
+	if err != nil || len(ce.ID) != 32 {
+		t.Fatal("Expected a generated ID, got: ", ce, err)
+	}
+}
+
+func TestCloudEventsBinarySinkAndHistory(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer endpoint.Close()
+
+	p, engine, _ := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{Name: "main"}}
+		c.Sinks = []SinkConfig{{Name: "bus", URL: endpoint.URL, Format: SinkFormatCloudEventsBinary}}
+	})
+	if err := p.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disable()
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", string(messageSentEvent))
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", string(messageLoadedEvent))
+
+	select {
+	case h := <-headers:
+		if h.Get("ce-type") != "com.postal.MessageSent" || h.Get("ce-source") != "/postal/main" || h.Get("Content-Type") != "application/json" {
+			t.Fatal("Unexpected binary mode headers: ", h)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CloudEvent was not delivered")
+	}
+
+	rec := serveWithToken(p, engine, http.MethodGet, "/plugin/1/custom/abc/postal/events?type=com.postal.MessageLoaded", "")
+	var events []CloudEvent
+	if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != "com.postal.MessageLoaded" {
+		t.Fatal("Unexpected event history: ", rec.Body.String())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// configMigration upgrades a configuration by one version. It returns the
+// changed settings, defaults are taken from DefaultConfig.
+type configMigration func(config, defaults *PluginConfig) []string
+
+// configMigrations[i] upgrades a configuration from version i to i+1. Append a
+// migration whenever settings are renamed or restructured.
+var configMigrations = []configMigration{
+	migrateUnversioned,
+}
+
+// currentConfigVersion is the version configurations are migrated to
+var currentConfigVersion = len(configMigrations)
+
+// UnmarshalYAML resets the version of configurations saved without
+// config_version to 0. Gotify reads saved configurations over DefaultConfig,
+// which is at the current version, so the missing key has to be detected.
+func (c *PluginConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	type plain PluginConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	var saved struct {
+		ConfigVersion *int `yaml:"config_version"`
+	}
+	if err := unmarshal(&saved); err != nil {
+		return err
+	}
+	if saved.ConfigVersion == nil {
+		c.ConfigVersion = 0
+	}
+	return nil
+}
+
+// migrate upgrades the configuration to the current version and returns a
+// description of each migration that changed something
+func (c *PluginConfig) migrate(defaults *PluginConfig) ([]string, error) {
+	if c.ConfigVersion < 0 || c.ConfigVersion > currentConfigVersion {
+		return nil, &configError{path: "config_version", err: fmt.Errorf("unsupported version %d, expected at most %d", c.ConfigVersion, currentConfigVersion)}
+	}
+	var applied []string
+	for c.ConfigVersion < currentConfigVersion {
+		if changes := configMigrations[c.ConfigVersion](c, defaults); len(changes) > 0 {
+			applied = append(applied, fmt.Sprintf("version %d to %d: %s", c.ConfigVersion, c.ConfigVersion+1, strings.Join(changes, ", ")))
+		}
+		c.ConfigVersion++
+	}
+	return applied, nil
+}
+
+// migrateUnversioned upgrades configurations saved before config_version was
+// introduced. Settings that didn't exist yet may be empty, they get their defaults.
+func migrateUnversioned(config, defaults *PluginConfig) []string {
+	var changes []string
+	fill := func(path string, value *string, defaultValue string) {
+		if *value == "" && defaultValue != "" {
+			*value = defaultValue
+			changes = append(changes, fmt.Sprintf("%s set to default '%s'", path, defaultValue))
+		}
+	}
+	fill("rate_alerts.window", &config.RateAlerts.Window, defaults.RateAlerts.Window)
+	fill("heartbeat.timeout", &config.Heartbeat.Timeout, defaults.Heartbeat.Timeout)
+	fill("report.interval", &config.Report.Interval, defaults.Report.Interval)
+	fill("report.weekday", &config.Report.Weekday, defaults.Report.Weekday)
+	fill("report.time", &config.Report.Time, defaults.Report.Time)
+	fill("escalation.after", &config.Escalation.After, defaults.Escalation.After)
+	fill("escalation.resolve_after", &config.Escalation.ResolveAfter, defaults.Escalation.ResolveAfter)
+	fill("mqtt.topic", &config.MQTT.Topic, defaults.MQTT.Topic)
+	fill("mqtt.keep_alive", &config.MQTT.KeepAlive, defaults.MQTT.KeepAlive)
+	fill("history_retention", &config.HistoryRetention, defaults.HistoryRetention)
+	fill("api_timeout", &config.APITimeout, defaults.APITimeout)
+	return changes
+}
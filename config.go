@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+// configError is an invalid setting, identified by its YAML path, e.g. profiles[1].signing_key
+type configError struct {
+	path string
+	err  error
+}
+
+func (e *configError) Error() string {
+	return e.path + ": " + e.err.Error()
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
+// configValidator collects the errors of all invalid settings, so that they can
+// be fixed at once
+type configValidator struct {
+	errs []error
+}
+
+// check records err for the setting at path, if it is not nil
+func (v *configValidator) check(path string, err error) {
+	if err != nil {
+		v.errs = append(v.errs, &configError{path: path, err: err})
+	}
+}
+
+// fail records an error for the setting at path
+func (v *configValidator) fail(path, format string, args ...any) {
+	v.check(path, fmt.Errorf(format, args...))
+}
+
+// err returns all recorded errors, one per line, or nil
+func (v *configValidator) err() error {
+	return errors.Join(v.errs...)
+}
+
+// duration checks a duration like "30m" or "7d", which must be positive, and
+// returns it
+func (v *configValidator) duration(path, s string) time.Duration {
+	d, err := parseDuration(s)
+	if err != nil {
+		v.fail(path, "invalid duration '%s'", s)
+	} else if d <= 0 {
+		v.fail(path, "duration must be positive")
+	}
+	return d
+}
+
+// httpURL checks an absolute http or https URL, empty if optional
+func (v *configValidator) httpURL(path, s string, optional bool) {
+	if s == "" {
+		if !optional {
+			v.fail(path, "URL is required")
+		}
+		return
+	}
+	if u, err := url.Parse(s); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.fail(path, "invalid URL '%s', expected http(s)://host", s)
+	}
+}
+
+// placeholders checks that s only contains the given {placeholders}
+func (v *configValidator) placeholders(path, s string, allowed ...string) {
+	for rest := s; ; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			return
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			v.fail(path, "unterminated placeholder in '%s'", s)
+			return
+		}
+		name := rest[start+1 : start+end]
+		valid := false
+		for _, placeholder := range allowed {
+			valid = valid || name == placeholder
+		}
+		if !valid {
+			v.fail(path, "unknown placeholder {%s}, expected one of {%s}", name, strings.Join(allowed, "}, {"))
+		}
+		rest = rest[start+end+1:]
+	}
+}
+
+// field returns the path of a setting below path
+func field(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// index returns the path of a list element
+func index(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+// validate checks all settings. Parsed values like signing keys, durations and
+// time windows are stored next to the settings they were parsed from.
+func (c *PluginConfig) validate(v *configValidator) {
+	names := map[string]bool{}
+	for i := range c.Profiles {
+		path := index("profiles", i)
+		c.Profiles[i].validate(v, path)
+		if name := c.Profiles[i].Name; names[name] {
+			v.fail(field(path, "name"), "duplicate profile name '%s'", name)
+		}
+		names[c.Profiles[i].Name] = true
+	}
+	c.RateAlerts.validate(v, "rate_alerts")
+	c.Heartbeat.validate(v, "heartbeat")
+	c.Report.validate(v, "report")
+	c.Quiet.validate(v, "quiet")
+	c.Escalation.validate(v, "escalation")
+	validateSinks(v, c.Sinks)
+	c.MQTT.validate(v, "mqtt")
+	validateProviders(v, c.Providers)
+	v.httpURL("public_url", c.PublicURL, true)
+	c.historyRetention = v.duration("history_retention", c.HistoryRetention)
+	c.apiTimeout = v.duration("api_timeout", c.APITimeout)
+}
+
+func (sp *ServerProfile) validate(v *configValidator, path string) {
+	if sp.Name == "" {
+		v.fail(field(path, "name"), "name is required")
+	}
+	if host := sp.Host; host != "" {
+		if !strings.Contains(host, "://") {
+			host = "https://" + host
+		}
+		if u, err := url.Parse(host); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.fail(field(path, "host"), "invalid host '%s', expected a hostname or http(s) URL", sp.Host)
+		}
+	}
+	v.httpURL(field(path, "api_url"), sp.APIURL, true)
+	v.httpURL(field(path, "held_action_url"), sp.HeldActionURL, true)
+	v.placeholders(field(path, "held_action_url"), sp.HeldActionURL, "id", "token", "action")
+	if sp.SigningKey != "" {
+		key, err := postal.ParsePublicKey(sp.SigningKey)
+		v.check(field(path, "signing_key"), err)
+		sp.signingKey = key
+	}
+	sp.Spam.validate(v, field(path, "spam"))
+}
+
+// compile validates the configuration and stores the state derived from it,
+// like parsed keys, durations and time windows. The configuration is shared by
+// all requests and components once it is set, so it must not be modified
+// afterwards.
+func (c *PluginConfig) compile() error {
+	v := &configValidator{}
+	c.validate(v)
+	return v.err()
+}
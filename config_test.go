@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotify/plugin-api"
+	"gopkg.in/yaml.v3"
+)
+
+type countingMessageHandler struct {
+	count atomic.Int64
+}
+
+func (h *countingMessageHandler) SendMessage(plugin.Message) error {
+	h.count.Add(1)
+	return nil
+}
+
+// validateSetting runs the validate method of a setting and returns its errors
+func validateSetting(validate func(*configValidator, string), path string) error {
+	v := &configValidator{}
+	validate(v, path)
+	return v.err()
+}
+
+func TestConfigValidationPaths(t *testing.T) {
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	config := p.DefaultConfig().(*PluginConfig)
+	config.Profiles = []ServerProfile{
+		{Name: "main", Host: "https://postal.example.com"},
+		{Name: "main", Host: "postal.example.com:port", SigningKey: "not a key", HeldActionURL: "https://hooks.example.com/{id}/{verb}"},
+	}
+	config.Report.Timezone = "Mars/Olympus_Mons"
+	config.Quiet.Hours = []QuietHours{{
+		TimeWindow:   TimeWindow{Start: "22:00", End: "25:00", Days: []string{"mon", "funday"}},
+		WindowPolicy: WindowPolicy{Policies: map[string]string{"MessageLoaded": "mute"}},
+	}}
+	config.Sinks = []SinkConfig{{Name: "hook", URL: "ftp://example.com", Retries: 1000}}
+	config.MQTT = MQTTConfig{Broker: "tcp://broker", Topic: "postal/{tenant}", KeepAlive: "60s"}
+	config.Providers = []ProviderConfig{{Provider: ProviderPostmark, Username: "gotify"}}
+	config.APITimeout = "soon"
+
+	err := p.ValidateAndSetConfig(config)
+	if err == nil {
+		t.Fatal("Invalid configuration accepted")
+	}
+	for _, path := range []string{
+		"profiles[1].name: duplicate profile name 'main'",
+		"profiles[1].host: invalid host",
+		"profiles[1].signing_key: ",
+		"profiles[1].held_action_url: unknown placeholder {verb}",
+		"report.timezone: unknown timezone 'Mars/Olympus_Mons'",
+		"quiet.hours[0].end: ",
+		"quiet.hours[0].days[1]: invalid day 'funday'",
+		"quiet.hours[0].policies.MessageLoaded: invalid quiet policy 'mute'",
+		"sinks[0].url: ",
+		"sinks[0].retries: must be at most 10",
+		"mqtt.topic: unknown placeholder {tenant}",
+		"providers[0].password: ",
+		"api_timeout: invalid duration 'soon'",
+	} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("Expected error for %s in:\n%s", path, err)
+		}
+	}
+	if strings.Contains(err.Error(), "profiles[0]") {
+		t.Error("Valid profile reported: ", err)
+	}
+	if p.config.Load() != nil {
+		t.Error("Invalid configuration was applied")
+	}
+	if err := p.ValidateAndSetConfig(&struct{}{}); err == nil {
+		t.Error("Unexpected configuration type accepted")
+	}
+}
+
+func TestConfigMigration(t *testing.T) {
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+
+	// the only setting of the first releases, read over the defaults like Gotify
+	// does, is detected as unversioned
+	config := p.DefaultConfig().(*PluginConfig)
+	if err := yaml.Unmarshal([]byte("verboseoutput: true\n"), config); err != nil {
+		t.Fatal(err)
+	}
+	if config.ConfigVersion != 0 {
+		t.Fatal("Configuration without config_version not detected, version: ", config.ConfigVersion)
+	}
+	if err := p.ValidateAndSetConfig(config); err != nil {
+		t.Fatal("Unversioned configuration rejected: ", err)
+	}
+	if applied := p.config.Load(); applied.ConfigVersion != currentConfigVersion || !applied.VerboseOutput || applied.MQTT.Topic != defaultMQTTTopic {
+		t.Fatalf("Configuration not migrated: %+v", applied)
+	}
+
+	// settings saved empty by an unversioned release get their defaults
+	config = p.DefaultConfig().(*PluginConfig)
+	if err := yaml.Unmarshal([]byte("verboseoutput: true\napi_timeout: \"\"\n"), config); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ValidateAndSetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if applied := p.config.Load(); applied.ConfigVersion != currentConfigVersion || applied.APITimeout != "5s" {
+		t.Fatalf("Configuration not migrated: %+v", applied)
+	}
+	if display := p.GetDisplay(nil); !strings.Contains(display, "Configuration migrated") || !strings.Contains(display, "api_timeout set to default '5s'") {
+		t.Fatal("Migration not displayed: ", display)
+	}
+
+	// the default configuration is current and needs no changes
+	defaults := p.DefaultConfig().(*PluginConfig)
+	if defaults.ConfigVersion != currentConfigVersion {
+		t.Fatal("Default configuration is not current, version: ", defaults.ConfigVersion)
+	}
+	if err := p.ValidateAndSetConfig(defaults); err != nil {
+		t.Fatal(err)
+	}
+	if display := p.GetDisplay(nil); strings.Contains(display, "Configuration migrated") {
+		t.Fatal("Current configuration reported as migrated: ", display)
+	}
+
+	// an explicit version is kept
+	saved := p.DefaultConfig().(*PluginConfig)
+	if err := yaml.Unmarshal([]byte(fmt.Sprintf("config_version: %d\nverboseoutput: true\n", currentConfigVersion)), saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.ConfigVersion != currentConfigVersion || !saved.VerboseOutput {
+		t.Fatalf("Saved configuration not read: %+v", saved)
+	}
+
+	future := p.DefaultConfig().(*PluginConfig)
+	future.ConfigVersion = currentConfigVersion + 1
+	if err := p.ValidateAndSetConfig(future); err == nil || !strings.Contains(err.Error(), "config_version: ") {
+		t.Fatal("Expected newer configuration version to be rejected, got: ", err)
+	}
+}
+
+func TestRequestsBeforeSetup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	engine := gin.New()
+	p.RegisterWebhook("/plugin/1/custom/abc/", engine.Group("/plugin/1/custom/abc/"))
+
+	if rec := serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", string(messageSentEvent)); rec.Code != http.StatusServiceUnavailable {
+		t.Fatal("Expected 503 without message handler and config, got: ", rec.Code)
+	}
+	handler := &recordingMessageHandler{}
+	p.SetMessageHandler(handler)
+	if rec := serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal/inbound", "{}"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatal("Expected 503 without config, got: ", rec.Code)
+	}
+	if err := p.ValidateAndSetConfig(p.DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", string(messageSentEvent)); rec.Code != http.StatusOK || len(handler.messages) != 1 {
+		t.Fatal("Expected webhook to be processed after setup, got: ", rec.Code)
+	}
+}
+
+func TestRejectedConfigIsNotApplied(t *testing.T) {
+	p, _, _ := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{Name: "main", Host: "postal.example.com"}}
+	})
+	config := p.DefaultConfig().(*PluginConfig)
+	config.Profiles = []ServerProfile{{Name: "main", SigningKey: "not a key"}}
+	if p.ValidateAndSetConfig(config) == nil {
+		t.Fatal("Invalid signing key accepted")
+	}
+	if profile := p.config.Load().profile("main"); profile == nil || profile.Host != "postal.example.com" {
+		t.Fatalf("Previous configuration replaced: %+v", profile)
+	}
+}
+
+func TestConfigSnapshotIsCompiled(t *testing.T) {
+	p, _, _ := newTestPlugin(t, func(c *PluginConfig) {
+		c.RateAlerts.Window = "10m"
+		c.Quiet.Hours = []QuietHours{{TimeWindow: TimeWindow{Start: "22:00", End: "07:00", Timezone: "UTC"}}}
+		c.Quiet.Maintenance = []MaintenanceWindow{{Start: "2024-01-01T22:30:00Z", End: "2024-01-02T01:00:00Z", WindowPolicy: WindowPolicy{Policy: QuietPolicyDrop}}}
+	})
+	config := p.config.Load()
+	if config.RateAlerts.window != 10*time.Minute || config.Escalation.resolveAfter != 2*time.Hour || config.historyRetention != 35*24*time.Hour {
+		t.Fatal("Durations were not parsed into the snapshot")
+	}
+	if !config.Quiet.Hours[0].Contains(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)) {
+		t.Fatal("Quiet hours were not parsed into the snapshot")
+	}
+	if label, _ := config.Quiet.activeWindow(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)); !strings.HasPrefix(label, "maintenance") {
+		t.Fatal("Maintenance window was not parsed into the snapshot, active window: ", label)
+	}
+}
+
+// TestConcurrentConfigUpdates changes the configuration while webhooks are handled,
+// run with -race
+func TestConcurrentConfigUpdates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	handler := &countingMessageHandler{}
+	p.SetMessageHandler(handler)
+	if err := p.ValidateAndSetConfig(p.DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	p.RegisterWebhook("/plugin/1/custom/abc/", engine.Group("/plugin/1/custom/abc/"))
+
+	const requests = 50
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < requests; i++ {
+			config := p.DefaultConfig().(*PluginConfig)
+			config.PublicURL = fmt.Sprintf("https://gotify%d.example.com", i)
+			config.Profiles = []ServerProfile{{Name: "main", Host: "postal.example.com", Organization: "org", Server: fmt.Sprint(i)}}
+			if err := p.ValidateAndSetConfig(config); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				recorder := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", strings.NewReader(string(messageSentEvent)))
+				engine.ServeHTTP(recorder, req)
+				if recorder.Code != http.StatusOK {
+					t.Error("Unexpected status: ", recorder.Code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if count := handler.count.Load(); count != 4*requests {
+		t.Fatalf("Expected %d notifications, got %d", 4*requests, count)
+	}
+}
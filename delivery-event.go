@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+// EventKind classifies delivery events independent of the mail provider
+type EventKind string
+
+const (
+	KindDelivered EventKind = "delivered"
+	KindDelayed   EventKind = "delayed"
+	KindFailed    EventKind = "failed"
+	KindHeld      EventKind = "held"
+	KindBounced   EventKind = "bounced"
+	KindOpened    EventKind = "opened"
+	KindClicked   EventKind = "clicked"
+	KindDNSError  EventKind = "dns_error"
+	KindReceived  EventKind = "received" // inbound mail
+	KindUnknown   EventKind = "unknown"
+)
+
+// InboundEventName is the event name of inbound mail, used by sinks and quiet hours
+const InboundEventName = "InboundMessage"
+
+// kindEvents maps kinds to the Postal event names used in the configuration,
+// e.g. for quiet hour policies and sink filters
+var kindEvents = map[EventKind]postal.EventType{
+	KindDelivered: postal.EventMessageSent,
+	KindDelayed:   postal.EventMessageDelayed,
+	KindFailed:    postal.EventMessageDeliveryFailed,
+	KindHeld:      postal.EventMessageHeld,
+	KindBounced:   postal.EventMessageBounced,
+	KindOpened:    postal.EventMessageLoaded,
+	KindClicked:   postal.EventMessageLinkClicked,
+	KindDNSError:  postal.EventDomainDNSError,
+	KindReceived:  InboundEventName,
+}
+
+// eventKind returns the kind of a Postal event
+func eventKind(eventType postal.EventType) EventKind {
+	for kind, name := range kindEvents {
+		if name == eventType {
+			return kind
+		}
+	}
+	return KindUnknown
+}
+
+// Severity tells how urgent an event is
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// MessageRef identifies the message an event refers to
+type MessageRef struct {
+	ID         int    `json:"id,omitempty"`         // Postal message ID
+	Token      string `json:"token,omitempty"`      // Postal message token or the provider's message ID
+	MessageID  string `json:"message_id,omitempty"` // Message-ID header
+	Subject    string `json:"subject,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Direction  string `json:"direction,omitempty"`
+	SpamStatus string `json:"spam_status,omitempty"`
+	BounceID   int    `json:"bounce_id,omitempty"` // Postal message ID of the bounce message
+}
+
+// ProviderResponse is what the provider or the receiving server reported
+type ProviderResponse struct {
+	Status  string `json:"status,omitempty"`  // provider status, e.g. Sent or HardFail
+	Details string `json:"details,omitempty"` // human readable description or reason
+	Output  string `json:"output,omitempty"`  // SMTP response of the receiving server
+	TLS     bool   `json:"tls,omitempty"`
+	// ReportedBy is the sender of the bounce message or the provider reporting it
+	ReportedBy string `json:"reported_by,omitempty"`
+	// Statuses are the per-recipient delivery statuses of a bounce, if known
+	Statuses []mailparse.DeliveryStatus `json:"statuses,omitempty"`
+}
+
+// Timings holds the durations and points in time of the message
+type Timings struct {
+	SentAt       *time.Time `json:"sent_at,omitempty"`
+	DeliveryTime float64    `json:"delivery_time,omitempty"` // seconds
+}
+
+// ClientInfo describes the client that opened a message or clicked a link
+type ClientInfo struct {
+	IPAddress string `json:"ip_address,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	URL       string `json:"url,omitempty"` // clicked link
+}
+
+// DNSCheck is the result of a failed DNS check of a sending domain
+type DNSCheck struct {
+	Domain     string `json:"domain"`
+	ServerUUID string `json:"server_uuid,omitempty"`
+	Permalink  string `json:"permalink,omitempty"`
+	SPF        string `json:"spf"`
+	DKIM       string `json:"dkim"`
+	MX         string `json:"mx"`
+	ReturnPath string `json:"return_path"`
+}
+
+// DeliveryEvent is the provider independent model of a webhook event. All
+// decoders produce it and everything after decoding works on it.
+type DeliveryEvent struct {
+	Event      string           `json:"event"` // Postal event name, also used for other providers
+	Kind       EventKind        `json:"kind"`
+	Severity   Severity         `json:"severity"`
+	ID         string           `json:"uuid,omitempty"`
+	Timestamp  time.Time        `json:"timestamp"`
+	Provider   string           `json:"provider"`
+	Profile    string           `json:"profile"`
+	Server     string           `json:"server,omitempty"`
+	MessageRef MessageRef       `json:"message_ref"`
+	Sender     string           `json:"sender,omitempty"`
+	Recipients []string         `json:"recipients,omitempty"`
+	Response   ProviderResponse `json:"response"`
+	Timings    Timings          `json:"timings"`
+	Client     *ClientInfo      `json:"client,omitempty"`
+	DNS        *DNSCheck        `json:"dns,omitempty"`
+	// Payload is the event as received from the provider
+	Payload json.RawMessage `json:"-"`
+}
+
+// newDeliveryEvent returns an event of the given kind with its name and severity set
+func newDeliveryEvent(provider string, kind EventKind, id string, at time.Time, payload json.RawMessage) *DeliveryEvent {
+	event := &DeliveryEvent{
+		Event:     string(kindEvents[kind]),
+		Kind:      kind,
+		ID:        id,
+		Timestamp: at,
+		Provider:  provider,
+		Payload:   payload,
+	}
+	event.classify()
+	return event
+}
+
+// classify sets the severity according to kind and bounce statuses
+func (e *DeliveryEvent) classify() {
+	switch e.Kind {
+	case KindDelivered, KindOpened, KindClicked, KindReceived, KindUnknown:
+		e.Severity = SeverityInfo
+	case KindDelayed, KindHeld:
+		e.Severity = SeverityWarning
+	case KindBounced:
+		if diagnosis := e.diagnosis(); diagnosis != nil && !diagnosis.Hard() {
+			e.Severity = SeverityWarning
+		} else {
+			e.Severity = SeverityCritical
+		}
+	default:
+		e.Severity = SeverityCritical
+	}
+}
+
+// recipient returns the first recipient or an empty string
+func (e *DeliveryEvent) recipient() string {
+	if len(e.Recipients) == 0 {
+		return ""
+	}
+	return e.Recipients[0]
+}
+
+// diagnosis returns the bounce diagnosis, nil if the statuses are unknown
+func (e *DeliveryEvent) diagnosis() *bounceDiagnosis {
+	if len(e.Response.Statuses) == 0 {
+		return nil
+	}
+	return &bounceDiagnosis{Statuses: e.Response.Statuses}
+}
+
+// setDiagnosis stores the delivery statuses of a bounce and updates the severity
+func (e *DeliveryEvent) setDiagnosis(diagnosis *bounceDiagnosis) {
+	e.Response.Statuses = diagnosis.Statuses
+	e.classify()
+}
+
+// muteKeys returns the keys the notification of the event can be snoozed by
+func (e *DeliveryEvent) muteKeys() []string {
+	if e.DNS != nil {
+		return []string{"dns:" + e.DNS.Domain}
+	}
+	return senderMuteKeys(e.Sender)
+}
+
+// problemKey identifies recurring problems for acknowledgements and escalation,
+// it is empty if the event is no problem
+func (e *DeliveryEvent) problemKey() string {
+	switch e.Kind {
+	case KindFailed:
+		return "delivery-failed:" + addressDomain(e.recipient()) + ":" + failureSignature(e.Response.Output, e.Response.Details)
+	case KindDNSError:
+		return "dns-error:" + e.DNS.ServerUUID + ":" + e.DNS.Domain
+	}
+	return ""
+}
+
+// fromPostalMessage fills message reference, sender and recipient from a Postal message
+func (e *DeliveryEvent) fromPostalMessage(msg postal.Message) {
+	e.MessageRef = MessageRef{
+		ID:         msg.ID,
+		Token:      msg.Token,
+		MessageID:  msg.MessageID,
+		Subject:    msg.Subject,
+		Direction:  msg.Direction,
+		SpamStatus: msg.SpamStatus,
+	}
+	if msg.Tag != nil {
+		e.MessageRef.Tag = *msg.Tag
+	}
+	e.Sender = msg.From
+	if msg.To != "" {
+		e.Recipients = []string{msg.To}
+	}
+	if msg.Timestamp > 0 {
+		sentAt := unixTime(msg.Timestamp)
+		e.Timings.SentAt = &sentAt
+	}
+}
+
+// newPostalDeliveryEvent converts a decoded Postal webhook
+func newPostalDeliveryEvent(event postal.Event) *DeliveryEvent {
+	envelope := event.Metadata()
+	e := &DeliveryEvent{
+		Event:     string(envelope.Event),
+		Kind:      eventKind(envelope.Event),
+		ID:        envelope.UUID,
+		Timestamp: timeNow(),
+		Provider:  "postal",
+		Payload:   envelope.Payload,
+	}
+	if envelope.Timestamp > 0 {
+		e.Timestamp = unixTime(envelope.Timestamp)
+	}
+
+	switch msg := event.(type) {
+	case *postal.MessageStatusEvent:
+		e.fromPostalMessage(msg.Message)
+		e.Response = ProviderResponse{Status: msg.Status, Details: msg.Details, Output: msg.Output, TLS: msg.SentWithSSL}
+		e.Timings.DeliveryTime = msg.Time
+	case *postal.MessageBounceEvent:
+		e.fromPostalMessage(msg.OriginalMessage)
+		e.MessageRef.BounceID = msg.Bounce.ID
+		e.Response = ProviderResponse{Details: msg.Bounce.Subject, ReportedBy: msg.Bounce.From}
+	case *postal.MessageClickEvent:
+		e.fromPostalMessage(msg.Message)
+		e.Client = &ClientInfo{IPAddress: msg.IPAddress, UserAgent: msg.UserAgent, URL: msg.URL}
+	case *postal.MessageLoadedEvent:
+		e.fromPostalMessage(msg.Message)
+		e.Client = &ClientInfo{IPAddress: msg.IPAddress, UserAgent: msg.UserAgent}
+	case *postal.DNSErrorEvent:
+		e.Server = msg.Server.Name
+		e.DNS = &DNSCheck{
+			Domain:     msg.Domain,
+			ServerUUID: msg.Server.UUID,
+			Permalink:  msg.Server.Permalink,
+			SPF:        msg.SPFStatus,
+			DKIM:       msg.DKIMStatus,
+			MX:         msg.MXStatus,
+			ReturnPath: msg.ReturnPathStatus,
+		}
+	}
+	e.classify()
+	return e
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+func TestPostalDeliveryEvent(t *testing.T) {
+	event, errMessage := decodeWebhook(messageSentEvent)
+	if errMessage != nil {
+		t.Fatal(errMessage.Message)
+	}
+	if event.Kind != KindDelivered || event.Severity != SeverityInfo || event.Provider != "postal" || event.Event != "MessageSent" {
+		t.Fatalf("Unexpected classification: %+v", event)
+	}
+	if event.Sender != "sales@awesomeapp.com" || len(event.Recipients) != 1 || event.Recipients[0] != "test@example.com" {
+		t.Fatalf("Unexpected addresses: %+v", event)
+	}
+	if event.MessageRef.ID != 12345 || event.MessageRef.Token != "abcdef123" || event.MessageRef.Tag != "welcome" {
+		t.Fatalf("Unexpected message reference: %+v", event.MessageRef)
+	}
+	if !event.Response.TLS || !strings.HasPrefix(event.Response.Output, "250") || event.Timings.DeliveryTime != 0.22 || event.Timings.SentAt == nil {
+		t.Fatalf("Unexpected response or timings: %+v %+v", event.Response, event.Timings)
+	}
+
+	clicked, _ := decodeWebhook(messageLinkClickedEvent)
+	if clicked.Kind != KindClicked || clicked.Client == nil || clicked.Client.URL == "" {
+		t.Fatalf("Unexpected click event: %+v", clicked)
+	}
+}
+
+func TestBounceSeverity(t *testing.T) {
+	event, _ := decodeWebhook(messageBouncedEvent)
+	if event.Kind != KindBounced || event.Severity != SeverityCritical {
+		t.Fatalf("Undiagnosed bounce should be critical: %+v", event)
+	}
+	event.setDiagnosis(&bounceDiagnosis{Statuses: []mailparse.DeliveryStatus{{Status: "4.2.2"}}})
+	if event.Severity != SeverityWarning {
+		t.Fatal("Soft bounce should be a warning, got: ", event.Severity)
+	}
+}
+
+// TestProviderEventsMatchPostal checks that a delivery reported by a provider is
+// rendered and published like the same Postal event
+func TestProviderEventsMatchPostal(t *testing.T) {
+	mailgun, err := mailgunAdapter{}.decode([]byte(`{"event-data":{"event":"delivered","id":"ev1","timestamp":1700000000,`+
+		`"recipient":"bob@example.com","message":{"headers":{"from":"app@example.org","subject":"Hi"}},`+
+		`"delivery-status":{"tls":true,"code":250,"message":"OK","session-seconds":1.5}}}`), nil)
+	if err != nil || len(mailgun) != 1 {
+		t.Fatal("Unexpected result: ", mailgun, err)
+	}
+	event := mailgun[0]
+	if event.Kind != KindDelivered || event.Event != "MessageSent" || event.Provider != ProviderMailgun || event.Sender != "app@example.org" {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+
+	p, engine, _ := newTestPlugin(t, nil)
+	notification := p.processWebhookMessage(event, nil)
+	if notification.Title != EmojiCheckMark+" Message delivered successfully" || !strings.Contains(notification.Message, "1.50 seconds") {
+		t.Fatal("Unexpected notification: ", notification)
+	}
+
+	event.Profile = "mailgun"
+	payload, err := newOutboundEvent(event.Payload, event, notification, "/mailgun").payload(SinkFormatNormalized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var normalized map[string]any
+	if err := json.Unmarshal(payload.body, &normalized); err != nil {
+		t.Fatal(err)
+	}
+	if normalized["kind"] != "delivered" || normalized["severity"] != "info" || normalized["provider"] != "mailgun" || normalized["title"] != notification.Title {
+		t.Fatal("Unexpected normalized event: ", string(payload.body))
+	}
+
+	// the history counts a provider event like a Postal event
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", string(messageSentEvent))
+	p.history.add(newHistoryEntry(event), p.config.Load().historyRetention)
+	summary := p.history.between(time.Time{}, timeNow().Add(time.Hour))
+	if summary.Events[postal.EventMessageSent] != 2 || summary.WithoutTLS != 0 || summary.DeliveryTimes[150] != 1 {
+		t.Fatalf("Unexpected history: %+v", summary)
+	}
+}
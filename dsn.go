@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+)
+
+// bounceDiagnosis is the result of analyzing a bounce message
+type bounceDiagnosis struct {
+	Statuses []mailparse.DeliveryStatus
+}
+
+// Hard reports whether any recipient failed permanently
+func (bd *bounceDiagnosis) Hard() bool {
+	for i := range bd.Statuses {
+		if bd.Statuses[i].Hard() {
+			return true
+		}
+	}
+	return false
+}
+
+// diagnoseBounce extracts the delivery status from a parsed bounce message. If the
+// bounce is no proper DSN, the first enhanced status code in the body is used.
+func diagnoseBounce(parsed *mailparse.Mail) *bounceDiagnosis {
+	if len(parsed.DeliveryStatus) > 0 {
+		return &bounceDiagnosis{Statuses: parsed.DeliveryStatus}
+	}
+	body := parsed.PlainBody
+	if body == "" {
+		body = htmlToMarkdown(parsed.HTMLBody)
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if code := enhancedStatusCode(line); code != "" {
+			return &bounceDiagnosis{Statuses: []mailparse.DeliveryStatus{{
+				Status:         code,
+				DiagnosticCode: strings.TrimSpace(line),
+			}}}
+		}
+	}
+	return nil
+}
+
+// render returns the markdown shown in bounce notifications. All fields come from
+// the remote server and are escaped, so that they can't inject markdown links.
+func (bd *bounceDiagnosis) render() string {
+	var sb strings.Builder
+	if bd.Hard() {
+		sb.WriteString("**Bounce type:** hard (permanent failure)\n\n")
+	} else {
+		sb.WriteString("**Bounce type:** soft (temporary failure)\n\n")
+	}
+	for _, status := range bd.Statuses {
+		if status.FinalRecipient != "" {
+			fmt.Fprintf(&sb, "**Final recipient:** %s\n\n", markdownEscape.Replace(status.FinalRecipient))
+		}
+		if status.Action != "" {
+			fmt.Fprintf(&sb, "**Action:** %s\n\n", markdownEscape.Replace(status.Action))
+		}
+		fmt.Fprintf(&sb, "**Status:** %s\n\n", markdownEscape.Replace(status.Status))
+		if status.DiagnosticCode != "" {
+			fmt.Fprintf(&sb, "**Diagnostic code:** %s\n\n", markdownEscape.Replace(status.DiagnosticCode))
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
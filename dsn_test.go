@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+)
+
+const dsnBounce = "From: MAILER-DAEMON@someserver.com\r\n" +
+	"To: abcde@psrp.postal.yourdomain.com\r\n" +
+	"Subject: Delivery Status Notification (Failure)\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=b1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; someserver.com\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; test@example.com\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 The email account that you tried to reach does\r\n" +
+	" not exist\r\n" +
+	"--b1--\r\n"
+
+func TestDiagnoseBounce(t *testing.T) {
+	parsed, err := mailparse.Parse([]byte(dsnBounce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diagnosis := diagnoseBounce(parsed)
+	if diagnosis == nil || len(diagnosis.Statuses) != 1 || !diagnosis.Hard() {
+		t.Fatal("Bounce was not classified as hard")
+	}
+}
+
+func TestDiagnoseBounceWithoutDSN(t *testing.T) {
+	parsed := &mailparse.Mail{PlainBody: "Hello,\n\n452 4.2.2 Mailbox full\n"}
+	diagnosis := diagnoseBounce(parsed)
+	if diagnosis == nil || diagnosis.Hard() || diagnosis.Statuses[0].Status != "4.2.2" {
+		t.Fatal("Expected soft bounce with status 4.2.2")
+	}
+}
+
+func TestBounceNotificationWithDiagnosis(t *testing.T) {
+	raw := base64.StdEncoding.EncodeToString([]byte(dsnBounce))
+	api := newFakePostalAPI(t, map[string]interface{}{
+		"messages/message": func(request map[string]interface{}) interface{} {
+			if request["id"] == 12347.0 {
+				return map[string]interface{}{"id": 12347, "raw_message": raw}
+			}
+			return map[string]interface{}{"id": 12345}
+		},
+		"messages/deliveries": []interface{}{},
+	})
+	defer api.Close()
+
+	p, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{Name: "main", APIURL: api.URL, APIKey: "secret"}}
+	})
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", string(messageBouncedEvent))
+
+	msg := handler.messages[0]
+	if msg.Title != EmojiExclamMark+" Hard bounce received" {
+		t.Fatal("Unexpected title: ", msg.Title)
+	}
+	if strings.Contains(msg.Message, bounceDetailsHint) || !strings.Contains(msg.Message, "**Diagnostic code:** 550 5.1.1") {
+		t.Fatal("Diagnosis missing in message: ", msg.Message)
+	}
+	if _, ok := p.suppressions.get("test@example.com"); !ok {
+		t.Fatal("Hard bounced recipient was not suppressed")
+	}
+}
+
+func TestBounceDiagnosisIsEscaped(t *testing.T) {
+	diagnosis := &bounceDiagnosis{Statuses: []mailparse.DeliveryStatus{{
+		FinalRecipient: "rfc822; <b>test</b>@example.com",
+		Status:         "5.1.1",
+		DiagnosticCode: "550 5.1.1 [Unlock your mailbox](https://attacker.example.com) *now*",
+	}}}
+	rendered := diagnosis.render()
+	if strings.Contains(rendered, "[Unlock your mailbox](") || strings.Contains(rendered, "; <b>") || strings.Contains(rendered, " *now*") {
+		t.Fatal("Diagnosis was not escaped: ", rendered)
+	}
+	if !strings.Contains(rendered, `**Diagnostic code:** 550 5.1.1 \[Unlock your mailbox\](https://attacker.example.com) \*now\*`) {
+		t.Fatal("Unexpected diagnostic code: ", rendered)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+// enrichedHeaders are shown in enriched notifications, in this order
+var enrichedHeaders = []string{"from", "to", "reply-to", "subject", "date", "message-id", "x-mailer"}
+
+const enrichedExcerptLength = 300
+
+// apiClient returns the Postal API client of the profile, or nil if none is configured
+func (c *PluginConfig) apiClient(profileName string) *postalAPIClient {
+	profile := c.profile(profileName)
+	if profile == nil || profile.APIKey == "" {
+		return nil
+	}
+	baseURL := profile.APIURL
+	if baseURL == "" {
+		baseURL = profile.Host
+	}
+	return newPostalAPIClient(baseURL, profile.APIKey)
+}
+
+// enrich adds details fetched from the Postal API to failure and bounce
+// notifications. All API calls share one deadline of api_timeout and end with
+// the request. If the API can't be reached, the notification only notes that.
+// For bounces, the diagnosis is stored in the event if it could be determined.
+func (p *Plugin) enrich(ctx context.Context, config *PluginConfig, notification *GotifyMessage, event *DeliveryEvent) {
+	client := config.apiClient(event.Profile)
+	if client == nil || event.MessageRef.ID == 0 {
+		return
+	}
+	switch event.Kind {
+	case KindFailed, KindDelayed, KindBounced:
+	default:
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.apiTimeout)
+	defer cancel()
+	if event.Kind == KindBounced {
+		diagnosis, err := fetchBounceDiagnosis(ctx, client, event.MessageRef.BounceID)
+		if err != nil {
+			notification.Message += fmt.Sprintf("\n\n_Could not diagnose the bounce: %s_", err)
+		} else if diagnosis != nil {
+			event.setDiagnosis(diagnosis)
+			applyBounceDiagnosis(notification, diagnosis)
+		}
+	}
+
+	details, err := client.message(ctx, event.MessageRef.ID, "plain_body", "headers")
+	if err == nil {
+		var deliveries []postal.APIDelivery
+		if deliveries, err = client.deliveries(ctx, event.MessageRef.ID); err == nil {
+			notification.Message += "\n\n" + renderMessageDetails(details, deliveries)
+			return
+		}
+	}
+	notification.Message += fmt.Sprintf("\n\n_Could not fetch message details from Postal: %s_", err)
+}
+
+// renderMessageDetails renders body excerpt, key headers and delivery attempts.
+// Headers, body and delivery details are escaped, they can contain markdown links.
+func renderMessageDetails(details *postal.APIMessage, deliveries []postal.APIDelivery) string {
+	var sb strings.Builder
+	sb.WriteString("---\n\n")
+
+	if len(details.Headers) > 0 {
+		sb.WriteString("**Headers:**\n\n")
+		for _, name := range enrichedHeaders {
+			if values := details.Headers[name]; len(values) > 0 {
+				fmt.Fprintf(&sb, "- %s: %s\n", name, markdownEscape.Replace(mailparse.DecodeHeader(values[0])))
+			}
+		}
+		sb.WriteString("\n")
+	}
+
+	if details.PlainBody != nil && strings.TrimSpace(*details.PlainBody) != "" {
+		sb.WriteString("**Body:**\n\n")
+		for _, line := range strings.Split(excerpt(strings.TrimSpace(*details.PlainBody), enrichedExcerptLength), "\n") {
+			sb.WriteString("> " + markdownEscape.Replace(line) + "\n")
+		}
+		sb.WriteString("\n")
+	}
+
+	if len(deliveries) > 0 {
+		sb.WriteString("**Delivery attempts:**\n\n")
+		for i, delivery := range deliveries {
+			at := time.Unix(int64(delivery.Timestamp), 0).Format("2006-01-02 15:04:05")
+			fmt.Fprintf(&sb, "%d. %s **%s**: %s", i+1, at, markdownEscape.Replace(delivery.Status), markdownEscape.Replace(delivery.Details))
+			if delivery.Output != "" {
+				fmt.Fprintf(&sb, " `%s`", strings.ReplaceAll(strings.TrimSpace(delivery.Output), "`", "'"))
+			}
+			sb.WriteString("\n")
+		}
+	}
+
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// fetchBounceDiagnosis fetches the raw bounce message and analyzes its DSN
+func fetchBounceDiagnosis(ctx context.Context, client *postalAPIClient, bounceID int) (*bounceDiagnosis, error) {
+	bounce, err := client.message(ctx, bounceID, "raw_message")
+	if err != nil {
+		return nil, err
+	}
+	if bounce.RawMessage == nil {
+		return nil, errors.New("postal API did not return the raw bounce message")
+	}
+	raw, err := base64.StdEncoding.DecodeString(*bounce.RawMessage)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode raw bounce message: %w", err)
+	}
+	parsed, err := mailparse.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return diagnoseBounce(parsed), nil
+}
+
+// applyBounceDiagnosis shows the bounce type in the title and replaces the details hint
+func applyBounceDiagnosis(notification *GotifyMessage, diagnosis *bounceDiagnosis) {
+	if diagnosis.Hard() {
+		notification.Title = EmojiExclamMark + " Hard bounce received"
+	} else {
+		notification.Title = EmojiWarningSign + " Soft bounce received"
+	}
+	notification.Message = strings.Replace(notification.Message, bounceDetailsHint, diagnosis.render(), 1)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+// newFakePostalAPI serves the given data for each API endpoint. If the data is a
+// func(map[string]interface{}) interface{}, it is called with the request.
+func newFakePostalAPI(t *testing.T, responses map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Server-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		data, ok := responses[strings.TrimPrefix(r.URL.Path, "/api/v1/")]
+		if !ok {
+			t.Error("Unexpected API call: ", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if fn, ok := data.(func(map[string]interface{}) interface{}); ok {
+			var request map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&request)
+			data = fn(request)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": data})
+	}))
+}
+
+var failedEvent = strings.Replace(string(messageSentEvent), `"event": "MessageSent"`, `"event": "MessageDeliveryFailed"`, 1)
+
+func TestEnrichFailureNotification(t *testing.T) {
+	api := newFakePostalAPI(t, map[string]interface{}{
+		"messages/message": map[string]interface{}{
+			"id":         12345,
+			"plain_body": "Hello,\nwelcome to AwesomeApp!",
+			"headers": map[string][]string{
+				"from":    {"sales@awesomeapp.com"},
+				"subject": {"=?UTF-8?Q?Willkommen_bei_AwesomeApp?="},
+			},
+		},
+		"messages/deliveries": []map[string]interface{}{
+			{"id": 1, "status": "SoftFail", "details": "Connection refused", "timestamp": 1477945177.0},
+			{"id": 2, "status": "HardFail", "details": "Recipient rejected", "output": "550 5.1.1 unknown user", "timestamp": 1477945277.0},
+		},
+	})
+	defer api.Close()
+
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{Name: "main", APIURL: api.URL, APIKey: "secret"}}
+	})
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", failedEvent)
+
+	msg := handler.messages[0].Message
+	for _, expected := range []string{
+		"- subject: Willkommen bei AwesomeApp",
+		"> Hello,\n> welcome to AwesomeApp!",
+		"**SoftFail**: Connection refused",
+		"**HardFail**: Recipient rejected `550 5.1.1 unknown user`",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatal("Message does not contain '"+expected+"', got: ", msg)
+		}
+	}
+}
+
+func TestRenderMessageDetailsIsEscaped(t *testing.T) {
+	body := "Hi,\n[Reset your password](https://attacker.example.com)"
+	details := &postal.APIMessage{
+		PlainBody: &body,
+		Headers:   map[string][]string{"subject": {"Invoice ![pixel](https://attacker.example.com/p.png)"}},
+	}
+	deliveries := []postal.APIDelivery{{Status: "HardFail", Details: "Rejected <a href=x>*here*</a>"}}
+	rendered := renderMessageDetails(details, deliveries)
+	for _, expected := range []string{
+		`- subject: Invoice !\[pixel\](https://attacker.example.com/p.png)`,
+		`> \[Reset your password\](https://attacker.example.com)`,
+		`**HardFail**: Rejected \<a href=x>\*here\*\</a>`,
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Fatal("Message does not contain '"+expected+"', got: ", rendered)
+		}
+	}
+}
+
+func TestEnrichFallsBackWithoutAPI(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer api.Close()
+
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{Name: "main", APIURL: api.URL, APIKey: "secret"}}
+	})
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", failedEvent)
+
+	if len(handler.messages) != 1 || strings.Contains(handler.messages[0].Message, "Delivery attempts") ||
+		!strings.Contains(handler.messages[0].Message, "_Could not fetch message details from Postal: postal API returned status 500") {
+		t.Fatal("Expected the plain notification with a note, got: ", handler.messages)
+	}
+}
+
+func TestEnrichUsesOneDeadline(t *testing.T) {
+	api := newFakePostalAPI(t, map[string]interface{}{
+		"messages/message": func(map[string]interface{}) interface{} {
+			time.Sleep(150 * time.Millisecond)
+			return map[string]interface{}{"id": 12345}
+		},
+		"messages/deliveries": func(map[string]interface{}) interface{} {
+			time.Sleep(150 * time.Millisecond)
+			return []interface{}{}
+		},
+	})
+	defer api.Close()
+
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{Name: "main", APIURL: api.URL, APIKey: "secret"}}
+		c.APITimeout = "200ms"
+	})
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", failedEvent)
+
+	// each call is faster than api_timeout, but both together are not
+	if msg := handler.messages[0].Message; !strings.Contains(msg, "context deadline exceeded") {
+		t.Fatal("API calls exceeded the overall deadline, got: ", msg)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EscalationConfig configures re-notification of problems that keep occurring.
+// Occurrences of a known problem are suppressed until After has passed since
+// the last notice, then it is sent again with a higher priority.
+type EscalationConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	After        string `yaml:"after"`
+	ResolveAfter string `yaml:"resolve_after"` // problem is considered resolved if it didn't occur for this long
+	PriorityStep int    `yaml:"priority_step"`
+	MaxPriority  int    `yaml:"max_priority"`
+
+	after, resolveAfter time.Duration // parsed After and ResolveAfter
+}
+
+func defaultEscalationConfig() EscalationConfig {
+	return EscalationConfig{
+		Enabled:      false,
+		After:        "30m",
+		ResolveAfter: "2h",
+		PriorityStep: 2,
+		MaxPriority:  10,
+	}
+}
+
+func (ec *EscalationConfig) validate(v *configValidator, path string) {
+	ec.after = v.duration(field(path, "after"), ec.After)
+	ec.resolveAfter = v.duration(field(path, "resolve_after"), ec.ResolveAfter)
+	if ec.PriorityStep < 0 {
+		v.fail(field(path, "priority_step"), "must not be negative")
+	}
+	if ec.MaxPriority < 0 || ec.MaxPriority > 10 {
+		v.fail(field(path, "max_priority"), "priority must be between 0 and 10")
+	}
+}
+
+// maxListedOccurrences limits the suppressed occurrences listed in a notice
+const maxListedOccurrences = 10
+
+type problemState struct {
+	title       string
+	lastNotice  time.Time
+	lastSeen    time.Time
+	priority    int
+	notices     int
+	occurrences int      // suppressed since the last notice
+	examples    []string // first lines of the suppressed notifications
+	acked       bool
+}
+
+// suppress records an occurrence that is not notified
+func (ps *problemState) suppress(notification *GotifyMessage) {
+	ps.occurrences++
+	if len(ps.examples) < maxListedOccurrences {
+		ps.examples = append(ps.examples, firstLine(notification.Message))
+	}
+}
+
+// occurrenceSummary describes the occurrences since the last notice
+func (ps *problemState) occurrenceSummary() string {
+	summary := fmt.Sprintf("_Occurred %d more times since %s", ps.occurrences, ps.lastNotice.Format("2006-01-02 15:04"))
+	if len(ps.examples) == 0 {
+		return summary + "._\n\n"
+	}
+	summary += ", including:_\n"
+	for _, example := range ps.examples {
+		summary += "- " + example + "\n"
+	}
+	if more := ps.occurrences - len(ps.examples); more > 0 {
+		summary += fmt.Sprintf("- and %d more\n", more)
+	}
+	return summary + "\n"
+}
+
+// firstLine returns the first non-empty line of a message
+func firstLine(message string) string {
+	for _, line := range strings.Split(message, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// escalator tracks ongoing problems and decides when to re-notify
+type escalator struct {
+	mu       sync.Mutex
+	problems map[string]*problemState
+}
+
+func newEscalator() *escalator {
+	return &escalator{
+		problems: map[string]*problemState{},
+	}
+}
+
+// apply returns the notification to send, or nil if it is suppressed
+// because the problem was already reported recently or was acknowledged
+func (e *escalator) apply(config *EscalationConfig, notification *GotifyMessage) *GotifyMessage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !config.Enabled || notification.problem == "" {
+		return notification
+	}
+
+	now := timeNow()
+	state, ok := e.problems[notification.problem]
+	if !ok || now.Sub(state.lastSeen) >= config.resolveAfter {
+		// new problem or it occurs again after being resolved
+		if ok && state.occurrences > 0 && !state.acked {
+			notification.Message = state.occurrenceSummary() + notification.Message
+		}
+		e.problems[notification.problem] = &problemState{
+			title:      notification.Title,
+			lastNotice: now,
+			lastSeen:   now,
+			priority:   notification.Priority,
+			notices:    1,
+		}
+		return notification
+	}
+
+	state.lastSeen = now
+	if state.acked || now.Sub(state.lastNotice) < config.after {
+		state.suppress(notification)
+		return nil
+	}
+
+	state.notices++
+	state.priority = min(state.priority+config.PriorityStep, config.MaxPriority)
+	notification.Priority = max(notification.Priority, state.priority)
+	notification.Title += fmt.Sprintf(" (still ongoing, %s notice)", ordinal(state.notices))
+	if state.occurrences > 0 {
+		notification.Message = state.occurrenceSummary() + notification.Message
+	}
+	state.lastNotice = now
+	state.occurrences = 0
+	state.examples = nil
+	return notification
+}
+
+// prune forgets resolved problems. For problems with occurrences that were
+// suppressed since the last notice, a final notice is returned, so that no
+// occurrence goes unreported.
+func (e *escalator) prune(config *EscalationConfig) []*GotifyMessage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := timeNow()
+	var notices []*GotifyMessage
+	for problem, state := range e.problems {
+		if now.Sub(state.lastSeen) < config.resolveAfter {
+			continue
+		}
+		if state.occurrences > 0 && !state.acked {
+			notices = append(notices, &GotifyMessage{
+				Title:    state.title + " (resolved)",
+				Message:  state.occurrenceSummary() + fmt.Sprintf("Last seen %s.", state.lastSeen.Format("2006-01-02 15:04")),
+				Priority: state.priority,
+			})
+		}
+		delete(e.problems, problem)
+	}
+	return notices
+}
+
+// tracks reports whether the problem is tracked, so that it can be acknowledged
+func (e *escalator) tracks(config *EscalationConfig, problem string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.problems[problem]
+	return ok && config.Enabled
+}
+
+// acknowledge stops reminders for the problem until it is resolved
+func (e *escalator) acknowledge(problem string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	state, ok := e.problems[problem]
+	if !ok {
+		return false
+	}
+	state.acked = true
+	return true
+}
+
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
+
+var (
+	// smtpReplyRegex matches the reply code at the start of an SMTP response and
+	// an enhanced status code directly following it, e.g. "550 5.1.1 User unknown"
+	smtpReplyRegex = regexp.MustCompile(`^([245]\d\d)(?:[ -]([245]\.\d{1,3}\.\d{1,3})(?:\s|$))?(?:[ -]|$)`)
+	// enhancedStatusCodeRegex matches an enhanced status code (RFC 3463) standing
+	// on its own, not as part of an IP address or version number
+	enhancedStatusCodeRegex = regexp.MustCompile(`(?:^|[\s(\[;:])([245]\.\d{1,3}\.\d{1,3})(?:$|[\s)\],;:]|\.(?:\s|$))`)
+)
+
+// enhancedStatusCode returns the first enhanced status code in s, e.g. "5.1.1"
+func enhancedStatusCode(s string) string {
+	if match := enhancedStatusCodeRegex.FindStringSubmatch(s); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// smtpStatus returns the enhanced status code or, if there is none, the reply
+// code of the SMTP response. Reply codes are only taken from the start of the
+// output, other numbers like ports or sizes are no status. It is empty if the
+// status is unknown.
+func smtpStatus(output, details string) string {
+	match := smtpReplyRegex.FindStringSubmatch(strings.TrimSpace(output))
+	if match != nil && match[2] != "" {
+		return match[2]
+	}
+	for _, s := range []string{output, details} {
+		if code := enhancedStatusCode(s); code != "" {
+			return code
+		}
+	}
+	if match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// failureSignature reduces an SMTP output to something that is equal for
+// failures with the same cause, e.g. the enhanced status code "5.1.1"
+func failureSignature(output, details string) string {
+	if status := smtpStatus(output, details); status != "" {
+		return status
+	}
+	signature := strings.ToLower(strings.TrimSpace(details))
+	if len(signature) > 64 {
+		signature = signature[:64]
+	}
+	return signature
+}
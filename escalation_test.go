@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscalation(t *testing.T) {
+	fixed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	config := defaultEscalationConfig()
+	config.Enabled = true
+	if err := validateSetting(config.validate, "escalation"); err != nil {
+		t.Fatal(err)
+	}
+	e := newEscalator()
+	notify := func() *GotifyMessage {
+		return e.apply(&config, &GotifyMessage{Title: "DNS setup check failed", Priority: 5, problem: "dns-error:example.com"})
+	}
+
+	if notify() == nil {
+		t.Fatal("First notice was suppressed")
+	}
+	fixed = fixed.Add(10 * time.Minute)
+	if notify() != nil {
+		t.Fatal("Repeated occurrence was not suppressed")
+	}
+
+	fixed = fixed.Add(25 * time.Minute)
+	second := notify()
+	if second == nil || second.Priority != 7 || !strings.HasSuffix(second.Title, "(still ongoing, 2nd notice)") {
+		t.Fatal("Expected escalated 2nd notice")
+	}
+	fixed = fixed.Add(30 * time.Minute)
+	if third := notify(); third == nil || third.Priority != 9 || !strings.Contains(third.Title, "3rd notice") {
+		t.Fatal("Expected escalated 3rd notice")
+	}
+
+	e.acknowledge("dns-error:example.com")
+	fixed = fixed.Add(time.Hour)
+	if notify() != nil {
+		t.Fatal("Acknowledged problem was escalated")
+	}
+
+	// resolved problems start over
+	fixed = fixed.Add(3 * time.Hour)
+	if first := notify(); first == nil || first.Priority != 5 {
+		t.Fatal("Expected a fresh notice after the problem was resolved")
+	}
+}
+
+func TestEscalationCountsSuppressedOccurrences(t *testing.T) {
+	fixed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	config := defaultEscalationConfig()
+	config.Enabled = true
+	if err := validateSetting(config.validate, "escalation"); err != nil {
+		t.Fatal(err)
+	}
+	e := newEscalator()
+	fail := func(recipient string) *GotifyMessage {
+		return e.apply(&config, &GotifyMessage{
+			Title:   "Message delivery failed",
+			Message: "_From app@example.com to " + recipient + "_\n\nConnection refused",
+			problem: "delivery-failed:example.org:421",
+		})
+	}
+
+	fail("a@example.org")
+	fixed = fixed.Add(time.Minute)
+	fail("b@example.org")
+	fail("c@example.org")
+	fixed = fixed.Add(30 * time.Minute)
+	notice := fail("d@example.org")
+	if notice == nil || !strings.Contains(notice.Message, "Occurred 2 more times") ||
+		!strings.Contains(notice.Message, "to b@example.org") || !strings.Contains(notice.Message, "to c@example.org") {
+		t.Fatal("Suppressed occurrences are missing in the notice: ", notice)
+	}
+
+	fixed = fixed.Add(time.Minute)
+	fail("e@example.org")
+	if notices := e.prune(&config); len(notices) != 0 {
+		t.Fatal("Ongoing problem was pruned")
+	}
+	fixed = fixed.Add(3 * time.Hour)
+	notices := e.prune(&config)
+	if len(notices) != 1 || !strings.Contains(notices[0].Message, "to e@example.org") {
+		t.Fatal("Expected a final notice with the suppressed occurrence, got: ", notices)
+	}
+	if len(e.problems) != 0 {
+		t.Fatal("Resolved problem was not pruned")
+	}
+}
+
+func TestFailureSignature(t *testing.T) {
+	for _, test := range []struct {
+		output, details, signature string
+	}{
+		{"550 5.1.1 <test@example.com>: Recipient address rejected", "", "5.1.1"},
+		{"550-5.7.1 Blocked\r\n550 5.7.1 See https://example.com", "", "5.7.1"},
+		{"421 Too many connections", "", "421"},
+		{"", "Relaying denied, status 5.7.1.", "5.7.1"},
+		// numbers that look like status codes, but are none
+		{"", "Connection refused (421)", "connection refused (421)"},
+		{"Connection to mx.example.com:587 timed out", "Timeout", "timeout"},
+		{"", "Message size 5242880 exceeds 500 kB", "message size 5242880 exceeds 500 kB"},
+		{"", "Could not connect to 5.9.1.20", "could not connect to 5.9.1.20"},
+		{"", "Postfix 3.5.6 refused the connection", "postfix 3.5.6 refused the connection"},
+	} {
+		if s := failureSignature(test.output, test.details); s != strings.ToLower(test.signature) {
+			t.Errorf("Unexpected signature of '%s' / '%s': %s", test.output, test.details, s)
+		}
+	}
+}
+
+func TestMisleadingNumbersAreNoPermanentFailure(t *testing.T) {
+	for _, details := range []string{
+		"Connection to mx.example.com:587 timed out",
+		"500 kB message could not be delivered",
+		"Could not connect to 5.9.1.20",
+	} {
+		if status := smtpStatus("", details); status != "" {
+			t.Errorf("Status %s found in '%s'", status, details)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+// eventHandler turns one webhook event type into a notification. Events of other
+// providers are rendered by the handler registered for their Postal event name.
+type eventHandler interface {
+	// decode converts the payload of the envelope into a delivery event
+	decode(envelope *postal.Envelope) (*DeliveryEvent, error)
+	// filterKeys returns the problem key used for acknowledgements and escalation
+	// (empty if the event is no problem) and the keys the notification can be snoozed by
+	filterKeys(event *DeliveryEvent) (problem string, muteKeys []string)
+	// render builds the notification without click URL and filter keys
+	render(event *DeliveryEvent) *GotifyMessage
+	// clickURL returns the URL opened when clicking the notification, or nil
+	clickURL(event *DeliveryEvent, msInfo *PostalMailserverInfo) *string
+}
+
+var (
+	eventHandlersMu sync.RWMutex
+	eventHandlers   = map[postal.EventType]eventHandler{}
+)
+
+// registerEventHandler adds or replaces the handler of an event type
+func registerEventHandler(eventType postal.EventType, handler eventHandler) {
+	eventHandlersMu.Lock()
+	defer eventHandlersMu.Unlock()
+	eventHandlers[eventType] = handler
+}
+
+// lookupEventHandler returns the handler of the event name, falling back to unknownEventHandler
+func lookupEventHandler(eventType string) eventHandler {
+	eventHandlersMu.RLock()
+	defer eventHandlersMu.RUnlock()
+	if handler, ok := eventHandlers[postal.EventType(eventType)]; ok {
+		return handler
+	}
+	return unknownEventHandler{}
+}
+
+// decodeWebhook decodes the body with the handler registered for its event. On
+// failure, the error is returned as notification naming the event.
+func decodeWebhook(body []byte) (*DeliveryEvent, *GotifyMessage) {
+	envelope, err := postal.DecodeEnvelope(body)
+	if err != nil {
+		return nil, &GotifyMessage{
+			Title:   "Error unmarshalling Postal message",
+			Message: err.Error(),
+		}
+	}
+	event, err := lookupEventHandler(string(envelope.Event)).decode(envelope)
+	if err != nil {
+		return nil, &GotifyMessage{
+			Title:   fmt.Sprintf("Error handling %s event", envelope.Event),
+			Message: err.Error(),
+			event:   string(envelope.Event),
+		}
+	}
+	return event, nil
+}
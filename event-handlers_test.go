@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+func TestDecodeErrorNamesEvent(t *testing.T) {
+	p := &Plugin{}
+	for _, event := range []string{"MessageSent", "MessageBounced", "MessageLinkClicked", "MessageLoaded", "DomainDNSError"} {
+		result := p.processWebhookBytes([]byte(`{"event":"`+event+`","payload":[]}`), nil)
+		if result.Title != "Error handling "+event+" event" {
+			t.Error("Unexpected title: ", result.Title)
+		}
+	}
+	if result := p.processWebhookBytes([]byte(`{"event":`), nil); result.Title != "Error unmarshalling Postal message" {
+		t.Error("Unexpected title: ", result.Title)
+	}
+	if result := p.processWebhookBytes([]byte(`{"event":"SomethingNew","payload":{}}`), nil); !strings.Contains(result.Message, "SomethingNew") {
+		t.Error("Unknown event not reported: ", result.Message)
+	}
+}
+
+// testSuppressionHandler handles a custom event unknown to the postal package
+type testSuppressionHandler struct{}
+
+func (testSuppressionHandler) decode(envelope *postal.Envelope) (*DeliveryEvent, error) {
+	var payload struct {
+		Address string `json:"address"`
+	}
+	if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+		return nil, err
+	}
+	event := newDeliveryEvent("postal", KindUnknown, envelope.UUID, timeNow(), envelope.Payload)
+	event.Event = string(envelope.Event)
+	event.Recipients = []string{payload.Address}
+	return event, nil
+}
+
+func (testSuppressionHandler) filterKeys(event *DeliveryEvent) (string, []string) {
+	return "suppressed:" + event.recipient(), nil
+}
+
+func (testSuppressionHandler) render(event *DeliveryEvent) *GotifyMessage {
+	return &GotifyMessage{Title: "Suppressed " + event.recipient()}
+}
+
+func (testSuppressionHandler) clickURL(*DeliveryEvent, *PostalMailserverInfo) *string {
+	return nil
+}
+
+func TestCustomEventHandler(t *testing.T) {
+	registerEventHandler("AddressSuppressed", testSuppressionHandler{})
+	defer func() {
+		eventHandlersMu.Lock()
+		delete(eventHandlers, "AddressSuppressed")
+		eventHandlersMu.Unlock()
+	}()
+
+	p := &Plugin{}
+	result := p.processWebhookBytes([]byte(`{"event":"AddressSuppressed","payload":{"address":"a@example.com"}}`), nil)
+	if result.Title != "Suppressed a@example.com" || result.problem != "suppressed:a@example.com" || result.event != "AddressSuppressed" {
+		t.Fatal("Custom handler not used: ", result)
+	}
+}
+
+func BenchmarkDecodeWebhook(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(messageSentEvent)))
+	for i := 0; i < b.N; i++ {
+		if _, errMessage := decodeWebhook(messageSentEvent); errMessage != nil {
+			b.Fatal(errMessage.Message)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeartbeatConfig configures the dead man's switch that alerts when
+// a server profile did not send any webhooks for a while
+type HeartbeatConfig struct {
+	Enabled       bool        `yaml:"enabled"`
+	Timeout       string      `yaml:"timeout"`
+	BusinessHours *TimeWindow `yaml:"business_hours"` // only alert within these hours, if set
+
+	timeout time.Duration // parsed Timeout
+}
+
+func defaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		Enabled: false,
+		Timeout: "1h",
+	}
+}
+
+func (hc *HeartbeatConfig) validate(v *configValidator, path string) {
+	hc.timeout = v.duration(field(path, "timeout"), hc.Timeout)
+	if hc.BusinessHours != nil {
+		hc.BusinessHours.validate(v, field(path, "business_hours"))
+	}
+}
+
+type heartbeatState struct {
+	lastSeen     time.Time // zero if no webhook arrived yet
+	trackedSince time.Time
+	alerted      bool
+}
+
+// silentSince returns the start of the current silence period
+func (hs *heartbeatState) silentSince() time.Time {
+	if hs.lastSeen.IsZero() {
+		return hs.trackedSince
+	}
+	return hs.lastSeen
+}
+
+// heartbeatMonitor remembers when the last webhook of each profile arrived
+type heartbeatMonitor struct {
+	mu       sync.Mutex
+	profiles map[string]*heartbeatState
+}
+
+func newHeartbeatMonitor() *heartbeatMonitor {
+	return &heartbeatMonitor{
+		profiles: map[string]*heartbeatState{},
+	}
+}
+
+// track makes sure that exactly the given profiles are tracked, caller must hold
+// the lock. Profiles that were never seen are tracked from now on, so that they
+// are reported if they never send anything.
+func (hm *heartbeatMonitor) track(profiles []string) {
+	for _, profile := range profiles {
+		if _, ok := hm.profiles[profile]; !ok {
+			hm.profiles[profile] = &heartbeatState{trackedSince: timeNow()}
+		}
+	}
+	for profile := range hm.profiles {
+		if !slices.Contains(profiles, profile) {
+			delete(hm.profiles, profile)
+		}
+	}
+}
+
+// seen records a webhook that was accepted and returns a recovery notice if
+// the profile was reported as silent before. Profiles other than the given
+// configured ones are ignored.
+func (hm *heartbeatMonitor) seen(profiles []string, profile string) *GotifyMessage {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	hm.track(profiles)
+	now := timeNow()
+	state, ok := hm.profiles[profile]
+	if !ok {
+		return nil
+	}
+	silence := now.Sub(state.silentSince())
+	state.lastSeen = now
+
+	if !state.alerted {
+		return nil
+	}
+	state.alerted = false
+	return &GotifyMessage{
+		Title:    EmojiCheckMark + " Postal webhooks received again from profile " + profile,
+		Message:  fmt.Sprintf("Webhooks are arriving again after %s of silence.", silence.Round(time.Minute)),
+		Priority: PriorityRecovered,
+	}
+}
+
+// check returns alerts for all profiles that have been silent for too long
+func (hm *heartbeatMonitor) check(config *HeartbeatConfig, profiles []string) []*GotifyMessage {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	hm.track(profiles)
+	now := timeNow()
+	if !config.Enabled {
+		return nil
+	}
+	if config.BusinessHours != nil && !config.BusinessHours.Contains(now) {
+		return nil
+	}
+
+	var alerts []*GotifyMessage
+	for _, name := range hm.sortedProfiles() {
+		state := hm.profiles[name]
+		if state.alerted || now.Sub(state.silentSince()) < config.timeout {
+			continue
+		}
+		state.alerted = true
+		message := &GotifyMessage{
+			Title:    EmojiExclamMark + " No Postal webhooks received from profile " + name,
+			Priority: PriorityCritical,
+		}
+		message.Message += fmt.Sprintf("Nothing has arrived for more than %s. ", config.timeout)
+		message.Message += "Check whether Postal's webhook worker is still running.\n\n"
+		message.Message += "---\n\n"
+		message.Message += fmt.Sprintf("**Last seen:** %s", formatLastSeen(state.lastSeen))
+		alerts = append(alerts, message)
+	}
+	return alerts
+}
+
+// display returns a markdown list of the last-seen times of all profiles
+func (hm *heartbeatMonitor) display(profiles []string) string {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	hm.track(profiles)
+	if len(hm.profiles) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("**Last webhook received:**\n\n")
+	for _, name := range hm.sortedProfiles() {
+		fmt.Fprintf(&sb, "- %s: %s\n", name, formatLastSeen(hm.profiles[name].lastSeen))
+	}
+	return sb.String()
+}
+
+func (hm *heartbeatMonitor) sortedProfiles() []string {
+	names := make([]string, 0, len(hm.profiles))
+	for name := range hm.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func formatLastSeen(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04:05 MST")
+}
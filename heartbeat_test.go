@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatAlertAndRecovery(t *testing.T) {
+	fixed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) // monday
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	config := defaultHeartbeatConfig()
+	config.Enabled = true
+	config.Timeout = "30m"
+	if err := validateSetting(config.validate, "heartbeat"); err != nil {
+		t.Fatal(err)
+	}
+	profiles := []string{"main"}
+	hm := newHeartbeatMonitor()
+	hm.check(&config, profiles)
+
+	fixed = fixed.Add(20 * time.Minute)
+	if alerts := hm.check(&config, profiles); len(alerts) != 0 {
+		t.Fatal("Unexpected alert before timeout: ", alerts[0].Title)
+	}
+
+	fixed = fixed.Add(20 * time.Minute)
+	alerts := hm.check(&config, profiles)
+	if len(alerts) != 1 || !strings.Contains(alerts[0].Title, "profile main") {
+		t.Fatal("Expected one alert for profile main, got: ", len(alerts))
+	}
+	if alerts := hm.check(&config, profiles); len(alerts) != 0 {
+		t.Fatal("Alert was sent twice")
+	}
+
+	notice := hm.seen(profiles, "main")
+	if notice == nil || notice.Priority != PriorityRecovered {
+		t.Fatal("Expected recovery notice")
+	}
+	if !strings.Contains(hm.display(profiles), "main: 2024-01-01 12:40:00") {
+		t.Fatal("Display does not contain last seen time, got: ", hm.display(profiles))
+	}
+}
+
+func TestHeartbeatBusinessHours(t *testing.T) {
+	fixed := time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC) // saturday
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	config := defaultHeartbeatConfig()
+	config.Enabled = true
+	config.Timeout = "1m"
+	config.BusinessHours = &TimeWindow{
+		Days:     []string{"mon", "tue", "wed", "thu", "fri"},
+		Start:    "08:00",
+		End:      "18:00",
+		Timezone: "UTC",
+	}
+	if err := validateSetting(config.validate, "heartbeat"); err != nil {
+		t.Fatal(err)
+	}
+	profiles := []string{"main"}
+	hm := newHeartbeatMonitor()
+	hm.seen(profiles, "main")
+
+	fixed = fixed.Add(time.Hour)
+	if alerts := hm.check(&config, profiles); len(alerts) != 0 {
+		t.Fatal("Alert sent outside of business hours")
+	}
+	fixed = fixed.Add(44 * time.Hour) // monday 09:00
+	if alerts := hm.check(&config, profiles); len(alerts) != 1 {
+		t.Fatal("Expected alert within business hours")
+	}
+}
+
+func TestHeartbeatIgnoresUnknownProfiles(t *testing.T) {
+	p, engine, _ := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{Name: "main"}}
+	})
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=typo", string(messageSentEvent))
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", "not json")
+
+	display := p.heartbeat.display(p.config.Load().profileNames())
+	if strings.Contains(display, "typo") {
+		t.Fatal("Unknown profile is tracked: ", display)
+	}
+	if !strings.Contains(display, "main: never") {
+		t.Fatal("Undecodable webhook counted as heartbeat: ", display)
+	}
+}
+
+func TestTimeWindowAcrossMidnight(t *testing.T) {
+	tw := &TimeWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00", Timezone: "UTC"}
+	if tw.Contains(time.Date(2024, 1, 5, 23, 0, 0, 0, time.UTC)) {
+		t.Fatal("Window matches before it was validated")
+	}
+	if err := validateSetting(tw.validate, "window"); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[time.Time]bool{
+		time.Date(2024, 1, 5, 23, 0, 0, 0, time.UTC): true,  // friday night
+		time.Date(2024, 1, 6, 5, 59, 0, 0, time.UTC): true,  // saturday morning, belongs to friday
+		time.Date(2024, 1, 6, 6, 0, 0, 0, time.UTC):  false, // end is exclusive
+		time.Date(2024, 1, 6, 23, 0, 0, 0, time.UTC): false, // saturday night
+	}
+	for at, expected := range cases {
+		if tw.Contains(at) != expected {
+			t.Fatal("Unexpected result for ", at)
+		}
+	}
+}
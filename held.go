@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions for held messages, also used as route names
+const (
+	HeldActionRelease = "release"
+	HeldActionDiscard = "discard"
+)
+
+// heldLinkValidity is how long release and discard links can be used
+const heldLinkValidity = 7 * 24 * time.Hour
+
+// heldActionKey encodes the held message a link refers to, so that any profile
+// name or token can be decoded again
+func heldActionKey(profile string, id int, token string) string {
+	return url.Values{"profile": {profile}, "id": {strconv.Itoa(id)}, "token": {token}}.Encode()
+}
+
+// parseHeldActionKey decodes a key created by heldActionKey
+func parseHeldActionKey(key string) (profile string, id int, token string, err error) {
+	values, err := url.ParseQuery(key)
+	if err != nil {
+		return "", 0, "", err
+	}
+	id, err = strconv.Atoi(values.Get("id"))
+	if err != nil {
+		return "", 0, "", fmt.Errorf("invalid message ID")
+	}
+	return values.Get("profile"), id, values.Get("token"), nil
+}
+
+// addHeldActionLinks appends release and discard links to a MessageHeld notification,
+// if the profile has an endpoint for held messages
+func (p *Plugin) addHeldActionLinks(config *PluginConfig, notification *GotifyMessage, event *DeliveryEvent) {
+	baseURL := config.publicURL()
+	if event.Kind != KindHeld || baseURL == "" {
+		return
+	}
+	profile := config.profile(event.Profile)
+	if profile == nil || profile.HeldActionURL == "" {
+		return
+	}
+	key := heldActionKey(event.Profile, event.MessageRef.ID, event.MessageRef.Token)
+	params := url.Values{"expires": {strconv.FormatInt(timeNow().Add(heldLinkValidity).Unix(), 10)}}
+	notification.Message += fmt.Sprintf("\n\n[Release message](%s) · [Discard message](%s)",
+		p.actionURL(baseURL, HeldActionRelease, key, params),
+		p.actionURL(baseURL, HeldActionDiscard, key, params),
+	)
+}
+
+// heldActionHandler returns the handler releasing or discarding a held message.
+// Each link can be used once.
+func (p *Plugin) heldActionHandler(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := p.config.Load()
+		key, ok := p.actionKey(c, action)
+		if !ok {
+			return
+		}
+		profileName, id, token, err := parseHeldActionKey(key)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid key: %s", err)
+			return
+		}
+		profile := config.profile(profileName)
+		if profile == nil || profile.HeldActionURL == "" {
+			c.String(http.StatusNotFound, "no endpoint for held messages configured for profile %s", profileName)
+			return
+		}
+
+		if !confirmed(c, fmt.Sprintf("%s held message %d", strings.ToUpper(action[:1])+action[1:], id), action) {
+			return
+		}
+		if !p.heldActions.claim(action+"?"+key, timeNow().Add(heldLinkValidity)) {
+			c.String(http.StatusConflict, "the link was already used")
+			return
+		}
+
+		result := &GotifyMessage{}
+		if err := p.callHeldAction(c.Request.Context(), config, profile, action, id, token); err != nil {
+			p.heldActions.unclaim(action + "?" + key)
+			result.Title = fmt.Sprintf("%s Could not %s held message %d", EmojiExclamMark, action, id)
+			result.Message = err.Error()
+			result.Priority = PriorityWarning
+			p.send(config, result)
+			c.String(http.StatusBadGateway, "%s failed: %s", action, err)
+			return
+		}
+		result.Title = fmt.Sprintf("%s Held message %d %sd", EmojiCheckMark, id, action)
+		result.Message = fmt.Sprintf("The message was %sd on request of a Gotify user.", action)
+		if info := profile.mailserverInfo(); info != nil {
+			result.clickURL = makeClickURL(id, info.Host, info.Organization, info.Name, "")
+		}
+		p.send(config, result)
+		c.String(http.StatusOK, "Message %d %sd.", id, action)
+	}
+}
+
+// usedLinks remembers links or tokens that were used until they expire, so that they
+// can't be replayed
+type usedLinks struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newUsedLinks() *usedLinks {
+	return &usedLinks{until: map[string]time.Time{}}
+}
+
+// claim marks the link as used, it returns false if it was used before
+func (ul *usedLinks) claim(key string, until time.Time) bool {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	now := timeNow()
+	for used, expires := range ul.until {
+		if now.After(expires) {
+			delete(ul.until, used)
+		}
+	}
+	if _, used := ul.until[key]; used {
+		return false
+	}
+	ul.until[key] = until
+	return true
+}
+
+// unclaim allows to use the link again, e.g. after the action failed
+func (ul *usedLinks) unclaim(key string) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	delete(ul.until, key)
+}
+
+// callHeldAction calls the held message endpoint of the profile. {id}, {token} and
+// {action} in the URL are replaced, the same values are sent as JSON body.
+func (p *Plugin) callHeldAction(ctx context.Context, config *PluginConfig, profile *ServerProfile, action string, id int, token string) error {
+	url := strings.NewReplacer(
+		"{id}", strconv.Itoa(id),
+		"{token}", token,
+		"{action}", action,
+	).Replace(profile.HeldActionURL)
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":     id,
+		"token":  token,
+		"action": action,
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, config.apiTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if profile.APIKey != "" {
+		req.Header.Set("X-Server-API-Key", profile.APIKey)
+	}
+	for name, value := range profile.HeldActionHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		output, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("endpoint returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
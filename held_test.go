@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var heldEvent = strings.NewReplacer(
+	`"event": "MessageSent"`, `"event": "MessageHeld"`,
+	`"details":"Message sent by SMTP to aspmx.l.google.com (2a00:1450:400c:c0b::1b) (from 2a00:67a0:a:15::2)"`, `"details":"Credential is configured to hold all messages"`,
+).Replace(string(messageSentEvent))
+
+func TestReleaseHeldMessage(t *testing.T) {
+	var received map[string]interface{}
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/messages/12345/release" || r.Header.Get("X-Server-API-Key") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer endpoint.Close()
+
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{
+			Name:          "main",
+			APIKey:        "secret",
+			HeldActionURL: endpoint.URL + "/admin/messages/{id}/{action}",
+		}}
+	})
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", heldEvent)
+
+	notification := handler.messages[0].Message
+	if !strings.HasPrefix(notification, "**Held reason:** Credential is configured to hold all messages\n\n") {
+		t.Fatal("Held reason is not at the top: ", notification)
+	}
+
+	link := findLink(t, notification, "Release message")
+	if rec := serve(engine, http.MethodGet, link, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<form method="post">`) || received != nil {
+		t.Fatal("GET did not only ask for confirmation, status: ", rec.Code, rec.Body.String())
+	}
+	if rec := serve(engine, http.MethodPost, link, ""); rec.Code != http.StatusOK {
+		t.Fatal("Release failed, status: ", rec.Code, rec.Body.String())
+	}
+	if received["token"] != "abcdef123" || received["action"] != "release" {
+		t.Fatal("Unexpected request to endpoint: ", received)
+	}
+	if rec := serve(engine, http.MethodPost, link, ""); rec.Code != http.StatusConflict {
+		t.Fatal("Release link was replayed, status: ", rec.Code)
+	}
+	if followUp := handler.messages[len(handler.messages)-1]; followUp.Title != EmojiCheckMark+" Held message 12345 released" {
+		t.Fatal("Unexpected follow-up notification: ", followUp.Title)
+	}
+
+	discard := strings.Replace(findLink(t, notification, "Discard message"), "/discard/", "/release/", 1)
+	if rec := serve(engine, http.MethodPost, discard, ""); rec.Code != http.StatusForbidden {
+		t.Fatal("Discard token was accepted for release")
+	}
+}
+
+func TestHeldActionLinkExpires(t *testing.T) {
+	fixed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{Name: "main:eu", HeldActionURL: "https://hooks.example.com/{id}/{action}"}}
+	})
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main:eu", heldEvent)
+	link := findLink(t, handler.messages[0].Message, "Discard message")
+
+	if rec := serve(engine, http.MethodGet, link, ""); rec.Code != http.StatusOK {
+		t.Fatal("Link of profile with colon was rejected, status: ", rec.Code, rec.Body.String())
+	}
+	fixed = fixed.Add(heldLinkValidity)
+	if rec := serve(engine, http.MethodPost, link, ""); rec.Code != http.StatusGone {
+		t.Fatal("Expired link was accepted, status: ", rec.Code)
+	}
+	if rec := serve(engine, http.MethodPost, strings.Replace(link, "expires=", "expires=9", 1), ""); rec.Code != http.StatusForbidden {
+		t.Fatal("Changed expiry was accepted, status: ", rec.Code)
+	}
+}
+
+func TestHeldActionKey(t *testing.T) {
+	profile, id, token, err := parseHeldActionKey(heldActionKey("a:b&c", 42, "x:y"))
+	if err != nil || profile != "a:b&c" || id != 42 || token != "x:y" {
+		t.Fatal("Key was not decoded: ", profile, id, token, err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+// historyEntry is the compact record of a processed webhook kept for reports
+type historyEntry struct {
+	Time            time.Time        `json:"time"`
+	Profile         string           `json:"profile"`
+	Event           postal.EventType `json:"event"`
+	RecipientDomain string           `json:"recipient_domain,omitempty"`
+	Reason          string           `json:"reason,omitempty"`
+	DeliveryTime    float64          `json:"delivery_time,omitempty"`
+	SentWithSSL     bool             `json:"sent_with_ssl,omitempty"`
+}
+
+// newHistoryEntry extracts the fields relevant for reports from the event
+func newHistoryEntry(event *DeliveryEvent) historyEntry {
+	entry := historyEntry{
+		Time:    timeNow(),
+		Profile: event.Profile,
+		Event:   postal.EventType(event.Event),
+	}
+
+	switch event.Kind {
+	case KindDelivered, KindDelayed, KindFailed, KindHeld:
+		entry.RecipientDomain = addressDomain(event.recipient())
+		entry.Reason = event.Response.Details
+		entry.DeliveryTime = event.Timings.DeliveryTime
+		entry.SentWithSSL = event.Response.TLS
+	case KindBounced:
+		entry.RecipientDomain = addressDomain(event.recipient())
+		entry.Reason = bounceReason(event.Response.Statuses)
+	}
+	return entry
+}
+
+// maxReasonLength cuts off long diagnostic codes stored as reason
+const maxReasonLength = 120
+
+// bounceReason returns the diagnostic code of the first failed recipient, or its
+// status code if there is none. The subject of the bounce message is no reason,
+// so it is empty if the delivery status is unknown.
+func bounceReason(statuses []mailparse.DeliveryStatus) string {
+	for _, status := range statuses {
+		reason := strings.TrimSpace(status.DiagnosticCode)
+		if reason == "" {
+			reason = status.Status
+		}
+		if len(reason) > maxReasonLength {
+			reason = strings.ToValidUTF8(reason[:maxReasonLength], "")
+		}
+		if reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// historyBucket aggregates the entries of one hour. Only what reports need is
+// kept, so that the history stays small at high webhook volumes.
+type historyBucket struct {
+	Start          time.Time                `json:"start"`
+	First          time.Time                `json:"first"`
+	Last           time.Time                `json:"last"`
+	Events         map[postal.EventType]int `json:"events"`
+	DeliveryTimes  map[int]int              `json:"delivery_times,omitempty"` // sent messages per delivery time in 10 ms
+	WithoutTLS     int                      `json:"without_tls,omitempty"`
+	FailingDomains map[string]int           `json:"failing_domains,omitempty"`
+	BounceReasons  map[string]int           `json:"bounce_reasons,omitempty"`
+}
+
+func newHistoryBucket(start time.Time) *historyBucket {
+	return &historyBucket{
+		Start:          start,
+		Events:         map[postal.EventType]int{},
+		DeliveryTimes:  map[int]int{},
+		FailingDomains: map[string]int{},
+		BounceReasons:  map[string]int{},
+	}
+}
+
+// add counts the entry
+func (hb *historyBucket) add(entry historyEntry) {
+	if hb.First.IsZero() || entry.Time.Before(hb.First) {
+		hb.First = entry.Time
+	}
+	if entry.Time.After(hb.Last) {
+		hb.Last = entry.Time
+	}
+	hb.Events[entry.Event]++
+	switch entry.Event {
+	case postal.EventMessageSent:
+		hb.DeliveryTimes[int(math.Round(entry.DeliveryTime*100))]++
+		if !entry.SentWithSSL {
+			hb.WithoutTLS++
+		}
+	case postal.EventMessageDeliveryFailed:
+		if entry.RecipientDomain != "" {
+			hb.FailingDomains[entry.RecipientDomain]++
+		}
+	case postal.EventMessageBounced:
+		if entry.RecipientDomain != "" {
+			hb.FailingDomains[entry.RecipientDomain]++
+		}
+		if entry.Reason != "" {
+			hb.BounceReasons[entry.Reason]++
+		}
+	}
+}
+
+// merge adds the counts of the other bucket
+func (hb *historyBucket) merge(other *historyBucket) {
+	if hb.First.IsZero() || (!other.First.IsZero() && other.First.Before(hb.First)) {
+		hb.First = other.First
+	}
+	if other.Last.After(hb.Last) {
+		hb.Last = other.Last
+	}
+	for event, count := range other.Events {
+		hb.Events[event] += count
+	}
+	for centis, count := range other.DeliveryTimes {
+		hb.DeliveryTimes[centis] += count
+	}
+	hb.WithoutTLS += other.WithoutTLS
+	for domain, count := range other.FailingDomains {
+		hb.FailingDomains[domain] += count
+	}
+	for reason, count := range other.BounceReasons {
+		hb.BounceReasons[reason] += count
+	}
+}
+
+// total returns the number of counted entries
+func (hb *historyBucket) total() int {
+	total := 0
+	for _, count := range hb.Events {
+		total += count
+	}
+	return total
+}
+
+// eventHistory keeps the processed webhooks aggregated per hour for a limited time
+type eventHistory struct {
+	mu      sync.Mutex
+	buckets []*historyBucket // oldest first
+}
+
+func newEventHistory() *eventHistory {
+	return &eventHistory{}
+}
+
+// add counts the entry in the bucket of its hour and drops buckets older than
+// the retention
+func (eh *eventHistory) add(entry historyEntry, retention time.Duration) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	start := entry.Time.Truncate(time.Hour)
+	if n := len(eh.buckets); n == 0 || eh.buckets[n-1].Start.Before(start) {
+		eh.buckets = append(eh.buckets, newHistoryBucket(start))
+	}
+	eh.buckets[len(eh.buckets)-1].add(entry)
+	eh.prune(retention)
+}
+
+// prune drops buckets that ended before the retention, 0 keeps all buckets.
+// Caller must hold the lock.
+func (eh *eventHistory) prune(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	cutoff := timeNow().Add(-retention)
+	i := 0
+	for i < len(eh.buckets) && !eh.buckets[i].Start.Add(time.Hour).After(cutoff) {
+		i++
+	}
+	if i > 0 {
+		eh.buckets = append([]*historyBucket(nil), eh.buckets[i:]...)
+	}
+}
+
+// between sums up the buckets of the hours starting in [from, to)
+func (eh *eventHistory) between(from, to time.Time) *historyBucket {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	sum := newHistoryBucket(from)
+	for _, bucket := range eh.buckets {
+		if !bucket.Start.Before(from) && bucket.Start.Before(to) {
+			sum.merge(bucket)
+		}
+	}
+	return sum
+}
+
+// snapshot returns a copy of the buckets
+func (eh *eventHistory) snapshot() []*historyBucket {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	buckets := make([]*historyBucket, len(eh.buckets))
+	for i, bucket := range eh.buckets {
+		buckets[i] = newHistoryBucket(bucket.Start)
+		buckets[i].merge(bucket)
+	}
+	return buckets
+}
+
+func (eh *eventHistory) restore(buckets []*historyBucket, retention time.Duration) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	eh.buckets = nil
+	for _, bucket := range buckets {
+		// buckets are restored with all maps, even if they were stored empty
+		restored := newHistoryBucket(bucket.Start)
+		restored.merge(bucket)
+		eh.buckets = append(eh.buckets, restored)
+	}
+	eh.prune(retention)
+}
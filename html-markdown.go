@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	spaceRegex     = regexp.MustCompile(`[ \t\r\n]+`)
+	blankLineRegex = regexp.MustCompile(`\n[ \t]*\n\s*\n+`)
+	markdownEscape = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`, "`", "\\`", `[`, `\[`, `]`, `\]`, `<`, `\<`)
+)
+
+// linkDestinationEscape percent-encodes characters that would end a markdown link
+var linkDestinationEscape = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29", "<", "%3C", ">", "%3E", `"`, "%22", `\`, "%5C", "\n", "", "\r", "")
+
+// linkTarget returns href escaped for a markdown link, or an empty string if it
+// is no absolute http(s) URL. Links with other schemes like javascript: are
+// dropped and only their text is kept.
+func linkTarget(href string) string {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return linkDestinationEscape.Replace(u.String())
+}
+
+// htmlToMarkdown converts an HTML mail body to readable markdown. Only the
+// structure relevant for notifications (paragraphs, emphasis, links, lists,
+// headings) is kept, scripts, styles and images are dropped.
+func htmlToMarkdown(s string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(s))
+	var sb strings.Builder
+	var links []string // href of open links
+	skip := 0          // depth inside script, style and head elements
+	listDepth := 0
+
+	newline := func(n int) {
+		current := sb.String()
+		trimmed := strings.TrimRight(current, " ")
+		existing := len(trimmed) - len(strings.TrimRight(trimmed, "\n"))
+		if len(trimmed) == 0 {
+			return
+		}
+		for i := existing; i < n; i++ {
+			sb.WriteString("\n")
+		}
+	}
+
+	for {
+		tt := tokenizer.Next()
+		switch tt {
+		case html.ErrorToken:
+			return strings.TrimSpace(blankLineRegex.ReplaceAllString(sb.String(), "\n\n"))
+
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := spaceRegex.ReplaceAllString(string(tokenizer.Text()), " ")
+			if strings.HasSuffix(sb.String(), "\n") || sb.Len() == 0 {
+				text = strings.TrimLeft(text, " ")
+			}
+			sb.WriteString(markdownEscape.Replace(text))
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			tag := atom.Lookup(name)
+			switch tag {
+			case atom.Script, atom.Style, atom.Head, atom.Title:
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case atom.Br:
+				sb.WriteString("\n")
+			case atom.P, atom.Div, atom.Table, atom.Tr, atom.Blockquote:
+				newline(2)
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				newline(2)
+				sb.WriteString(strings.Repeat("#", int(name[1]-'0')) + " ")
+			case atom.Ul, atom.Ol:
+				listDepth++
+				newline(1)
+			case atom.Li:
+				newline(1)
+				sb.WriteString(strings.Repeat("  ", max(listDepth-1, 0)) + "- ")
+			case atom.B, atom.Strong:
+				sb.WriteString("**")
+			case atom.I, atom.Em:
+				sb.WriteString("_")
+			case atom.Hr:
+				newline(2)
+				sb.WriteString("---")
+				newline(2)
+			case atom.A:
+				href := ""
+				for hasAttr {
+					var key, value []byte
+					key, value, hasAttr = tokenizer.TagAttr()
+					if string(key) == "href" {
+						href = linkTarget(string(value))
+					}
+				}
+				links = append(links, href)
+				if href != "" {
+					sb.WriteString("[")
+				}
+			}
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch atom.Lookup(name) {
+			case atom.Script, atom.Style, atom.Head, atom.Title:
+				skip = max(skip-1, 0)
+			case atom.P, atom.Div, atom.Table, atom.Blockquote, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				newline(2)
+			case atom.Ul, atom.Ol:
+				listDepth = max(listDepth-1, 0)
+				newline(2)
+			case atom.Tr:
+				newline(1)
+			case atom.Td, atom.Th:
+				sb.WriteString(" ")
+			case atom.B, atom.Strong:
+				sb.WriteString("**")
+			case atom.I, atom.Em:
+				sb.WriteString("_")
+			case atom.A:
+				if len(links) == 0 {
+					continue
+				}
+				href := links[len(links)-1]
+				links = links[:len(links)-1]
+				if href != "" {
+					sb.WriteString("](" + href + ")")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+	"github.com/gin-gonic/gin"
+)
+
+const EmojiIncomingEnvelope = "\xF0\x9F\x93\xA8"
+
+const inboundExcerptLength = 500
+
+// inboundMail is the format independent representation of an incoming mail
+type inboundMail struct {
+	From        string
+	To          string
+	Subject     string
+	SpamStatus  string
+	SpamScore   float64
+	PlainBody   string
+	HTMLBody    string
+	Attachments []postal.InboundAttachment
+}
+
+func (p *Plugin) inboundHandler(c *gin.Context) {
+	config := p.config.Load()
+	body, err := readBody(c, maxInboundBodySize)
+	if err != nil {
+		p.send(config, &GotifyMessage{
+			Title:   "Error reading inbound request body",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if config.VerboseOutput {
+		printBody("Incoming Postal inbound message", body)
+	}
+
+	profileName := c.DefaultQuery("profile", defaultProfileName)
+	if err := verifyInbound(c, config.profile(profileName), body); err != nil {
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+	incoming, err := decodeInbound(c.ContentType(), body)
+	if err != nil {
+		p.send(config, &GotifyMessage{
+			Title:   "Error decoding inbound message",
+			Message: err.Error(),
+		})
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if notice := p.heartbeat.seen(config.profileNames(), profileName); notice != nil {
+		p.send(config, notice)
+	}
+
+	notification := renderInboundMail(incoming)
+	event := newInboundDeliveryEvent(profileName, incoming)
+	p.publish(config, newOutboundEvent(body, event, notification, cloudEventSource(config, event)))
+	if notification = config.spamPolicy(profileName).apply(notification, incoming.SpamStatus, incoming.SpamScore); notification != nil {
+		p.addActionLinks(config, notification)
+		p.send(config, notification)
+	}
+	c.Status(http.StatusOK)
+}
+
+// verifyInbound authenticates an inbound message by the secret of the profile
+// and its signature. Unlike webhooks, inbound messages are rejected if the
+// profile has neither.
+func verifyInbound(c *gin.Context, profile *ServerProfile, body []byte) error {
+	if profile == nil {
+		return errors.New("unknown profile")
+	}
+	if profile.InboundSecret == "" && profile.signingKey == nil {
+		return fmt.Errorf("profile %s has no inbound_secret or signing_key", profile.Name)
+	}
+	if profile.InboundSecret != "" && subtle.ConstantTimeCompare([]byte(c.Query("secret")), []byte(profile.InboundSecret)) != 1 {
+		return errors.New("invalid secret")
+	}
+	if profile.signingKey != nil {
+		return postal.VerifyRequest(c.Request.Header, body, profile.signingKey)
+	}
+	return nil
+}
+
+// newInboundDeliveryEvent describes an incoming mail as delivery event
+func newInboundDeliveryEvent(profileName string, incoming *inboundMail) *DeliveryEvent {
+	event := newDeliveryEvent("postal", KindReceived, "", timeNow(), nil)
+	event.Profile = profileName
+	event.Sender = incoming.From
+	event.Recipients = []string{incoming.To}
+	event.MessageRef = MessageRef{Subject: incoming.Subject, Direction: "incoming", SpamStatus: incoming.SpamStatus}
+	return event
+}
+
+// decodeInbound accepts Postal's hash and raw JSON formats as well as plain RFC 822 messages
+func decodeInbound(contentType string, body []byte) (*inboundMail, error) {
+	if contentType == "message/rfc822" || contentType == "text/plain" {
+		return parseRawMail(body)
+	}
+
+	var msg postal.InboundMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+
+	if msg.Message != "" {
+		raw := []byte(msg.Message)
+		if msg.Base64 {
+			decoded, err := base64.StdEncoding.DecodeString(msg.Message)
+			if err != nil {
+				return nil, fmt.Errorf("could not decode raw message: %w", err)
+			}
+			raw = decoded
+		}
+		return parseRawMail(raw)
+	}
+
+	return &inboundMail{
+		From:        msg.From,
+		To:          msg.To,
+		Subject:     msg.Subject,
+		SpamStatus:  msg.SpamStatus,
+		SpamScore:   msg.SpamScore,
+		PlainBody:   msg.PlainBody,
+		HTMLBody:    msg.HTMLBody,
+		Attachments: msg.Attachments,
+	}, nil
+}
+
+// parseRawMail parses an RFC 822 message to an inboundMail
+func parseRawMail(raw []byte) (*inboundMail, error) {
+	parsed, err := mailparse.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	incoming := &inboundMail{
+		From:      parsed.From,
+		To:        parsed.To,
+		Subject:   parsed.Subject,
+		PlainBody: parsed.PlainBody,
+		HTMLBody:  parsed.HTMLBody,
+	}
+	for _, attachment := range parsed.Attachments {
+		incoming.Attachments = append(incoming.Attachments, postal.InboundAttachment{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        attachment.Size,
+		})
+	}
+
+	// Postal adds its spam check results as headers
+	if strings.EqualFold(parsed.Header.Get("X-Postal-Spam"), "yes") {
+		incoming.SpamStatus = "Spam"
+	}
+	if score, err := strconv.ParseFloat(parsed.Header.Get("X-Postal-Spam-Score"), 64); err == nil {
+		incoming.SpamScore = score
+	}
+	return incoming, nil
+}
+
+// renderInboundMail turns the incoming mail into a Gotify notification
+func renderInboundMail(incoming *inboundMail) *GotifyMessage {
+	subject := incoming.Subject
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	message := &GotifyMessage{
+		Title:    EmojiIncomingEnvelope + " " + subject,
+		Priority: PriorityInbound,
+		event:    InboundEventName,
+		muteKeys: senderMuteKeys(incoming.From),
+	}
+
+	message.Message += fmt.Sprintf("_From %s to %s_\n\n", incoming.From, incoming.To)
+	// the plain body is escaped, so that it can't inject markdown links
+	text := markdownEscape.Replace(incoming.PlainBody)
+	if strings.TrimSpace(text) == "" {
+		text = htmlToMarkdown(incoming.HTMLBody)
+	}
+	message.Message += excerpt(strings.TrimSpace(text), inboundExcerptLength)
+
+	if len(incoming.Attachments) > 0 {
+		message.Message += "\n\n---\n\n**Attachments:**\n\n"
+		for _, attachment := range incoming.Attachments {
+			message.Message += fmt.Sprintf("- %s (%s, %s)\n", attachment.Filename, attachment.ContentType, formatSize(attachment.Size))
+		}
+		message.Message = strings.TrimRight(message.Message, "\n")
+	}
+	return message
+}
+
+// excerpt shortens s to at most n characters
+func excerpt(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:n])) + " …"
+}
+
+func formatSize(size int) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/1024/1024)
+	case size >= 1024:
+		return fmt.Sprintf("%.1f kB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
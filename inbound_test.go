@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+var inboundHashMessage = []byte(`{
+	"id":12345,
+	"rcpt_to":"alerts@example.com",
+	"mail_from":"monitoring@example.net",
+	"subject":"Disk almost full",
+	"spam_status":"NotSpam",
+	"to":"alerts@example.com",
+	"from":"Monitoring <monitoring@example.net>",
+	"plain_body":"The disk /dev/sda1 is 95% full.",
+	"html_body":"<p>The disk <b>/dev/sda1</b> is 95% full.</p>",
+	"attachment_quantity":1,
+	"attachments":[{"filename":"df.txt","content_type":"text/plain","size":2048,"data":"Li4u"}]
+}`)
+
+const rawInboundMessage = "From: =?UTF-8?Q?J=C3=BCrgen?= <juergen@example.net>\r\n" +
+	"To: alerts@example.com\r\n" +
+	"Subject: =?UTF-8?B?QmFja3VwIGZlaGxnZXNjaGxhZ2Vu?=\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<html><body><p>Backup of <b>db01</b> failed.</p><script>x()</script></body></html>\r\n"
+
+// withInboundSecret configures the main profile to accept inbound messages with secret "s3cret"
+func withInboundSecret(c *PluginConfig) {
+	c.Profiles = []ServerProfile{{Name: defaultProfileName, InboundSecret: "s3cret"}}
+}
+
+func TestInboundHashFormat(t *testing.T) {
+	_, engine, handler := newTestPlugin(t, withInboundSecret)
+
+	rec := serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal/inbound?secret=s3cret", string(inboundHashMessage))
+	if rec.Code != http.StatusOK || len(handler.messages) != 1 {
+		t.Fatal("Inbound message was not processed, status: ", rec.Code)
+	}
+	msg := handler.messages[0]
+	if msg.Title != EmojiIncomingEnvelope+" Disk almost full" {
+		t.Fatal("Unexpected title: ", msg.Title)
+	}
+	for _, expected := range []string{
+		"_From Monitoring <monitoring@example.net> to alerts@example.com_",
+		"The disk /dev/sda1 is 95% full.",
+		"- df.txt (text/plain, 2.0 kB)",
+	} {
+		if !strings.Contains(msg.Message, expected) {
+			t.Fatal("Message does not contain '"+expected+"', got: ", msg.Message)
+		}
+	}
+}
+
+func TestInboundRawFormat(t *testing.T) {
+	body, _ := json.Marshal(postal.InboundMessage{
+		ID:      1,
+		Message: base64.StdEncoding.EncodeToString([]byte(rawInboundMessage)),
+		Base64:  true,
+	})
+	incoming, err := decodeInbound("application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := renderInboundMail(incoming)
+
+	if notification.Title != EmojiIncomingEnvelope+" Backup fehlgeschlagen" {
+		t.Fatal("Unexpected title: ", notification.Title)
+	}
+	if !strings.Contains(notification.Message, "_From Jürgen <juergen@example.net>") {
+		t.Fatal("Sender was not decoded, got: ", notification.Message)
+	}
+	if !strings.Contains(notification.Message, "Backup of **db01** failed.") || strings.Contains(notification.Message, "x()") {
+		t.Fatal("HTML body was not converted to markdown, got: ", notification.Message)
+	}
+}
+
+func TestHTMLToMarkdown(t *testing.T) {
+	body := `<h1>Report</h1><ul><li>one</li><li>two</li></ul><p>See <a href="https://example.com">the dashboard</a>.</p>`
+	expected := "# Report\n\n- one\n- two\n\nSee [the dashboard](https://example.com)."
+	if md := htmlToMarkdown(body); md != expected {
+		t.Fatal("Unexpected markdown: ", strings.ReplaceAll(md, "\n", `\n`))
+	}
+}
+
+func TestInboundRequiresSecret(t *testing.T) {
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		withInboundSecret(c)
+		c.Profiles = append(c.Profiles, ServerProfile{Name: "open"})
+	})
+
+	for _, target := range []string{
+		"/plugin/1/custom/abc/postal/inbound",
+		"/plugin/1/custom/abc/postal/inbound?secret=wrong",
+		"/plugin/1/custom/abc/postal/inbound?profile=open",
+		"/plugin/1/custom/abc/postal/inbound?profile=unknown&secret=s3cret",
+	} {
+		if rec := serve(engine, http.MethodPost, target, string(inboundHashMessage)); rec.Code != http.StatusForbidden {
+			t.Fatal("Unauthenticated inbound message was accepted: ", target, rec.Code)
+		}
+	}
+	if len(handler.messages) != 0 {
+		t.Fatal("Unauthenticated inbound message was sent")
+	}
+}
+
+func TestInboundLinksAreSanitized(t *testing.T) {
+	notification := renderInboundMail(&inboundMail{
+		HTMLBody: `<a href="javascript:alert(1)">Run</a> <a href="https://example.com/a b)(c">Open</a>`,
+	})
+	if strings.Contains(notification.Message, "javascript:") || !strings.Contains(notification.Message, "Run [Open](https://example.com/a%20b%29%28c)") {
+		t.Fatal("Links were not sanitized, got: ", notification.Message)
+	}
+
+	notification = renderInboundMail(&inboundMail{PlainBody: "[Open](javascript:alert(1)) <javascript:alert(1)>"})
+	if strings.Contains(notification.Message, "[Open](") || strings.Contains(notification.Message, " <javascript:") {
+		t.Fatal("Plain body injected markdown, got: ", notification.Message)
+	}
+}
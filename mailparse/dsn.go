@@ -0,0 +1,60 @@
+package mailparse
+
+import (
+	"bufio"
+	"bytes"
+	"net/textproto"
+	"strings"
+)
+
+// DeliveryStatus is one per-recipient block of a delivery status notification (RFC 3464)
+type DeliveryStatus struct {
+	FinalRecipient string
+	Action         string
+	Status         string
+	DiagnosticCode string
+}
+
+// Hard reports whether the status is a permanent failure (5.x.x)
+func (ds *DeliveryStatus) Hard() bool {
+	return strings.HasPrefix(ds.Status, "5")
+}
+
+// parseDeliveryStatus parses the content of a message/delivery-status part.
+// The first block holds the per-message fields, which are skipped.
+func parseDeliveryStatus(content []byte) []DeliveryStatus {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(content)))
+	var statuses []DeliveryStatus
+	for first := true; ; first = false {
+		// skip superfluous blank lines between blocks
+		for {
+			peek, err := reader.R.Peek(1)
+			if err != nil || (peek[0] != '\r' && peek[0] != '\n') {
+				break
+			}
+			reader.R.ReadByte()
+		}
+
+		header, err := reader.ReadMIMEHeader()
+		if len(header) > 0 && !first {
+			statuses = append(statuses, DeliveryStatus{
+				FinalRecipient: stripTypePrefix(header.Get("Final-Recipient")),
+				Action:         strings.ToLower(header.Get("Action")),
+				Status:         header.Get("Status"),
+				DiagnosticCode: stripTypePrefix(header.Get("Diagnostic-Code")),
+			})
+		}
+		if err != nil {
+			// io.EOF after the last block or a malformed block
+			return statuses
+		}
+	}
+}
+
+// stripTypePrefix removes the address or diagnostic type like "rfc822;" or "smtp;"
+func stripTypePrefix(value string) string {
+	if _, rest, found := strings.Cut(value, ";"); found {
+		return strings.TrimSpace(rest)
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,43 @@
+package mailparse
+
+import (
+	"testing"
+)
+
+const dsnBounce = "From: MAILER-DAEMON@someserver.com\r\n" +
+	"To: abcde@psrp.postal.yourdomain.com\r\n" +
+	"Subject: Delivery Status Notification (Failure)\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=b1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; someserver.com\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; test@example.com\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 The email account that you tried to reach does\r\n" +
+	" not exist\r\n" +
+	"--b1--\r\n"
+
+func TestParseDeliveryStatus(t *testing.T) {
+	parsed, err := Parse([]byte(dsnBounce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.DeliveryStatus) != 1 {
+		t.Fatal("Expected one delivery status, got: ", len(parsed.DeliveryStatus))
+	}
+	status := parsed.DeliveryStatus[0]
+	if status.FinalRecipient != "test@example.com" || status.Action != "failed" || status.Status != "5.1.1" || !status.Hard() {
+		t.Fatal("Unexpected delivery status: ", status)
+	}
+	if status.DiagnosticCode != "550 5.1.1 The email account that you tried to reach does not exist" {
+		t.Fatal("Unexpected diagnostic code: ", status.DiagnosticCode)
+	}
+}
@@ -0,0 +1,173 @@
+// Package mailparse parses raw RFC 822 messages including their MIME tree and
+// the delivery status reports of bounces (RFC 3464).
+package mailparse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxMIMEDepth limits the nesting of multipart entities
+const maxMIMEDepth = 10
+
+// Attachment describes a leaf part of the MIME tree that is no body
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Size        int // decoded size in bytes
+}
+
+// Mail is the result of parsing a raw RFC 822 message with Parse. Headers
+// are decoded according to RFC 2047 and bodies are converted to UTF-8.
+type Mail struct {
+	Header      mail.Header
+	From        string
+	To          string
+	Cc          string
+	Subject     string
+	Date        string
+	MessageID   string
+	PlainBody   string
+	HTMLBody    string
+	Attachments []Attachment
+	// DeliveryStatus is set for delivery status notifications (bounces)
+	DeliveryStatus []DeliveryStatus
+}
+
+// Parse parses a raw RFC 822 message including its MIME tree. The first
+// text/plain and text/html parts that aren't attachments become the bodies,
+// all other leaf parts are listed as attachments.
+func Parse(raw []byte) (*Mail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse raw message: %w", err)
+	}
+
+	parsed := &Mail{
+		Header:    msg.Header,
+		From:      DecodeHeader(msg.Header.Get("From")),
+		To:        DecodeHeader(msg.Header.Get("To")),
+		Cc:        DecodeHeader(msg.Header.Get("Cc")),
+		Subject:   DecodeHeader(msg.Header.Get("Subject")),
+		Date:      msg.Header.Get("Date"),
+		MessageID: msg.Header.Get("Message-Id"),
+	}
+	if err := parsed.walk(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// DecodeHeader decodes RFC 2047 encoded words, keeping the value on errors
+func DecodeHeader(value string) string {
+	if decoded, err := headerDecoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// charsetReader converts input in the given charset to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	}
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset '%s'", charset)
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
+
+func (m *Mail) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > maxMIMEDepth {
+		return fmt.Errorf("MIME structure is nested too deeply")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("could not read MIME part: %w", err)
+			}
+			if err := m.walk(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	content, err := io.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("could not decode %s part: %w", mediaType, err)
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := DecodeHeader(dispositionParams["filename"])
+	if filename == "" {
+		filename = DecodeHeader(params["name"])
+	}
+	isAttachment := disposition == "attachment" || filename != ""
+
+	switch {
+	case mediaType == "text/plain" && !isAttachment && m.PlainBody == "":
+		m.PlainBody, err = decodeCharset(params["charset"], content)
+	case mediaType == "text/html" && !isAttachment && m.HTMLBody == "":
+		m.HTMLBody, err = decodeCharset(params["charset"], content)
+	case mediaType == "message/delivery-status" || mediaType == "message/global-delivery-status":
+		m.DeliveryStatus = append(m.DeliveryStatus, parseDeliveryStatus(content)...)
+	default:
+		if filename == "" {
+			filename = "unnamed"
+		}
+		m.Attachments = append(m.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			Size:        len(content),
+		})
+	}
+	return err
+}
+
+// transferDecoder undoes the Content-Transfer-Encoding of a part
+func transferDecoder(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// the decoder skips the line breaks of base64 content
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+func decodeCharset(charset string, content []byte) (string, error) {
+	reader, err := charsetReader(charset, bytes.NewReader(content))
+	if err != nil {
+		// show the content anyway, it is most likely readable
+		return string(content), nil
+	}
+	decoded, err := io.ReadAll(reader)
+	return string(decoded), err
+}
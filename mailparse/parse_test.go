@@ -0,0 +1,53 @@
+package mailparse
+
+import (
+	"testing"
+)
+
+const multipartMail = "From: =?ISO-8859-1?Q?Andr=E9?= <andre@example.net>\r\n" +
+	"To: alerts@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Gr=FC=DFe aus K=F6ln\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<h1>Report</h1><ul><li>one</li><li>two</li></ul><p>See <a href=\"https://example.com\">the dashboard</a>.</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"=?UTF-8?Q?Bericht_M=C3=A4rz.pdf?=\"\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"JSVFT0YK\r\n" +
+	"--outer--\r\n"
+
+func TestParse(t *testing.T) {
+	parsed, err := Parse([]byte(multipartMail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.From != "André <andre@example.net>" {
+		t.Fatal("Unexpected sender: ", parsed.From)
+	}
+	if parsed.PlainBody != "Grüße aus Köln" {
+		t.Fatal("Unexpected plain body: ", parsed.PlainBody)
+	}
+	if len(parsed.Attachments) != 1 {
+		t.Fatal("Expected one attachment, got: ", len(parsed.Attachments))
+	}
+	attachment := parsed.Attachments[0]
+	if attachment.Filename != "Bericht März.pdf" || attachment.ContentType != "application/pdf" || attachment.Size != 15 {
+		t.Fatal("Unexpected attachment: ", attachment)
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rsa"
 	"fmt"
-	"io"
+	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
 	"github.com/gin-gonic/gin"
 	"github.com/gotify/plugin-api"
 )
@@ -26,7 +32,11 @@ func GetGotifyPluginInfo() plugin.Info {
 type GotifyMessage struct {
 	Title    string
 	Message  string
+	Priority int
 	clickURL *string
+	event    string   // name of the originating webhook event, empty for plugin alerts
+	problem  string   // identifies recurring problems for escalation, if any
+	muteKeys []string // keys that can be snoozed, e.g. "sender:mail@example.com"
 }
 
 type PostalMailserverInfo struct {
@@ -35,43 +45,233 @@ type PostalMailserverInfo struct {
 	Name         string
 }
 
+// ServerProfile describes a Postal mail server that sends webhooks to this plugin.
+// Webhooks are associated with a profile using the "profile" query parameter.
+type ServerProfile struct {
+	Name         string     `yaml:"name"`
+	Host         string     `yaml:"host"`
+	Organization string     `yaml:"organization"`
+	Server       string     `yaml:"server"`
+	Spam         SpamPolicy `yaml:"spam"`
+	// APIURL and APIKey enable fetching message details from Postal's HTTP API.
+	// APIURL defaults to Host.
+	APIURL string `yaml:"api_url"`
+	APIKey string `yaml:"api_key"`
+	// HeldActionURL is called to release or discard held messages, see callHeldAction
+	HeldActionURL     string            `yaml:"held_action_url"`
+	HeldActionHeaders map[string]string `yaml:"held_action_headers"`
+	// SigningKey is the public key Postal signs webhooks with, PEM or base64 encoded.
+	// If set, webhooks without a valid signature are rejected.
+	SigningKey string `yaml:"signing_key"`
+	// InboundSecret must be passed as "secret" query parameter of inbound
+	// messages. Inbound messages are only accepted with a secret or signing key.
+	InboundSecret string `yaml:"inbound_secret"`
+
+	signingKey *rsa.PublicKey // parsed SigningKey, set by compile
+}
+
+// mailserverInfo returns the dashboard location of the profile, if configured
+func (sp *ServerProfile) mailserverInfo() *PostalMailserverInfo {
+	if sp.Host == "" || sp.Organization == "" || sp.Server == "" {
+		return nil
+	}
+	return &PostalMailserverInfo{
+		Host:         sp.Host,
+		Organization: sp.Organization,
+		Name:         sp.Server,
+	}
+}
+
 type PluginConfig struct {
+	// ConfigVersion is the schema version, older configurations are migrated on
+	// load. It is 0 for configurations saved before versioning.
+	ConfigVersion int `yaml:"config_version"`
 	VerboseOutput bool
+	Profiles      []ServerProfile  `yaml:"profiles"`
+	RateAlerts    RateAlertConfig  `yaml:"rate_alerts"`
+	Heartbeat     HeartbeatConfig  `yaml:"heartbeat"`
+	Report        ReportConfig     `yaml:"report"`
+	Quiet         QuietConfig      `yaml:"quiet"`
+	Escalation    EscalationConfig `yaml:"escalation"`
+	Sinks         []SinkConfig     `yaml:"sinks"`
+	MQTT          MQTTConfig       `yaml:"mqtt"`
+	Providers     []ProviderConfig `yaml:"providers"`
+	// PublicURL is the external URL of Gotify used for action links, e.g. https://gotify.example.com
+	PublicURL string `yaml:"public_url"`
+	// HistoryRetention is how long processed events are stored, e.g. "35d"
+	HistoryRetention string `yaml:"history_retention"`
+	// APITimeout limits requests to the Postal API
+	APITimeout string `yaml:"api_timeout"`
+
+	// derived from the settings above by compile
+	apiTimeout       time.Duration
+	historyRetention time.Duration
+	migrations       []string // migrations applied on load, for the display
+}
+
+// profile returns the configured profile with the given name or nil
+func (c *PluginConfig) profile(name string) *ServerProfile {
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == name {
+			return &c.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// profileNames returns the names of the server profiles and the profiles of providers
+func (c *PluginConfig) profileNames() []string {
+	var names []string
+	for _, profile := range c.Profiles {
+		names = append(names, profile.Name)
+	}
+	for i := range c.Providers {
+		names = append(names, c.Providers[i].profile())
+	}
+	return names
 }
 
 // Plugin is plugin instance
 type Plugin struct {
-	userCtx    plugin.UserContext
-	msgHandler plugin.MessageHandler
-	basePath   string
-	config     *PluginConfig
+	userCtx      plugin.UserContext
+	msgHandler   atomic.Pointer[plugin.MessageHandler]
+	basePath     string
+	config       atomic.Pointer[PluginConfig] // nil until configured, never modified
+	configMu     sync.Mutex                   // serializes configuration changes
+	rateMonitor  *rateMonitor
+	heartbeat    *heartbeatMonitor
+	history      *eventHistory
+	reports      *reportScheduler
+	quiet        *quietFilter
+	escalation   *escalator
+	signer       *linkSigner
+	snoozes      *snoozeList
+	heldActions  *usedLinks
+	suppressions *suppressionList
+	sinks        *sinkDispatcher
+	cloudEvents  *cloudEventLog
+	mqtt         *mqttPublisher
+
+	storage    plugin.StorageHandler
+	storageMu  sync.Mutex
+	stateDirty atomic.Bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
 }
 
 // Enable implements plugin.Plugin
 func (p *Plugin) Enable() error {
+	if err := p.loadState(); err != nil {
+		return err
+	}
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.sinks.run(p.stop)
+	}()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.mqtt.run(p.stop)
+	}()
+	p.runEvery(time.Minute, func() {
+		if config := p.config.Load(); config != nil {
+			for _, alert := range p.heartbeat.check(&config.Heartbeat, config.profileNames()) {
+				p.send(config, alert)
+			}
+			for _, notice := range p.escalation.prune(&config.Escalation) {
+				p.send(config, notice)
+			}
+			for _, alert := range p.rateMonitor.prune(&config.RateAlerts) {
+				p.addActionLinks(config, alert)
+				p.send(config, alert)
+			}
+			p.sendDueReport(config)
+			for _, summary := range p.quiet.flush(&config.Quiet) {
+				p.deliver(summary)
+				p.markDirty()
+			}
+		}
+		if err := p.flushState(); err != nil {
+			fmt.Println("Could not save plugin state:", err)
+		}
+	})
 	return nil
 }
 
 // Disable implements plugin.Plugin
 func (p *Plugin) Disable() error {
-	return nil
+	close(p.stop)
+	p.wg.Wait()
+	return p.flushState()
+}
+
+// runEvery calls fn periodically until the plugin is disabled
+func (p *Plugin) runEvery(interval time.Duration, fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
 }
 
 // DefaultConfig implements plugin.Configurer
 func (p *Plugin) DefaultConfig() interface{} {
-	return &PluginConfig{false}
+	return &PluginConfig{
+		ConfigVersion:    currentConfigVersion,
+		VerboseOutput:    false,
+		RateAlerts:       defaultRateAlertConfig(),
+		Heartbeat:        defaultHeartbeatConfig(),
+		Report:           defaultReportConfig(),
+		Escalation:       defaultEscalationConfig(),
+		MQTT:             defaultMQTTConfig(),
+		HistoryRetention: "35d",
+		APITimeout:       "5s",
+	}
 }
 
-// ValidateAndSetConfig implements plugin.Configurer
+// ValidateAndSetConfig implements plugin.Configurer. The configuration is
+// validated and compiled completely, then published as a single snapshot that
+// all components read from, so it is applied either completely or not at all.
 func (p *Plugin) ValidateAndSetConfig(c interface{}) error {
-	config := c.(*PluginConfig)
-	p.config = config
+	config, ok := c.(*PluginConfig)
+	if !ok {
+		return fmt.Errorf("unexpected configuration type %T", c)
+	}
+	migrations, err := config.migrate(p.DefaultConfig().(*PluginConfig))
+	if err != nil {
+		return err
+	}
+	config.migrations = migrations
+	if err := config.compile(); err != nil {
+		return err
+	}
+
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	previous := p.config.Swap(config)
+	if previous == nil || previous.MQTT != config.MQTT {
+		p.mqtt.reconnect()
+	}
 	return nil
 }
 
 const helpMessageTemplate = "Use this **webhook URL**: %s\n\n" +
 	"You can also set the Postal host, organization and server name as parameters (e.g. `?host=postal.example.com&org=some-org&name=main`). " +
-	"Once done, Gotify messages can be clicked to open the corresponding dashboard in Postal."
+	"Once done, Gotify messages can be clicked to open the corresponding dashboard in Postal.\n\n" +
+	"If you configured server profiles, append `?profile=<name>` instead to use the profile's settings.\n\n" +
+	"To receive incoming mail as notifications, add an HTTP endpoint in Postal with this URL: %s/inbound"
 
 // GetDisplay implements plugin.Displayer
 func (p *Plugin) GetDisplay(location *url.URL) string {
@@ -80,13 +280,44 @@ func (p *Plugin) GetDisplay(location *url.URL) string {
 		baseHost = fmt.Sprintf("%s://%s", location.Scheme, location.Host)
 	}
 	webhookURL := baseHost + p.basePath + routeName
-	return fmt.Sprintf(helpMessageTemplate, webhookURL)
+	display := fmt.Sprintf(helpMessageTemplate, webhookURL, webhookURL)
+	config := p.config.Load()
+	if config == nil {
+		return display
+	}
+	if len(config.migrations) > 0 {
+		display += fmt.Sprintf("\n\n**Configuration migrated** to version %d, save it to keep the changes:\n\n- %s",
+			config.ConfigVersion, strings.Join(config.migrations, "\n- "))
+	}
+	if lastSeen := p.heartbeat.display(config.profileNames()); lastSeen != "" {
+		display += "\n\n" + lastSeen
+	}
+	if snoozes := p.snoozes.display(); snoozes != "" {
+		display += "\n\n" + snoozes
+	}
+	if sinks := p.sinks.display(config.Sinks); sinks != "" {
+		display += "\n\n" + sinks
+	}
+	if mqtt := p.mqtt.display(&config.MQTT); mqtt != "" {
+		display += "\n\n" + mqtt
+	}
+	display += "\n\n" + p.apiDisplay(webhookURL)
+	return display
 }
 
 // SetMessageHandler implements plugin.Messenger
 func (p *Plugin) SetMessageHandler(h plugin.MessageHandler) {
 	// invoced during initialization
-	p.msgHandler = h
+	p.msgHandler.Store(&h)
+}
+
+// requireSetup rejects requests until the plugin is configured and can send messages
+func (p *Plugin) requireSetup(c *gin.Context) {
+	if p.config.Load() == nil || p.msgHandler.Load() == nil {
+		c.Header("Retry-After", "10")
+		c.String(http.StatusServiceUnavailable, "plugin is not set up yet")
+		c.Abort()
+	}
 }
 
 // RegisterWebhook implements plugin.Webhooker
@@ -94,20 +325,20 @@ func (p *Plugin) RegisterWebhook(basePath string, mux *gin.RouterGroup) {
 	p.basePath = basePath
 
 	webhookHandler := func(c *gin.Context) {
+		config := p.config.Load()
+
 		// read body
-		bytes, err := io.ReadAll(c.Request.Body)
+		bytes, err := readBody(c, maxWebhookBodySize)
 		if err != nil {
-			p.msgHandler.SendMessage(makeMarkdownMessage(
-				"Error reading request body",
-				err.Error(),
-				nil,
-			))
+			p.deliver(&GotifyMessage{
+				Title:   "Error reading request body",
+				Message: err.Error(),
+			})
 			return
 		}
 
-		if p.config.VerboseOutput {
-			fmt.Println("Incoming Postal webhook:")
-			fmt.Println(string(bytes))
+		if config.VerboseOutput {
+			printBody("Incoming Postal webhook", bytes)
 		}
 
 		// get optional params
@@ -123,110 +354,194 @@ func (p *Plugin) RegisterWebhook(basePath string, mux *gin.RouterGroup) {
 			}
 		}
 
+		// resolve server profile, which takes precedence over the params above
+		profileName := c.DefaultQuery("profile", defaultProfileName)
+		if err := verifySignature(c, config, profileName, bytes); err != nil {
+			c.String(http.StatusForbidden, err.Error())
+			return
+		}
+		if profile := config.profile(profileName); profile != nil {
+			if info := profile.mailserverInfo(); info != nil {
+				msInfo = info
+			}
+		}
+
+		event, errMessage := decodeWebhook(bytes)
+		if errMessage != nil {
+			p.send(config, errMessage)
+			return
+		}
+		if notice := p.heartbeat.seen(config.profileNames(), profileName); notice != nil {
+			p.send(config, notice)
+		}
+		event.Profile = profileName
+		if msInfo != nil && event.Server == "" {
+			event.Server = msInfo.Name
+		}
+
 		// this function does not return error since errors are handled within
 		// the function and returned "pre-serialized" as GotifyMessages
-		notification := p.processWebhookBytes(bytes, msInfo)
+		notification := p.processWebhookMessage(event, msInfo)
+		p.enrich(c.Request.Context(), config, notification, event)
+		p.dispatchEvent(config, msInfo, bytes, event, notification)
+	}
 
-		// send message
-		p.msgHandler.SendMessage(makeMarkdownMessage(
-			notification.Title,
-			notification.Message,
-			notification.clickURL, // may be nil
-		))
+	routes := mux.Group("/"+routeName, p.requireSetup)
+	routes.POST("", webhookHandler)
+	routes.POST("/inbound", p.inboundHandler)
+	routes.POST("/providers/:provider", p.providerHandler)
+	routes.GET("/ack/:key", p.ackHandler)
+	routes.POST("/ack/:key", p.ackHandler)
+	routes.GET("/snooze/:key", p.snoozeHandler)
+	routes.POST("/snooze/:key", p.snoozeHandler)
+	for _, action := range []string{HeldActionRelease, HeldActionDiscard} {
+		routes.GET("/"+action+"/:key", p.heldActionHandler(action))
+		routes.POST("/"+action+"/:key", p.heldActionHandler(action))
 	}
+	routes.GET("/events", p.eventHistoryHandler)
+	routes.GET("/suppressions", p.listSuppressionsHandler)
+	routes.POST("/suppressions", p.addSuppressionHandler)
+	routes.DELETE("/suppressions/:address", p.deleteSuppressionHandler)
+}
 
-	mux.POST("/"+routeName, webhookHandler)
+// send sends the notification, unless it is snoozed or dropped or held due to
+// quiet hours. config is nil before the plugin is configured.
+func (p *Plugin) send(config *PluginConfig, notification *GotifyMessage) {
+	if p.snoozes.snoozed(notification.problem) || p.snoozes.snoozed(notification.muteKeys...) {
+		return
+	}
+	if config != nil {
+		notification = p.quiet.apply(&config.Quiet, notification)
+	}
+	if notification != nil {
+		p.deliver(notification)
+	} else {
+		// the notification may be held
+		p.markDirty()
+	}
 }
 
-func (p *Plugin) processWebhookBytes(bytes []byte, msInfo *PostalMailserverInfo) *GotifyMessage {
-	// unmarshal body to generic WebhookMessage
-	var message WebhookMessage
-	if err := json.Unmarshal(bytes, &message); err != nil {
-		return &GotifyMessage{
-			"Error unmarshalling Postal message",
-			err.Error(),
-			nil,
-		}
+// deliver converts the notification to a markdown message and sends it to Gotify
+func (p *Plugin) deliver(notification *GotifyMessage) {
+	msg := makeMarkdownMessage(
+		notification.Title,
+		notification.Message,
+		notification.clickURL, // may be nil
+	)
+	msg.Priority = notification.Priority
+	handler := p.msgHandler.Load()
+	if handler == nil {
+		fmt.Println("Dropped message, no message handler set:", notification.Title)
+		return
 	}
+	(*handler).SendMessage(msg)
+}
 
-	// switch message event type for parsing PayloadRaw
-	switch message.Event {
-	// all message status events
-	case WebhookMessageEventMessageSent, WebhookMessageEventMessageDelayed, WebhookMessageEventMessageDeliveryFailed, WebhookMessageEventMessageHeld:
-		notification, err := p.handleMessageStatusEvent(message.PayloadRaw, message.Event, msInfo)
-		if err != nil {
-			return &GotifyMessage{
-				"Error handling message status event",
-				err.Error(),
-				nil,
-			}
-		}
-		return notification
+// publish hands the processed event to the event history, the outbound sinks and the MQTT broker
+func (p *Plugin) publish(config *PluginConfig, event *outboundEvent) {
+	if event.cloud != nil {
+		p.cloudEvents.add(event.cloud)
+	}
+	p.sinks.dispatch(config.Sinks, event)
+	p.mqtt.publish(&config.MQTT, event)
+}
 
-	// bounce events
-	case WebhookMessageEventMessageBounced:
-		notification, err := p.handleMessageBounceEvent(message.PayloadRaw, msInfo)
-		if err != nil {
-			return &GotifyMessage{
-				"Error handling message status event",
-				err.Error(),
-				nil,
-			}
-		}
-		return notification
+// dispatchEvent records the rendered event and sends its notification and alerts
+func (p *Plugin) dispatchEvent(config *PluginConfig, msInfo *PostalMailserverInfo, raw []byte, event *DeliveryEvent, notification *GotifyMessage) {
+	p.recordSuppressions(event)
+	p.publish(config, newOutboundEvent(raw, event, notification, cloudEventSource(config, event)))
 
-	// linktracking link clicked
-	case WebhookMessageEventMessageLinkClicked:
-		notification, err := p.handleMessageClickEvent(message.PayloadRaw, msInfo)
-		if err != nil {
-			return &GotifyMessage{
-				"Error handling message status event",
-				err.Error(),
-				nil,
-			}
-		}
-		return notification
+	// send message, unless it is a known problem that was reported recently
+	p.addHeldActionLinks(config, notification, event)
+	if notification = p.escalation.apply(&config.Escalation, notification); notification != nil {
+		p.addActionLinks(config, notification)
+		p.send(config, notification)
+	}
 
-	// message loaded events
-	case WebhookMessageEventMessageLoaded:
-		notification, err := p.handleMessageLoadedEvent(message.PayloadRaw, msInfo)
-		if err != nil {
-			return &GotifyMessage{
-				"Error handling message status event",
-				err.Error(),
-				nil,
+	if !config.spamPolicy(event.Profile).IgnoreOutgoing {
+		if alert := outgoingSpamAlert(event, msInfo); alert != nil {
+			if alert = p.escalation.apply(&config.Escalation, alert); alert != nil {
+				p.addActionLinks(config, alert)
+				p.send(config, alert)
 			}
 		}
-		return notification
+	}
 
-	// DNS error
-	case WebhookMessageEventDomainDNSError:
-		notification, err := p.handleDNSErrorEvent(message.PayloadRaw)
-		if err != nil {
-			return &GotifyMessage{
-				"Error handling message status event",
-				err.Error(),
-				nil,
-			}
-		}
-		return notification
+	// update delivery statistics, which may trigger additional alerts
+	for _, alert := range p.rateMonitor.observe(&config.RateAlerts, event) {
+		p.addActionLinks(config, alert)
+		p.send(config, alert)
+	}
+	p.history.add(newHistoryEntry(event), config.historyRetention)
+	p.markDirty()
+}
 
-	default:
-		return &GotifyMessage{
-			"Read unknown event name in Postal massage",
-			fmt.Sprintf("Event name was '%s'", string(message.Event)),
-			nil,
+// verifySignature checks the webhook signature once any profile has a signing
+// key. Webhooks of a profile with a key have to be signed with it, all others,
+// including those without or with an unknown profile, with any configured key.
+func verifySignature(c *gin.Context, config *PluginConfig, profileName string, body []byte) error {
+	if profile := config.profile(profileName); profile != nil && profile.signingKey != nil {
+		return postal.VerifyRequest(c.Request.Header, body, profile.signingKey)
+	}
+	var err error
+	for _, profile := range config.Profiles {
+		if profile.signingKey == nil {
+			continue
+		}
+		if err = postal.VerifyRequest(c.Request.Header, body, profile.signingKey); err == nil {
+			return nil
 		}
 	}
+	if err != nil {
+		return fmt.Errorf("profile '%s' has no signing key and the webhook is not signed by another profile: %w", profileName, err)
+	}
+	return nil
+}
+
+func (p *Plugin) processWebhookBytes(bytes []byte, msInfo *PostalMailserverInfo) *GotifyMessage {
+	event, errMessage := decodeWebhook(bytes)
+	if errMessage != nil {
+		return errMessage
+	}
+	return p.processWebhookMessage(event, msInfo)
+}
+
+// processWebhookMessage renders the notification with the handler registered for the event
+func (p *Plugin) processWebhookMessage(event *DeliveryEvent, msInfo *PostalMailserverInfo) *GotifyMessage {
+	handler := lookupEventHandler(event.Event)
+	notification := handler.render(event)
+	notification.event = event.Event
+	notification.clickURL = handler.clickURL(event, msInfo)
+	notification.problem, notification.muteKeys = handler.filterKeys(event)
+	return notification
 }
 
 // NewGotifyPluginInstance creates a plugin instance for a user context.
 func NewGotifyPluginInstance(ctx plugin.UserContext) plugin.Plugin {
-	return &Plugin{
-		userCtx: ctx,
+	p := &Plugin{
+		userCtx:      ctx,
+		rateMonitor:  newRateMonitor(),
+		heartbeat:    newHeartbeatMonitor(),
+		history:      newEventHistory(),
+		reports:      newReportScheduler(),
+		quiet:        newQuietFilter(),
+		escalation:   newEscalator(),
+		signer:       newLinkSigner(),
+		snoozes:      newSnoozeList(),
+		heldActions:  newUsedLinks(),
+		suppressions: newSuppressionList(),
+		cloudEvents:  &cloudEventLog{},
 	}
+	// the background workers read the sink and broker settings of the current configuration
+	p.sinks = newSinkDispatcher(p.config.Load)
+	p.mqtt = newMQTTPublisher(p.config.Load)
+	return p
 }
 
+// main runs the standalone mode, built with -buildmode=plugin it is never called
 func main() {
-	panic("this should be built as go plugin")
+	if err := runStandalone(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
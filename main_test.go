@@ -1,9 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
 	"github.com/gotify/plugin-api"
 )
 
@@ -147,9 +158,7 @@ func (m MockedMessageHandler) SendMessage(msg plugin.Message) error {
 }*/
 
 func TestProcessWebhookWithClickURL(t *testing.T) {
-	p := &Plugin{
-		config: &PluginConfig{},
-	}
+	p := &Plugin{}
 	msInfo := &PostalMailserverInfo{
 		Host:         "https://testing.example.com",
 		Organization: "testing-org",
@@ -169,9 +178,7 @@ func TestProcessWebhookWithClickURL(t *testing.T) {
 }
 
 func TestProcessWebhookWithoutClickURL(t *testing.T) {
-	p := &Plugin{
-		config: &PluginConfig{},
-	}
+	p := &Plugin{}
 
 	result := p.processWebhookBytes(messageSentEvent, nil)
 	mdMsg := makeMarkdownMessage(result.Title, result.Message, result.clickURL)
@@ -182,9 +189,7 @@ func TestProcessWebhookWithoutClickURL(t *testing.T) {
 }
 
 func TestProcessWebhookMessageSentTitle(t *testing.T) {
-	p := &Plugin{
-		config: &PluginConfig{},
-	}
+	p := &Plugin{}
 	result := p.processWebhookBytes(messageSentEvent, nil)
 	mdMsg := makeMarkdownMessage(result.Title, result.Message, result.clickURL)
 
@@ -194,9 +199,7 @@ func TestProcessWebhookMessageSentTitle(t *testing.T) {
 }
 
 func TestProcessWebhookMessageBouncedTitle(t *testing.T) {
-	p := &Plugin{
-		config: &PluginConfig{},
-	}
+	p := &Plugin{}
 	result := p.processWebhookBytes(messageBouncedEvent, nil)
 	mdMsg := makeMarkdownMessage(result.Title, result.Message, result.clickURL)
 
@@ -206,9 +209,7 @@ func TestProcessWebhookMessageBouncedTitle(t *testing.T) {
 }
 
 func TestProcessWebhookMessageLinkClickedTitle(t *testing.T) {
-	p := &Plugin{
-		config: &PluginConfig{},
-	}
+	p := &Plugin{}
 	result := p.processWebhookBytes(messageLinkClickedEvent, nil)
 	mdMsg := makeMarkdownMessage(result.Title, result.Message, result.clickURL)
 
@@ -218,9 +219,7 @@ func TestProcessWebhookMessageLinkClickedTitle(t *testing.T) {
 }
 
 func TestProcessWebhookMessageLoadedTitle(t *testing.T) {
-	p := &Plugin{
-		config: &PluginConfig{},
-	}
+	p := &Plugin{}
 	result := p.processWebhookBytes(messageLoadedEvent, nil)
 	mdMsg := makeMarkdownMessage(result.Title, result.Message, result.clickURL)
 
@@ -230,9 +229,7 @@ func TestProcessWebhookMessageLoadedTitle(t *testing.T) {
 }
 
 func TestProcessWebhookDomainDNSErrorTitle(t *testing.T) {
-	p := &Plugin{
-		config: &PluginConfig{},
-	}
+	p := &Plugin{}
 	result := p.processWebhookBytes(domainDNSErrorEvent, nil)
 	mdMsg := makeMarkdownMessage(result.Title, result.Message, result.clickURL)
 
@@ -241,6 +238,95 @@ func TestProcessWebhookDomainDNSErrorTitle(t *testing.T) {
 	}
 }
 
+func TestWebhookSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	p, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{{Name: "main", SigningKey: base64.StdEncoding.EncodeToString(der)}}
+	})
+
+	post := func(query, signature string) int {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/plugin/1/custom/abc/postal"+query, strings.NewReader(string(messageSentEvent)))
+		if signature != "" {
+			req.Header.Set(postal.SignatureHeader, signature)
+		}
+		engine.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	if code := post("?profile=main", ""); code != http.StatusForbidden {
+		t.Fatal("Unsigned webhook accepted: ", code)
+	}
+	if code := post("?profile=main", base64.StdEncoding.EncodeToString([]byte("forged"))); code != http.StatusForbidden {
+		t.Fatal("Forged webhook accepted: ", code)
+	}
+	if code := post("", ""); code != http.StatusForbidden {
+		t.Fatal("Unsigned webhook without profile accepted: ", code)
+	}
+	if code := post("?profile=unknown", ""); code != http.StatusForbidden {
+		t.Fatal("Unsigned webhook of unknown profile accepted: ", code)
+	}
+	if len(handler.messages) != 0 {
+		t.Fatal("Rejected webhooks were processed")
+	}
+
+	digest := sha1.Sum(messageSentEvent)
+	rawSignature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	signature := base64.StdEncoding.EncodeToString(rawSignature)
+	if code := post("?profile=main", signature); code != http.StatusOK || len(handler.messages) != 1 {
+		t.Fatal("Signed webhook was not processed: ", code)
+	}
+	if code := post("", signature); code != http.StatusOK || len(handler.messages) != 2 {
+		t.Fatal("Signed webhook without profile was not processed: ", code)
+	}
+
+	config := p.DefaultConfig().(*PluginConfig)
+	config.Profiles = []ServerProfile{{Name: "main", SigningKey: "not a key"}}
+	if p.ValidateAndSetConfig(config) == nil {
+		t.Fatal("Invalid signing key accepted")
+	}
+}
+
+func TestWebhookBodyLimit(t *testing.T) {
+	_, engine, handler := newTestPlugin(t, nil)
+	body := `{"event":"MessageSent","payload":{"details":"` + strings.Repeat("x", maxWebhookBodySize) + `"}}`
+
+	// once with and once without a known content length
+	if rec := serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", body); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal("Expected 413, got: ", rec.Code)
+	}
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/plugin/1/custom/abc/postal", io.MultiReader(strings.NewReader(body)))
+	engine.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal("Expected 413 for streamed body, got: ", recorder.Code)
+	}
+	for _, msg := range handler.messages {
+		if msg.Title != "Error reading request body" {
+			t.Fatal("Oversized webhook was processed: ", msg.Title)
+		}
+	}
+}
+
+// BenchmarkWebhookRequest measures a webhook request from reading the body to sending the notification
+func BenchmarkWebhookRequest(b *testing.B) {
+	_, engine, handler := newTestPlugin(b, nil)
+	recorder := httptest.NewRecorder()
+	body := bytes.NewReader(messageSentEvent)
+	req := httptest.NewRequest(http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", body)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(messageSentEvent)))
+	for i := 0; i < b.N; i++ {
+		body.Reset(messageSentEvent)
+		engine.ServeHTTP(recorder, req)
+		handler.messages = handler.messages[:0]
+	}
+}
+
 // Utilitiy test functions
 
 func hasClickURL(msg plugin.Message) bool {
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
+	"strings"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
 )
 
 const (
@@ -13,128 +14,180 @@ const (
 	EmojiEyes        = "\xF0\x9F\x91\x80"
 )
 
-func (p *Plugin) handleMessageStatusEvent(payload json.RawMessage, eventType WebhookMessageEvent, msInfo *PostalMailserverInfo) (*GotifyMessage, error) {
-	var msg MessageStatusEvent
-	if err := json.Unmarshal(payload, &msg); err != nil {
+func init() {
+	for _, eventType := range []postal.EventType{postal.EventMessageSent, postal.EventMessageDelayed, postal.EventMessageDeliveryFailed, postal.EventMessageHeld} {
+		registerEventHandler(eventType, messageStatusHandler{})
+	}
+	registerEventHandler(postal.EventMessageBounced, messageBounceHandler{})
+	registerEventHandler(postal.EventMessageLinkClicked, messageClickHandler{})
+	registerEventHandler(postal.EventMessageLoaded, messageLoadedHandler{})
+	registerEventHandler(postal.EventDomainDNSError, dnsErrorHandler{})
+}
+
+// postalHandler decodes events with the models of the postal package and derives
+// filter keys and click URL from the delivery event
+type postalHandler struct{}
+
+func (postalHandler) decode(envelope *postal.Envelope) (*DeliveryEvent, error) {
+	event, err := postal.DecodePayload(envelope)
+	if err != nil {
 		return nil, err
 	}
+	return newPostalDeliveryEvent(event), nil
+}
 
-	message := &GotifyMessage{}
-	if msInfo != nil {
-		message.clickURL = makeClickURL(msg.Message.ID, msInfo.Host, msInfo.Organization, msInfo.Name, "")
+func (postalHandler) filterKeys(event *DeliveryEvent) (string, []string) {
+	return event.problemKey(), event.muteKeys()
+}
+
+func (postalHandler) clickURL(event *DeliveryEvent, msInfo *PostalMailserverInfo) *string {
+	switch event.Kind {
+	case KindDNSError:
+		permalink := event.DNS.Permalink // don't know if this permalink works
+		return &permalink
+	case KindOpened, KindClicked:
+		return messageClickURL(event, msInfo, "/activity")
 	}
+	return messageClickURL(event, msInfo, "")
+}
+
+// messageStatusHandler handles all message status events
+type messageStatusHandler struct{ postalHandler }
 
-	// message status events can have several eventTypes, so we need to switch here again
-	switch eventType {
-	case WebhookMessageEventMessageSent:
+func (messageStatusHandler) render(event *DeliveryEvent) *GotifyMessage {
+	message := &GotifyMessage{}
+
+	// message status events can have several kinds, so we need to switch here again
+	switch event.Kind {
+	case KindDelivered:
 		message.Title = EmojiCheckMark + " Message delivered successfully"
-	case WebhookMessageEventMessageDelayed:
+	case KindDelayed:
 		message.Title = EmojiWarningSign + " Message delivery delayed"
-	case WebhookMessageEventMessageDeliveryFailed:
+	case KindFailed:
 		message.Title = EmojiExclamMark + " Message delivery failed"
-	case WebhookMessageEventMessageHeld:
+	case KindHeld:
 		message.Title = EmojiWarningSign + " Message delivery was held by Postal"
 	default:
-		return nil, errors.New("unknown event name '" + string(eventType) + "' occured in message status event handler")
+		message.Title = EmojiWarningSign + " Message status changed: " + event.Event
 	}
 
-	message.Message += fmt.Sprintf("_From %s to %s: \"%s\"_\n\n", msg.Message.From, msg.Message.To, msg.Message.Subject)
-	message.Message += msg.Details + "\n\n"
+	if event.Kind == KindHeld {
+		message.Message += fmt.Sprintf("**Held reason:** %s\n\n", event.Response.Details)
+	}
+	message.Message += renderMessageLine(event)
+	if event.Kind != KindHeld {
+		message.Message += event.Response.Details + "\n\n"
+	}
 	message.Message += "---\n\n"
-	if msg.Time != 0.0 {
-		message.Message += fmt.Sprintf("**Delivery time:** %.2f seconds\n\n", msg.Time)
+	if event.Timings.DeliveryTime != 0.0 {
+		message.Message += fmt.Sprintf("**Delivery time:** %.2f seconds\n\n", event.Timings.DeliveryTime)
 	} else {
 		message.Message += "**Delivery time:** instant\n\n"
 	}
-	message.Message += fmt.Sprintf("**Sent with SSL/TLS:** %t\n\n", msg.SentWithSSL)
-	if msg.Output != "" {
-		message.Message += fmt.Sprintf("**Output:**\n\n```\n%s\n```", msg.Output)
+	message.Message += fmt.Sprintf("**Sent with SSL/TLS:** %t\n\n", event.Response.TLS)
+	if event.Response.Output != "" {
+		message.Message += fmt.Sprintf("**Output:**\n\n```\n%s\n```", event.Response.Output)
 	} else {
 		message.Message += "**Output:** none"
 	}
 
-	return message, nil
+	return message
 }
 
-func (p *Plugin) handleMessageBounceEvent(payload json.RawMessage, msInfo *PostalMailserverInfo) (*GotifyMessage, error) {
-	var msg MessageBounceEvent
-	if err := json.Unmarshal(payload, &msg); err != nil {
-		return nil, err
-	}
+// bounceDetailsHint is replaced with the bounce diagnosis if the Postal API is available
+const bounceDetailsHint = "See the original message page for details!"
+
+type messageBounceHandler struct{ postalHandler }
 
+func (messageBounceHandler) render(event *DeliveryEvent) *GotifyMessage {
 	message := &GotifyMessage{}
-	if msInfo != nil {
-		message.clickURL = makeClickURL(msg.OriginalMessage.ID, msInfo.Host, msInfo.Organization, msInfo.Name, "")
-	}
 
 	message.Title = EmojiExclamMark + " Bounce message received"
 
-	message.Message += fmt.Sprintf("_From %s to %s: \"%s\"_\n\n", msg.OriginalMessage.From, msg.OriginalMessage.To, msg.OriginalMessage.Subject)
+	message.Message += renderMessageLine(event)
 	message.Message += "---\n\n"
-	message.Message += fmt.Sprintf("Sender of bounce message: %s\n\n", msg.Bounce.From)
-	message.Message += "See the original message page for details!"
+	message.Message += fmt.Sprintf("Sender of bounce message: %s\n\n", event.Response.ReportedBy)
+	message.Message += bounceDetailsHint
 
-	return message, nil
+	if diagnosis := event.diagnosis(); diagnosis != nil {
+		applyBounceDiagnosis(message, diagnosis)
+	}
+	return message
 }
 
-func (p *Plugin) handleMessageClickEvent(payload json.RawMessage, msInfo *PostalMailserverInfo) (*GotifyMessage, error) {
-	var msg MessageClickEvent
-	if err := json.Unmarshal(payload, &msg); err != nil {
-		return nil, err
-	}
+type messageClickHandler struct{ postalHandler }
 
+func (messageClickHandler) render(event *DeliveryEvent) *GotifyMessage {
 	message := &GotifyMessage{}
-	if msInfo != nil {
-		message.clickURL = makeClickURL(msg.Message.ID, msInfo.Host, msInfo.Organization, msInfo.Name, "/activity")
-	}
 
 	message.Title = EmojiEyes + " Link in message was clicked"
 
-	message.Message += fmt.Sprintf("_From %s to %s: \"%s\"_\n\n", msg.Message.From, msg.Message.To, msg.Message.Subject)
+	message.Message += renderMessageLine(event)
 	message.Message += "---\n\n"
-	message.Message += fmt.Sprintf("Clicked link: %s\n\n", msg.URL)
-	message.Message += fmt.Sprintf("Opened from **%s** with user agent \"%s\"", msg.IPAddress, msg.UserAgent)
+	message.Message += fmt.Sprintf("Clicked link: %s\n\n", event.Client.URL)
+	message.Message += fmt.Sprintf("Opened from **%s** with user agent \"%s\"", event.Client.IPAddress, event.Client.UserAgent)
 
-	return message, nil
+	return message
 }
 
-func (p *Plugin) handleMessageLoadedEvent(payload json.RawMessage, msInfo *PostalMailserverInfo) (*GotifyMessage, error) {
-	var msg MessageLoadedEvent
-	if err := json.Unmarshal(payload, &msg); err != nil {
-		return nil, err
-	}
+type messageLoadedHandler struct{ postalHandler }
 
+func (messageLoadedHandler) render(event *DeliveryEvent) *GotifyMessage {
 	message := &GotifyMessage{}
-	if msInfo != nil {
-		message.clickURL = makeClickURL(msg.Message.ID, msInfo.Host, msInfo.Organization, msInfo.Name, "/activity")
-	}
 
 	message.Title = EmojiEyes + " Message was opened"
 
-	message.Message += fmt.Sprintf("_From %s to %s: \"%s\"_\n\n", msg.Message.From, msg.Message.To, msg.Message.Subject)
+	message.Message += renderMessageLine(event)
 	message.Message += "---\n\n"
-	message.Message += fmt.Sprintf("Opened from **%s** with user agent \"%s\"", msg.IPAddress, msg.UserAgent)
+	message.Message += fmt.Sprintf("Opened from **%s** with user agent \"%s\"", event.Client.IPAddress, event.Client.UserAgent)
 
-	return message, nil
+	return message
 }
 
-func (p *Plugin) handleDNSErrorEvent(payload json.RawMessage) (*GotifyMessage, error) {
-	var msg DNSErrorEvent
-	if err := json.Unmarshal(payload, &msg); err != nil {
-		return nil, err
-	}
+type dnsErrorHandler struct{ postalHandler }
 
+func (dnsErrorHandler) render(event *DeliveryEvent) *GotifyMessage {
 	message := &GotifyMessage{}
-	message.clickURL = &msg.Server.Permalink // don't know if this permalink works
 
 	message.Title = EmojiExclamMark + " DNS setup check failed"
 
-	message.Message += fmt.Sprintf("Postal detected that your DNS records are incorrect!\n\nAffected domain: **%s** in Server **%s**\n\n", msg.Domain, msg.Server.Name)
+	message.Message += fmt.Sprintf("Postal detected that your DNS records are incorrect!\n\nAffected domain: **%s** in Server **%s**\n\n", event.DNS.Domain, event.Server)
 	message.Message += "---\n\n"
-	message.Message += fmt.Sprintf("**SPF:** %s\n\n", msg.SPFStatus)
-	message.Message += fmt.Sprintf("**DKIM:** %s\n\n", msg.DKIMStatus)
-	message.Message += fmt.Sprintf("**MX:** %s\n\n", msg.MXStatus)
-	message.Message += fmt.Sprintf("**RP:** %s", msg.ReturnPathStatus)
+	message.Message += fmt.Sprintf("**SPF:** %s\n\n", event.DNS.SPF)
+	message.Message += fmt.Sprintf("**DKIM:** %s\n\n", event.DNS.DKIM)
+	message.Message += fmt.Sprintf("**MX:** %s\n\n", event.DNS.MX)
+	message.Message += fmt.Sprintf("**RP:** %s", event.DNS.ReturnPath)
+
+	return message
+}
+
+// unknownEventHandler is used for events without a registered handler
+type unknownEventHandler struct{ postalHandler }
 
-	return message, nil
+func (unknownEventHandler) filterKeys(*DeliveryEvent) (string, []string) {
+	return "", nil
+}
+
+func (unknownEventHandler) clickURL(*DeliveryEvent, *PostalMailserverInfo) *string {
+	return nil
+}
+
+func (unknownEventHandler) render(event *DeliveryEvent) *GotifyMessage {
+	return &GotifyMessage{
+		Title:   "Read unknown event name in Postal massage",
+		Message: fmt.Sprintf("Event name was '%s'", event.Event),
+	}
+}
+
+// renderMessageLine renders sender, recipients and subject of the message
+func renderMessageLine(event *DeliveryEvent) string {
+	return fmt.Sprintf("_From %s to %s: \"%s\"_\n\n", event.Sender, strings.Join(event.Recipients, ", "), event.MessageRef.Subject)
+}
+
+// messageClickURL links to the message in the Postal dashboard, if the mail server is known
+func messageClickURL(event *DeliveryEvent, msInfo *PostalMailserverInfo, subPath string) *string {
+	if msInfo == nil {
+		return nil
+	}
+	return makeClickURL(event.MessageRef.ID, msInfo.Host, msInfo.Organization, msInfo.Name, subPath)
 }
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect    byte = 1
+	mqttConnack    byte = 2
+	mqttPublish    byte = 3
+	mqttPuback     byte = 4
+	mqttPubrec     byte = 5
+	mqttPubrel     byte = 6
+	mqttPubcomp    byte = 7
+	mqttPingreq    byte = 12
+	mqttPingresp   byte = 13
+	mqttDisconnect byte = 14
+)
+
+const (
+	defaultMQTTTopic = "postal/{server}/{event}"
+	mqttQueueSize    = 1000
+	mqttDialTimeout  = 10 * time.Second
+	mqttAckTimeout   = 10 * time.Second
+)
+
+// mqttReconnectBackoff is the delay before reconnecting after a failed session
+var mqttReconnectBackoff = 5 * time.Second
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// MQTTConfig configures publishing of processed events to an MQTT broker
+type MQTTConfig struct {
+	// Broker is e.g. tcp://broker.local:1883 or ssl://broker.local:8883, empty disables publishing
+	Broker   string `yaml:"broker"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	QoS      byte   `yaml:"qos"`
+	Retain   bool   `yaml:"retain"`
+	// Topic may contain the placeholders {profile}, {server} and {event}
+	Topic     string `yaml:"topic"`
+	Format    string `yaml:"format"` // raw, normalized (default) or cloudevents
+	KeepAlive string `yaml:"keep_alive"`
+
+	keepAlive time.Duration // parsed KeepAlive
+}
+
+func defaultMQTTConfig() MQTTConfig {
+	return MQTTConfig{
+		Topic:     defaultMQTTTopic,
+		KeepAlive: "60s",
+	}
+}
+
+func (mc *MQTTConfig) validate(v *configValidator, path string) {
+	if mc.Broker == "" {
+		return
+	}
+	if u, err := url.Parse(mc.Broker); err != nil || u.Hostname() == "" {
+		v.fail(field(path, "broker"), "invalid MQTT broker '%s'", mc.Broker)
+	} else {
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts":
+		default:
+			v.fail(field(path, "broker"), "invalid MQTT broker '%s': scheme must be tcp or ssl", mc.Broker)
+		}
+	}
+	if mc.Password != "" && mc.Username == "" {
+		v.fail(field(path, "password"), "MQTT password requires a username")
+	}
+	if mc.QoS > 2 {
+		v.fail(field(path, "qos"), "invalid MQTT QoS %d", mc.QoS)
+	}
+	if mc.Topic == "" || strings.ContainsAny(mc.Topic, "+#") {
+		v.fail(field(path, "topic"), "invalid MQTT topic '%s'", mc.Topic)
+	}
+	v.placeholders(field(path, "topic"), mc.Topic, "profile", "server", "event")
+	switch mc.Format {
+	case "", SinkFormatRaw, SinkFormatNormalized, SinkFormatCloudEvents:
+	default:
+		v.fail(field(path, "format"), "invalid MQTT format '%s'", mc.Format)
+	}
+	keepAlive, err := parseDuration(mc.KeepAlive)
+	if err != nil || keepAlive < time.Second || keepAlive > 0xffff*time.Second {
+		v.fail(field(path, "keep_alive"), "invalid MQTT keep alive '%s'", mc.KeepAlive)
+	}
+	mc.keepAlive = keepAlive
+}
+
+// topic expands the topic template for the event
+func (mc *MQTTConfig) topic(event *outboundEvent) string {
+	server := event.normalized.Server
+	if server == "" {
+		server = event.normalized.Profile
+	}
+	return strings.NewReplacer(
+		"{profile}", mqttTopicLevel(event.normalized.Profile),
+		"{server}", mqttTopicLevel(server),
+		"{event}", mqttTopicLevel(event.normalized.Event),
+	).Replace(mc.Topic)
+}
+
+// mqttTopicLevel replaces characters that would split the value into several topic levels or act as wildcards
+func mqttTopicLevel(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	id      uint16 // packet ID once the message was sent with QoS > 0
+	// released is set once the broker received a QoS 2 message, only PUBREL is
+	// sent again then
+	released bool
+}
+
+// mqttPublisher keeps a connection to the broker and publishes queued events
+type mqttPublisher struct {
+	config      func() *PluginConfig // current configuration, nil until configured
+	mu          sync.Mutex
+	clientID    string
+	connected   bool
+	published   int
+	lastError   string
+	lastErrorAt time.Time
+
+	queue    chan mqttMessage
+	reload   chan struct{}
+	pending  *mqttMessage // message that was not acknowledged yet, only used by run
+	packetID uint16
+	lastRead atomic.Int64 // unix nanoseconds of the last packet received from the broker
+}
+
+func newMQTTPublisher(config func() *PluginConfig) *mqttPublisher {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return &mqttPublisher{
+		config:   config,
+		clientID: "gotify-postal-" + hex.EncodeToString(id),
+		queue:    make(chan mqttMessage, mqttQueueSize),
+		reload:   make(chan struct{}, 1),
+	}
+}
+
+// reconnect makes the publisher reconnect with the current configuration
+func (mp *mqttPublisher) reconnect() {
+	select {
+	case mp.reload <- struct{}{}:
+	default:
+	}
+}
+
+// currentConfig returns the MQTT settings of the current configuration
+func (mp *mqttPublisher) currentConfig() MQTTConfig {
+	if config := mp.config(); config != nil {
+		return config.MQTT
+	}
+	return MQTTConfig{}
+}
+
+// publish queues the event, it is dropped if no broker is configured
+func (mp *mqttPublisher) publish(config *MQTTConfig, event *outboundEvent) {
+	if config.Broker == "" {
+		return
+	}
+	format := config.Format
+	if format == "" {
+		format = SinkFormatNormalized
+	}
+	payload, err := event.payload(format)
+	if err != nil {
+		mp.record(err)
+		return
+	}
+	select {
+	case mp.queue <- mqttMessage{topic: config.topic(event), payload: payload.body}:
+	default:
+		mp.record(fmt.Errorf("queue is full, event dropped"))
+	}
+}
+
+// run keeps a session with the broker until stop is closed
+func (mp *mqttPublisher) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-mp.reload: // the current configuration is read below
+		default:
+		}
+		config := mp.currentConfig()
+		if config.Broker == "" {
+			select {
+			case <-mp.reload:
+				continue
+			case <-stop:
+				return
+			}
+		}
+
+		err := mp.session(config, stop)
+		mp.setConnected(false)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err == nil {
+			continue // configuration changed
+		}
+		mp.record(err)
+		select {
+		case <-time.After(mqttReconnectBackoff):
+		case <-mp.reload:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// session connects to the broker and publishes messages until an error occurs,
+// the configuration changes or stop is closed
+func (mp *mqttPublisher) session(config MQTTConfig, stop <-chan struct{}) error {
+	conn, err := dialMQTT(config.Broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	keepAlive := config.keepAlive
+	clientID := config.ClientID
+	if clientID == "" {
+		clientID = mp.clientID
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(mqttAckTimeout))
+	if err := writeMQTTPacket(conn, mqttConnect, 0, mqttConnectBody(config, clientID, keepAlive)); err != nil {
+		return err
+	}
+	connack, err := readMQTTPacket(reader)
+	if err != nil {
+		return err
+	}
+	if connack.kind != mqttConnack || len(connack.body) < 2 {
+		return fmt.Errorf("unexpected packet type %d instead of CONNACK", connack.kind)
+	}
+	if code := connack.body[1]; code != 0 {
+		return fmt.Errorf("connection refused: %s", mqttConnackErrors[code])
+	}
+	if sessionPresent := connack.body[0]&0x01 != 0; !sessionPresent && mp.pending != nil {
+		// the broker lost the session, the pending message is sent as new one
+		mp.pending.id, mp.pending.released = 0, false
+	}
+	conn.SetDeadline(time.Time{})
+	mp.setConnected(true)
+	conn = &mqttConn{Conn: conn}
+
+	done := make(chan struct{})
+	defer close(done)
+	packets := make(chan *mqttPacket)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			packet, err := readMQTTPacket(reader)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			mp.lastRead.Store(time.Now().UnixNano())
+			select {
+			case packets <- packet:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// a PINGREQ is sent every half keep alive interval, the broker must have
+	// answered the previous one by then, otherwise the connection is dead
+	ping := time.NewTicker(keepAlive / 2)
+	defer ping.Stop()
+	var pingSent time.Time
+	for {
+		if mp.pending != nil {
+			if err := mp.send(conn, config, mp.pending, packets, readErr, stop); err != nil {
+				return err
+			}
+			mp.pending = nil
+			mp.record(nil)
+		}
+
+		select {
+		case message := <-mp.queue:
+			mp.pending = &message
+		case <-ping.C:
+			if !pingSent.IsZero() && mp.lastRead.Load() < pingSent.UnixNano() {
+				return fmt.Errorf("no PINGRESP within %s, connection lost", keepAlive/2)
+			}
+			if err := writeMQTTPacket(conn, mqttPingreq, 0, nil); err != nil {
+				return err
+			}
+			pingSent = time.Now()
+		case <-packets:
+			// PINGRESP or late acknowledgements
+		case err := <-readErr:
+			return err
+		case <-mp.reload:
+			writeMQTTPacket(conn, mqttDisconnect, 0, nil)
+			return nil
+		case <-stop:
+			writeMQTTPacket(conn, mqttDisconnect, 0, nil)
+			return nil
+		}
+	}
+}
+
+// send publishes the message and waits for the acknowledgements required by the
+// QoS. The session is persistent, so a message that was sent before, but not
+// acknowledged, is sent again with the same packet ID and the DUP flag, or only
+// released if the broker already received it.
+func (mp *mqttPublisher) send(conn net.Conn, config MQTTConfig, message *mqttMessage, packets <-chan *mqttPacket, readErr <-chan error, stop <-chan struct{}) error {
+	if config.QoS == 2 && message.released {
+		return mp.release(conn, message.id, packets, readErr, stop)
+	}
+	flags := config.QoS << 1
+	if config.Retain {
+		flags |= 1
+	}
+	if config.QoS > 0 && message.id != 0 {
+		flags |= 0x08 // DUP
+	} else if config.QoS > 0 {
+		mp.packetID++
+		if mp.packetID == 0 {
+			mp.packetID = 1
+		}
+		message.id = mp.packetID
+	}
+	id := message.id
+
+	body := appendMQTTString(nil, message.topic)
+	if config.QoS > 0 {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, message.payload...)
+	if err := writeMQTTPacket(conn, mqttPublish, flags, body); err != nil {
+		return err
+	}
+
+	switch config.QoS {
+	case 1:
+		return awaitMQTTAck(mqttPuback, id, packets, readErr, stop)
+	case 2:
+		if err := awaitMQTTAck(mqttPubrec, id, packets, readErr, stop); err != nil {
+			return err
+		}
+		message.released = true
+		return mp.release(conn, id, packets, readErr, stop)
+	}
+	return nil
+}
+
+// release completes the delivery of a QoS 2 message received by the broker
+func (mp *mqttPublisher) release(conn net.Conn, id uint16, packets <-chan *mqttPacket, readErr <-chan error, stop <-chan struct{}) error {
+	if err := writeMQTTPacket(conn, mqttPubrel, 0x02, binary.BigEndian.AppendUint16(nil, id)); err != nil {
+		return err
+	}
+	return awaitMQTTAck(mqttPubcomp, id, packets, readErr, stop)
+}
+
+func awaitMQTTAck(kind byte, id uint16, packets <-chan *mqttPacket, readErr <-chan error, stop <-chan struct{}) error {
+	timeout := time.NewTimer(mqttAckTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case packet := <-packets:
+			if packet.kind == kind && len(packet.body) >= 2 && binary.BigEndian.Uint16(packet.body) == id {
+				return nil
+			}
+		case err := <-readErr:
+			return err
+		case <-timeout.C:
+			return fmt.Errorf("no acknowledgement for message %d", id)
+		case <-stop:
+			return errors.New("publisher stopped")
+		}
+	}
+}
+
+func (mp *mqttPublisher) setConnected(connected bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.connected = connected
+}
+
+// record updates the publishing status, err is nil for published messages
+func (mp *mqttPublisher) record(err error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if err == nil {
+		mp.published++
+		return
+	}
+	mp.lastError = err.Error()
+	mp.lastErrorAt = timeNow()
+}
+
+// display returns the connection status shown in GetDisplay
+func (mp *mqttPublisher) display(config *MQTTConfig) string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if config.Broker == "" {
+		return ""
+	}
+	state := "disconnected"
+	if mp.connected {
+		state = "connected"
+	}
+	display := fmt.Sprintf("**MQTT:** %s to %s, %d published", state, config.Broker, mp.published)
+	if mp.lastError != "" {
+		display += fmt.Sprintf(", last error at %s: %s", formatLastSeen(mp.lastErrorAt), mp.lastError)
+	}
+	return display
+}
+
+func dialMQTT(broker string) (net.Conn, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	secure := u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "mqtts"
+	address := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if secure {
+			port = "8883"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	if secure {
+		return tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: u.Hostname()})
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// mqttConn fails writes that block, e.g. on a half-open connection whose send
+// buffer is full
+type mqttConn struct {
+	net.Conn
+}
+
+func (mc *mqttConn) Write(b []byte) (int, error) {
+	mc.Conn.SetWriteDeadline(time.Now().Add(mqttAckTimeout))
+	return mc.Conn.Write(b)
+}
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func mqttConnectBody(config MQTTConfig, clientID string, keepAlive time.Duration) []byte {
+	// no clean session, the broker keeps the state of unacknowledged messages
+	// across reconnects
+	var flags byte
+	if config.Username != "" {
+		flags |= 0x80
+		if config.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags) // protocol level 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(keepAlive/time.Second))
+	body = appendMQTTString(body, clientID)
+	if flags&0x80 != 0 {
+		body = appendMQTTString(body, config.Username)
+	}
+	if flags&0x40 != 0 {
+		body = appendMQTTString(body, config.Password)
+	}
+	return body
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func writeMQTTPacket(w io.Writer, kind, flags byte, body []byte) error {
+	packet := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &mqttPacket{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBroker accepts a single MQTT connection and acknowledges QoS 1 messages
+func fakeBroker(t *testing.T) (string, <-chan mqttMessage, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan mqttMessage, 10)
+	connects := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			packet, err := readMQTTPacket(reader)
+			if err != nil {
+				return
+			}
+			switch packet.kind {
+			case mqttConnect:
+				connects <- packet.body
+				writeMQTTPacket(conn, mqttConnack, 0, []byte{0, 0})
+			case mqttPublish:
+				topicLength := int(binary.BigEndian.Uint16(packet.body))
+				topic := string(packet.body[2 : 2+topicLength])
+				rest := packet.body[2+topicLength:]
+				if packet.flags>>1 > 0 {
+					writeMQTTPacket(conn, mqttPuback, 0, rest[:2])
+					rest = rest[2:]
+				}
+				messages <- mqttMessage{topic: topic, payload: rest}
+			case mqttPingreq:
+				writeMQTTPacket(conn, mqttPingresp, 0, nil)
+			}
+		}
+	}()
+	return "tcp://" + listener.Addr().String(), messages, connects
+}
+
+func TestMQTTPublish(t *testing.T) {
+	broker, messages, connects := fakeBroker(t)
+	p, engine, _ := newTestPlugin(t, func(c *PluginConfig) {
+		c.MQTT.Broker = broker
+		c.MQTT.Username = "gotify"
+		c.MQTT.Password = "secret"
+		c.MQTT.QoS = 1
+		c.Profiles = []ServerProfile{{Name: "main", Host: "postal.example.com", Organization: "acme", Server: "mail/out"}}
+	})
+	if err := p.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disable()
+
+	select {
+	case connect := <-connects:
+		if connect[7]&0xc0 != 0xc0 || !strings.HasSuffix(string(connect), "\x00\x06gotify\x00\x06secret") {
+			t.Fatal("Credentials missing in CONNECT: ", connect)
+		}
+		if connect[7]&0x02 != 0 {
+			t.Fatal("Connected with clean session: ", connect)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publisher did not connect")
+	}
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", string(messageSentEvent))
+
+	select {
+	case message := <-messages:
+		if message.topic != "postal/mail_out/MessageSent" {
+			t.Fatal("Unexpected topic: ", message.topic)
+		}
+		var event NormalizedEvent
+		if err := json.Unmarshal(message.payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Event != "MessageSent" || event.Profile != "main" || event.Server != "mail/out" {
+			t.Fatal("Unexpected payload: ", string(message.payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was not published")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(p.mqtt.display(&p.config.Load().MQTT), "connected to "+broker+", 1 published") {
+		if time.Now().After(deadline) {
+			t.Fatal("Unexpected status: ", p.mqtt.display(&p.config.Load().MQTT))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTConfigValidation(t *testing.T) {
+	for _, broker := range []string{"http://broker", "tcp://", "::"} {
+		config := defaultMQTTConfig()
+		config.Broker = broker
+		if validateSetting(config.validate, "mqtt") == nil {
+			t.Error("Invalid broker accepted: ", broker)
+		}
+	}
+	config := defaultMQTTConfig()
+	config.Broker = "ssl://broker.local"
+	config.Topic = "postal/#"
+	if validateSetting(config.validate, "mqtt") == nil {
+		t.Error("Wildcard topic accepted")
+	}
+	config.Topic = "postal/{profile}/{event}"
+	config.QoS = 3
+	if validateSetting(config.validate, "mqtt") == nil {
+		t.Error("Invalid QoS accepted")
+	}
+	config.QoS = 1
+	config.Password = "secret"
+	if validateSetting(config.validate, "mqtt") == nil {
+		t.Error("Password without username accepted")
+	}
+}
+
+// mqttConfigSource validates the MQTT settings and returns a configuration
+// source for a publisher
+func mqttConfigSource(t *testing.T, config MQTTConfig) func() *PluginConfig {
+	if err := validateSetting(config.validate, "mqtt"); err != nil {
+		t.Fatal(err)
+	}
+	pluginConfig := &PluginConfig{MQTT: config}
+	return func() *PluginConfig { return pluginConfig }
+}
+
+// acceptMQTT accepts a connection and answers its CONNECT, reporting whether
+// the session of the client is present
+func acceptMQTT(t *testing.T, listener net.Listener, sessionPresent bool) (net.Conn, *bufio.Reader) {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	reader := bufio.NewReader(conn)
+	if packet, err := readMQTTPacket(reader); err != nil || packet.kind != mqttConnect {
+		t.Error("Expected CONNECT: ", err)
+	}
+	var flags byte
+	if sessionPresent {
+		flags = 1
+	}
+	writeMQTTPacket(conn, mqttConnack, 0, []byte{flags, 0})
+	return conn, reader
+}
+
+func TestMQTTDetectsMissingPingResponse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, reader := acceptMQTT(t, listener, false)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		// half-open connection: packets are read, but never answered
+		for {
+			if _, err := readMQTTPacket(reader); err != nil {
+				return
+			}
+		}
+	}()
+
+	config := defaultMQTTConfig()
+	config.Broker = "tcp://" + listener.Addr().String()
+	config.KeepAlive = "1s"
+	mp := newMQTTPublisher(mqttConfigSource(t, config))
+	errs := make(chan error, 1)
+	go func() { errs <- mp.session(mp.currentConfig(), make(chan struct{})) }()
+
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "no PINGRESP") {
+			t.Fatal("Unexpected session error: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Missing PINGRESP was not detected")
+	}
+}
+
+func TestMQTTRedeliveryHasDupFlag(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	publishes := make(chan *mqttPacket, 2)
+	go func() {
+		// the first connection drops the message without acknowledgement
+		conn, reader := acceptMQTT(t, listener, false)
+		if conn == nil {
+			return
+		}
+		if packet, err := readMQTTPacket(reader); err == nil {
+			publishes <- packet
+		}
+		conn.Close()
+
+		conn, reader = acceptMQTT(t, listener, true)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			packet, err := readMQTTPacket(reader)
+			if err != nil {
+				return
+			}
+			if packet.kind == mqttPublish {
+				publishes <- packet
+				topicLength := int(binary.BigEndian.Uint16(packet.body))
+				writeMQTTPacket(conn, mqttPuback, 0, packet.body[2+topicLength:4+topicLength])
+			}
+		}
+	}()
+
+	backoff := mqttReconnectBackoff
+	mqttReconnectBackoff = 10 * time.Millisecond
+	defer func() { mqttReconnectBackoff = backoff }()
+	config := defaultMQTTConfig()
+	config.Broker = "tcp://" + listener.Addr().String()
+	config.QoS = 1
+	mp := newMQTTPublisher(mqttConfigSource(t, config))
+	mp.queue <- mqttMessage{topic: "postal/test", payload: []byte("{}")}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		mp.run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	var packets []*mqttPacket
+	for len(packets) < 2 {
+		select {
+		case packet := <-publishes:
+			packets = append(packets, packet)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message was not published twice, got: ", len(packets))
+		}
+	}
+	first, second := packets[0], packets[1]
+	if first.flags&0x08 != 0 || second.flags&0x08 == 0 {
+		t.Fatal("DUP flag not set on redelivery only, flags: ", first.flags, second.flags)
+	}
+	if string(first.body) != string(second.body) {
+		t.Fatal("Redelivered message has a different packet ID or content")
+	}
+}
+
+func TestMQTTQoS2ResumesWithRelease(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan *mqttPacket, 4)
+	go func() {
+		// the first connection receives the message, but drops before PUBREL
+		conn, reader := acceptMQTT(t, listener, false)
+		if conn == nil {
+			return
+		}
+		if packet, err := readMQTTPacket(reader); err == nil {
+			received <- packet
+			topicLength := int(binary.BigEndian.Uint16(packet.body))
+			writeMQTTPacket(conn, mqttPubrec, 0, packet.body[2+topicLength:4+topicLength])
+		}
+		conn.Close()
+
+		conn, reader = acceptMQTT(t, listener, true)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			packet, err := readMQTTPacket(reader)
+			if err != nil {
+				return
+			}
+			received <- packet
+			if packet.kind == mqttPubrel {
+				writeMQTTPacket(conn, mqttPubcomp, 0, packet.body)
+			}
+		}
+	}()
+
+	backoff := mqttReconnectBackoff
+	mqttReconnectBackoff = 10 * time.Millisecond
+	defer func() { mqttReconnectBackoff = backoff }()
+	config := defaultMQTTConfig()
+	config.Broker = "tcp://" + listener.Addr().String()
+	config.QoS = 2
+	mp := newMQTTPublisher(mqttConfigSource(t, config))
+	mp.queue <- mqttMessage{topic: "postal/test", payload: []byte("{}")}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		mp.run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	var packets []*mqttPacket
+	for len(packets) < 2 {
+		select {
+		case packet := <-received:
+			packets = append(packets, packet)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message was not released after reconnecting, got: ", len(packets))
+		}
+	}
+	if packets[0].kind != mqttPublish || packets[1].kind != mqttPubrel {
+		t.Fatal("Expected PUBLISH, then only PUBREL after reconnecting, got: ", packets[0].kind, packets[1].kind)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(mp.display(&config), "1 published") {
+		if time.Now().After(deadline) {
+			t.Fatal("Message not completed: ", mp.display(&config))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
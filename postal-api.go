@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+// postalHTTPClient is shared by all API clients to reuse connections, the
+// deadline of calls is set by their context
+var postalHTTPClient = &http.Client{}
+
+// postalAPIClient calls Postal's legacy HTTP API with a server API key
+type postalAPIClient struct {
+	baseURL string
+	key     string
+}
+
+func newPostalAPIClient(baseURL, key string) *postalAPIClient {
+	return &postalAPIClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		key:     key,
+	}
+}
+
+// call posts the request to the API endpoint and unmarshals the response data into result
+func (c *postalAPIClient) call(ctx context.Context, endpoint string, request interface{}, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v1/"+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Server-API-Key", c.key)
+
+	resp, err := postalHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("postal API returned status %d for %s", resp.StatusCode, endpoint)
+	}
+
+	var response postal.APIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("could not decode postal API response: %w", err)
+	}
+	if response.Status != "success" {
+		var apiErr postal.APIError
+		json.Unmarshal(response.Data, &apiErr)
+		return fmt.Errorf("postal API error for %s: %s (%s)", endpoint, apiErr.Message, apiErr.Code)
+	}
+	return json.Unmarshal(response.Data, result)
+}
+
+// message fetches a message with the given expansions, e.g. "plain_body" or "headers"
+func (c *postalAPIClient) message(ctx context.Context, id int, expansions ...string) (*postal.APIMessage, error) {
+	var message postal.APIMessage
+	request := map[string]interface{}{
+		"id":          id,
+		"_expansions": expansions,
+	}
+	if err := c.call(ctx, "messages/message", request, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// deliveries fetches all delivery attempts of a message
+func (c *postalAPIClient) deliveries(ctx context.Context, id int) ([]postal.APIDelivery, error) {
+	var deliveries []postal.APIDelivery
+	if err := c.call(ctx, "messages/deliveries", map[string]interface{}{"id": id}, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
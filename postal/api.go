@@ -0,0 +1,66 @@
+package postal
+
+import (
+	"encoding/json"
+)
+
+// APIResponse is the envelope of all responses of Postal's legacy HTTP API
+type APIResponse struct {
+	Status string          `json:"status"`
+	Time   float64         `json:"time"`
+	Flags  json.RawMessage `json:"flags"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// APIError is the data of an API response with status "error"
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// APIMessage is returned by the messages/message API endpoint. Fields are only
+// set if the corresponding expansion was requested.
+type APIMessage struct {
+	ID        int                 `json:"id"`
+	Token     string              `json:"token"`
+	Status    *APIMessageStatus   `json:"status"`
+	Details   *APIMessageDetails  `json:"details"`
+	PlainBody *string             `json:"plain_body"`
+	HTMLBody  *string             `json:"html_body"`
+	Headers   map[string][]string `json:"headers"`
+	// RawMessage is the base64 encoded RFC 822 message
+	RawMessage *string `json:"raw_message"`
+}
+
+type APIMessageStatus struct {
+	Status              string   `json:"status"`
+	LastDeliveryAttempt float64  `json:"last_delivery_attempt"`
+	Held                bool     `json:"held"`
+	HoldExpiry          *float64 `json:"hold_expiry"`
+}
+
+type APIMessageDetails struct {
+	RcptTo          string  `json:"rcpt_to"`
+	MailFrom        string  `json:"mail_from"`
+	Subject         string  `json:"subject"`
+	MessageID       string  `json:"message_id"`
+	Timestamp       float64 `json:"timestamp"`
+	Direction       string  `json:"direction"`
+	Size            string  `json:"size"`
+	Bounce          bool    `json:"bounce"`
+	BounceForID     int     `json:"bounce_for_id"`
+	Tag             *string `json:"tag"`
+	ReceivedWithSSL bool    `json:"received_with_ssl"`
+}
+
+// APIDelivery is one delivery attempt returned by the messages/deliveries API endpoint
+type APIDelivery struct {
+	ID          int     `json:"id"`
+	Status      string  `json:"status"`
+	Details     string  `json:"details"`
+	Output      string  `json:"output"`
+	SentWithSSL bool    `json:"sent_with_ssl"`
+	LogID       string  `json:"log_id"`
+	Time        float64 `json:"time"`
+	Timestamp   float64 `json:"timestamp"`
+}
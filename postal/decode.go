@@ -0,0 +1,73 @@
+package postal
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PayloadError is returned by Decode if the envelope is valid, but the payload
+// does not match the model of the event
+type PayloadError struct {
+	Event EventType
+	Err   error
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("invalid %s payload: %v", e.Event, e.Err)
+}
+
+func (e *PayloadError) Unwrap() error {
+	return e.Err
+}
+
+// newEvent returns an empty model for the event type, or nil for unknown events
+func newEvent(eventType EventType) Event {
+	switch eventType {
+	case EventMessageSent, EventMessageDelayed, EventMessageDeliveryFailed, EventMessageHeld:
+		return &MessageStatusEvent{}
+	case EventMessageBounced:
+		return &MessageBounceEvent{}
+	case EventMessageLinkClicked:
+		return &MessageClickEvent{}
+	case EventMessageLoaded:
+		return &MessageLoadedEvent{}
+	case EventDomainDNSError:
+		return &DNSErrorEvent{}
+	}
+	return nil
+}
+
+// Decode decodes a webhook request body: the envelope is unmarshalled once,
+// keeping the payload raw, which is then unmarshalled straight into the model
+// of its event. Events without a model are returned as *UnknownEvent, invalid
+// payloads of known events as *PayloadError.
+func Decode(data []byte) (Event, error) {
+	envelope, err := DecodeEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePayload(envelope)
+}
+
+// DecodeEnvelope decodes the fields common to all webhooks, leaving the payload
+// undecoded
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+// DecodePayload decodes the payload of the envelope into the model of its event
+func DecodePayload(envelope *Envelope) (Event, error) {
+	event := newEvent(envelope.Event)
+	if event == nil {
+		return &UnknownEvent{Envelope: *envelope}, nil
+	}
+	if err := json.Unmarshal(envelope.Payload, event); err != nil {
+		return nil, &PayloadError{Event: envelope.Event, Err: err}
+	}
+	*event.Metadata() = *envelope
+	return event, nil
+}
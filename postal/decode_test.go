@@ -0,0 +1,78 @@
+package postal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeTypedEvents(t *testing.T) {
+	tests := []struct {
+		body  string
+		check func(Event) bool
+	}{
+		{`{"event":"MessageDeliveryFailed","uuid":"a","payload":{"status":"HardFail","message":{"id":1,"to":"x@example.com"}}}`, func(e Event) bool {
+			msg, ok := e.(*MessageStatusEvent)
+			return ok && msg.Status == "HardFail" && msg.Message.To == "x@example.com"
+		}},
+		{`{"event":"MessageBounced","uuid":"a","payload":{"original_message":{"id":1},"bounce":{"id":2}}}`, func(e Event) bool {
+			msg, ok := e.(*MessageBounceEvent)
+			return ok && msg.OriginalMessage.ID == 1 && msg.Bounce.ID == 2
+		}},
+		{`{"event":"MessageLinkClicked","uuid":"a","payload":{"url":"https://example.com"}}`, func(e Event) bool {
+			msg, ok := e.(*MessageClickEvent)
+			return ok && msg.URL == "https://example.com"
+		}},
+		{`{"event":"MessageLoaded","uuid":"a","payload":{"ip_address":"127.0.0.1"}}`, func(e Event) bool {
+			msg, ok := e.(*MessageLoadedEvent)
+			return ok && msg.IPAddress == "127.0.0.1"
+		}},
+		{`{"event":"DomainDNSError","uuid":"a","payload":{"domain":"example.com","uuid":"domain"}}`, func(e Event) bool {
+			msg, ok := e.(*DNSErrorEvent)
+			return ok && msg.Domain == "example.com" && msg.UUID == "domain"
+		}},
+		{`{"event":"SomethingNew","uuid":"a","payload":{"x":1}}`, func(e Event) bool {
+			msg, ok := e.(*UnknownEvent)
+			return ok && string(msg.Payload) == `{"x":1}`
+		}},
+	}
+	for _, test := range tests {
+		event, err := Decode([]byte(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.check(event) {
+			t.Errorf("Unexpected event for %s: %+v", test.body, event)
+		}
+		if event.Metadata().UUID != "a" {
+			t.Errorf("Envelope not set for %s", test.body)
+		}
+	}
+}
+
+func TestDecodeInvalidPayload(t *testing.T) {
+	_, err := Decode([]byte(`{"event":"MessageBounced","payload":{"bounce":"nope"}}`))
+	var payloadErr *PayloadError
+	if !errors.As(err, &payloadErr) || payloadErr.Event != EventMessageBounced {
+		t.Fatal("Expected payload error, got ", err)
+	}
+	if _, err := Decode([]byte(`not json`)); err == nil || errors.As(err, &payloadErr) {
+		t.Fatal("Expected syntax error, got ", err)
+	}
+}
+
+var benchmarkWebhook = []byte(`{"event":"MessageSent","timestamp":1477945177.12994,"uuid":"6f3a5c1e-8a0b-4f5e-9d51-3c7e0c1e2b4a","payload":{` +
+	`"status":"Sent","details":"Message sent by SMTP to aspmx.l.google.com (2a00:1450:400c:c0b::1b) (from 2a00:67a0:a:15::2)",` +
+	`"output":"250 2.0.0 OK 1477944899 ly2si31746747wjb.95 - gsmtp","time":0.22,"sent_with_ssl":true,"timestamp":1477945177.12994,` +
+	`"message":{"id":12345,"token":"abcdef123","direction":"outgoing","message_id":"5817a64332f44_4ec93ff59e79d154565eb@app34.mail",` +
+	`"to":"test@example.com","from":"sales@awesomeapp.com","subject":"Welcome to AwesomeApp","timestamp":1477945177.12994,` +
+	`"spam_status":"NotSpam","tag":"welcome"}}}`)
+
+func BenchmarkDecode(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkWebhook)))
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(benchmarkWebhook); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Package postal contains the models of Postal's webhooks, HTTP endpoints and
+// legacy HTTP API, along with a decoder and signature verification for webhooks.
+package postal
+
+import (
+	"encoding/json"
+)
+
+// EventType is the name of a webhook event
+type EventType string
+
+const (
+	// send events
+	EventMessageSent           EventType = "MessageSent"
+	EventMessageDelayed        EventType = "MessageDelayed"
+	EventMessageDeliveryFailed EventType = "MessageDeliveryFailed"
+	EventMessageHeld           EventType = "MessageHeld"
+
+	// other events
+	EventMessageLoaded      EventType = "MessageLoaded"
+	EventMessageBounced     EventType = "MessageBounced"
+	EventMessageLinkClicked EventType = "MessageLinkClicked"
+	EventDomainDNSError     EventType = "DomainDNSError"
+)
+
+// Envelope holds the fields Postal sends with every webhook
+type Envelope struct {
+	Event     EventType       `json:"event"`
+	Timestamp float64         `json:"timestamp"`
+	UUID      string          `json:"uuid"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Type returns the event name
+func (e *Envelope) Type() EventType {
+	return e.Event
+}
+
+// Metadata returns the envelope the event was received in
+func (e *Envelope) Metadata() *Envelope {
+	return e
+}
+
+// Event is a decoded webhook. Use a type switch to access the payload:
+//
+//	switch e := event.(type) {
+//	case *postal.MessageStatusEvent:
+//	case *postal.MessageBounceEvent:
+//	...
+//	}
+type Event interface {
+	Type() EventType
+	Metadata() *Envelope
+}
+
+// MessageStatusEvent is the payload of MessageSent, MessageDelayed,
+// MessageDeliveryFailed and MessageHeld events
+type MessageStatusEvent struct {
+	Envelope    `json:"-"`
+	Status      string  `json:"status"`
+	Details     string  `json:"details"`
+	Output      string  `json:"output"`
+	Time        float64 `json:"time"`
+	SentWithSSL bool    `json:"sent_with_ssl"`
+	Timestamp   float64 `json:"timestamp"`
+	Message     Message `json:"message"`
+}
+
+// MessageBounceEvent is the payload of MessageBounced events
+type MessageBounceEvent struct {
+	Envelope        `json:"-"`
+	OriginalMessage Message `json:"original_message"`
+	Bounce          Message `json:"bounce"`
+}
+
+// MessageClickEvent is the payload of MessageLinkClicked events
+type MessageClickEvent struct {
+	Envelope  `json:"-"`
+	URL       string  `json:"url"`
+	Token     string  `json:"token"`
+	IPAddress string  `json:"ip_address"`
+	UserAgent string  `json:"user_agent"`
+	Message   Message `json:"message"`
+}
+
+// MessageLoadedEvent is the payload of MessageLoaded events
+type MessageLoadedEvent struct {
+	Envelope  `json:"-"`
+	IPAddress string  `json:"ip_address"`
+	UserAgent string  `json:"user_agent"`
+	Message   Message `json:"message"`
+}
+
+// DNSErrorEvent is the payload of DomainDNSError events
+type DNSErrorEvent struct {
+	Envelope         `json:"-"`
+	Domain           string  `json:"domain"`
+	UUID             string  `json:"uuid"`
+	DNSCheckedAt     float64 `json:"dns_checked_at"`
+	SPFStatus        string  `json:"spf_status"`
+	SPFError         string  `json:"spf_error"`
+	DKIMStatus       string  `json:"dkim_status"`
+	DKIMError        string  `json:"dkim_error"`
+	MXStatus         string  `json:"mx_status"`
+	MXError          string  `json:"mx_error"`
+	ReturnPathStatus string  `json:"return_path_status"`
+	ReturnPathError  string  `json:"return_path_error"`
+	Server           Server  `json:"server"`
+}
+
+// UnknownEvent is returned for events this package has no model for, the
+// payload is left undecoded in the envelope
+type UnknownEvent struct {
+	Envelope
+}
+
+type Message struct {
+	ID         int     `json:"id"`
+	Token      string  `json:"token"`
+	Direction  string  `json:"direction"`
+	MessageID  string  `json:"message_id"`
+	To         string  `json:"to"`
+	From       string  `json:"from"`
+	Subject    string  `json:"subject"`
+	Timestamp  float64 `json:"timestamp"`
+	SpamStatus string  `json:"spam_status"`
+	Tag        *string `json:"tag"`
+}
+
+type Server struct {
+	UUID         string `json:"uuid"`
+	Name         string `json:"name"`
+	Permalink    string `json:"permalink"`
+	Organization string `json:"organization"`
+}
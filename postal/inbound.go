@@ -0,0 +1,37 @@
+package postal
+
+// InboundMessage is sent by Postal HTTP endpoints for incoming mail. Depending
+// on the endpoint's format, either the parsed fields (hash format) or the
+// complete RFC 822 message in Message (raw format) are set.
+type InboundMessage struct {
+	ID                 int                 `json:"id"`
+	RcptTo             string              `json:"rcpt_to"`
+	MailFrom           string              `json:"mail_from"`
+	Token              string              `json:"token"`
+	Subject            string              `json:"subject"`
+	MessageID          string              `json:"message_id"`
+	Timestamp          float64             `json:"timestamp"`
+	SpamStatus         string              `json:"spam_status"`
+	SpamScore          float64             `json:"spam_score"`
+	Bounce             bool                `json:"bounce"`
+	ReceivedWithSSL    bool                `json:"received_with_ssl"`
+	To                 string              `json:"to"`
+	Cc                 string              `json:"cc"`
+	From               string              `json:"from"`
+	Date               string              `json:"date"`
+	PlainBody          string              `json:"plain_body"`
+	HTMLBody           string              `json:"html_body"`
+	AttachmentQuantity int                 `json:"attachment_quantity"`
+	Attachments        []InboundAttachment `json:"attachments"`
+
+	// raw format
+	Message string `json:"message"`
+	Base64  bool   `json:"base64"`
+}
+
+type InboundAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Data        string `json:"data"`
+}
@@ -0,0 +1,81 @@
+package postal
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers Postal signs webhooks with
+const (
+	SignatureHeader       = "X-Postal-Signature"     // RSA with SHA-1
+	SignatureSHA256Header = "X-Postal-Signature-256" // RSA with SHA-256, sent by Postal v3
+)
+
+// ErrMissingSignature is returned by VerifyRequest if the request is not signed
+var ErrMissingSignature = errors.New("webhook signature missing")
+
+// ParsePublicKey parses the webhook signing key of a Postal server, either PEM
+// encoded or as the base64 encoded key shown in Postal's DNS records (p=...)
+func ParsePublicKey(key string) (*rsa.PublicKey, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(key)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.Join(strings.Fields(key), ""), "p="))
+		if err != nil {
+			return nil, fmt.Errorf("public key is neither PEM nor base64 encoded: %w", err)
+		}
+	}
+
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if rsaKey, ok := pub.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return x509.ParsePKCS1PublicKey(der)
+}
+
+// Verify checks the base64 encoded X-Postal-Signature of a webhook body
+func Verify(body []byte, signature string, key *rsa.PublicKey) error {
+	digest := sha1.Sum(body)
+	return verify(crypto.SHA1, digest[:], signature, key)
+}
+
+// VerifySHA256 checks the base64 encoded X-Postal-Signature-256 of a webhook body
+func VerifySHA256(body []byte, signature string, key *rsa.PublicKey) error {
+	digest := sha256.Sum256(body)
+	return verify(crypto.SHA256, digest[:], signature, key)
+}
+
+// VerifyRequest checks the strongest signature present in the request headers
+func VerifyRequest(header http.Header, body []byte, key *rsa.PublicKey) error {
+	if signature := header.Get(SignatureSHA256Header); signature != "" {
+		return VerifySHA256(body, signature, key)
+	}
+	if signature := header.Get(SignatureHeader); signature != "" {
+		return Verify(body, signature, key)
+	}
+	return ErrMissingSignature
+}
+
+func verify(hash crypto.Hash, digest []byte, signature string, key *rsa.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return fmt.Errorf("invalid webhook signature encoding: %w", err)
+	}
+	if err := rsa.VerifyPKCS1v15(key, hash, digest, sig); err != nil {
+		return errors.New("webhook signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package postal
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	body := []byte(`{"event":"MessageSent"}`)
+	sha1Digest := sha1.Sum(body)
+	sha1Sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, sha1Digest[:])
+	sha256Digest := sha256.Sum256(body)
+	sha256Sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sha256Digest[:])
+
+	for _, encoded := range []string{
+		base64.StdEncoding.EncodeToString(der),
+		"p=" + base64.StdEncoding.EncodeToString(der),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})),
+	} {
+		pub, err := ParsePublicKey(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(body, base64.StdEncoding.EncodeToString(sha1Sig), pub); err != nil {
+			t.Error(err)
+		}
+	}
+
+	pub, _ := ParsePublicKey(base64.StdEncoding.EncodeToString(der))
+	header := http.Header{}
+	if err := VerifyRequest(header, body, pub); err != ErrMissingSignature {
+		t.Error("Expected missing signature, got ", err)
+	}
+	header.Set(SignatureSHA256Header, base64.StdEncoding.EncodeToString(sha256Sig))
+	if err := VerifyRequest(header, body, pub); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyRequest(header, []byte(`{"event":"MessageHeld"}`), pub); err == nil {
+		t.Error("Tampered body accepted")
+	}
+	if err := Verify(body, base64.StdEncoding.EncodeToString(sha256Sig), pub); err == nil {
+		t.Error("SHA-256 signature accepted as SHA-1 signature")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+)
+
+// mailgunWebhook is the body of Mailgun's webhooks (API v3)
+type mailgunWebhook struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData json.RawMessage `json:"event-data"`
+}
+
+type mailgunEvent struct {
+	Event      string  `json:"event"`
+	ID         string  `json:"id"`
+	Timestamp  float64 `json:"timestamp"`
+	Recipient  string  `json:"recipient"`
+	Severity   string  `json:"severity"` // failed events: permanent or temporary
+	Reason     string  `json:"reason"`
+	URL        string  `json:"url"`
+	IP         string  `json:"ip"`
+	ClientInfo struct {
+		UserAgent string `json:"user-agent"`
+	} `json:"client-info"`
+	Message struct {
+		Headers struct {
+			From      string `json:"from"`
+			To        string `json:"to"`
+			Subject   string `json:"subject"`
+			MessageID string `json:"message-id"`
+		} `json:"headers"`
+	} `json:"message"`
+	DeliveryStatus struct {
+		TLS            bool    `json:"tls"`
+		Code           int     `json:"code"`
+		EnhancedCode   string  `json:"enhanced-code"`
+		Message        string  `json:"message"`
+		Description    string  `json:"description"`
+		SessionSeconds float64 `json:"session-seconds"`
+	} `json:"delivery-status"`
+}
+
+type mailgunAdapter struct {
+	// tokens are the tokens of recently verified webhooks
+	tokens *usedLinks
+}
+
+func (mailgunAdapter) validate(v *configValidator, path string, config *ProviderConfig) {
+	if config.SigningKey == "" {
+		v.fail(field(path, "signing_key"), "signing key is required")
+	}
+}
+
+// verify checks the HMAC of timestamp and token with the webhook signing key,
+// that the timestamp is recent and that the token was not used before
+func (ma mailgunAdapter) verify(_ *http.Request, body []byte, config *ProviderConfig) error {
+	var webhook mailgunWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(config.SigningKey))
+	mac.Write([]byte(webhook.Signature.Timestamp + webhook.Signature.Token))
+	signature, err := hex.DecodeString(webhook.Signature.Signature)
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("invalid Mailgun signature")
+	}
+	seconds, err := strconv.ParseInt(webhook.Signature.Timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid Mailgun signature timestamp")
+	}
+	signed := time.Unix(seconds, 0)
+	if err := checkSignatureAge("Mailgun", signed); err != nil {
+		return err
+	}
+	if !ma.tokens.claim(config.SigningKey+"\x00"+webhook.Signature.Token, signed.Add(signatureMaxAge)) {
+		return errors.New("Mailgun signature token was used before")
+	}
+	return nil
+}
+
+func (mailgunAdapter) decode(body []byte, _ *ProviderConfig) ([]*DeliveryEvent, error) {
+	var webhook mailgunWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, err
+	}
+	var e mailgunEvent
+	if err := json.Unmarshal(webhook.EventData, &e); err != nil {
+		return nil, fmt.Errorf("invalid event data: %w", err)
+	}
+
+	headers := e.Message.Headers
+	to := headers.To
+	if e.Recipient != "" {
+		to = e.Recipient
+	}
+	newEvent := func(kind EventKind) *DeliveryEvent {
+		event := newDeliveryEvent(ProviderMailgun, kind, e.ID, unixTime(e.Timestamp), webhook.EventData)
+		event.MessageRef = MessageRef{Token: e.ID, MessageID: headers.MessageID, Subject: headers.Subject}
+		event.Sender = headers.From
+		event.Recipients = []string{to}
+		return event
+	}
+	status := e.DeliveryStatus
+	details := status.Message
+	if details == "" {
+		details = status.Description
+	}
+	output := ""
+	if status.Code != 0 {
+		output = fmt.Sprintf("%d %s", status.Code, status.Message)
+	}
+
+	switch e.Event {
+	case "delivered":
+		event := withResponse(newEvent(KindDelivered), details, output)
+		event.Response.TLS = status.TLS
+		event.Timings.DeliveryTime = status.SessionSeconds
+		return []*DeliveryEvent{event}, nil
+	case "failed":
+		if e.Severity == "temporary" {
+			return []*DeliveryEvent{withResponse(newEvent(KindDelayed), details, output)}, nil
+		}
+		if e.Reason != "bounce" {
+			// e.g. suppress-bounce: Mailgun didn't try to deliver the message
+			return []*DeliveryEvent{withResponse(newEvent(KindFailed), details+" ("+e.Reason+")", output)}, nil
+		}
+		code := status.EnhancedCode
+		if code == "" {
+			code = fmt.Sprintf("%d.0.0", status.Code/100)
+		}
+		return []*DeliveryEvent{withBounce(newEvent(KindBounced), "Mailgun", details, mailparse.DeliveryStatus{
+			FinalRecipient: to,
+			Action:         "failed",
+			Status:         code,
+			DiagnosticCode: output,
+		})}, nil
+	case "opened":
+		return []*DeliveryEvent{withClient(newEvent(KindOpened), e.IP, e.ClientInfo.UserAgent, "")}, nil
+	case "clicked":
+		return []*DeliveryEvent{withClient(newEvent(KindClicked), e.IP, e.ClientInfo.UserAgent, e.URL)}, nil
+	}
+	return nil, nil
+}
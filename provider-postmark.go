@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+)
+
+// postmarkEvent holds the fields of Postmark's delivery, bounce, open and click webhooks
+type postmarkEvent struct {
+	RecordType  string    `json:"RecordType"`
+	ID          int64     `json:"ID"` // bounces only
+	MessageID   string    `json:"MessageID"`
+	Recipient   string    `json:"Recipient"`
+	Email       string    `json:"Email"` // bounces use Email instead of Recipient
+	From        string    `json:"From"`
+	Subject     string    `json:"Subject"`
+	Tag         string    `json:"Tag"`
+	Details     string    `json:"Details"`
+	Description string    `json:"Description"`
+	Type        string    `json:"Type"` // bounce type, e.g. HardBounce or SoftBounce
+	DeliveredAt time.Time `json:"DeliveredAt"`
+	BouncedAt   time.Time `json:"BouncedAt"`
+	ReceivedAt  time.Time `json:"ReceivedAt"`
+	UserAgent   string    `json:"UserAgent"`
+	Geo         struct {
+		IP string `json:"IP"`
+	} `json:"Geo"`
+	OriginalLink string `json:"OriginalLink"`
+}
+
+// postmarkHardBounces are the bounce types that are permanent failures
+var postmarkHardBounces = map[string]bool{
+	"HardBounce":          true,
+	"BadEmailAddress":     true,
+	"ManuallyDeactivated": true,
+	"Blocked":             true,
+	"SpamNotification":    true,
+}
+
+type postmarkAdapter struct{}
+
+func (postmarkAdapter) validate(v *configValidator, path string, config *ProviderConfig) {
+	if config.Username == "" {
+		v.fail(field(path, "username"), "username for basic authentication is required")
+	}
+	if config.Password == "" {
+		v.fail(field(path, "password"), "password for basic authentication is required")
+	}
+}
+
+// verify checks the basic authentication credentials, Postmark doesn't sign webhooks
+func (postmarkAdapter) verify(r *http.Request, _ []byte, config *ProviderConfig) error {
+	username, password, ok := r.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(username), []byte(config.Username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(config.Password)) != 1 {
+		return errors.New("invalid Postmark credentials")
+	}
+	return nil
+}
+
+func (postmarkAdapter) decode(body []byte, _ *ProviderConfig) ([]*DeliveryEvent, error) {
+	var e postmarkEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	recipient := e.Recipient
+	if recipient == "" {
+		recipient = e.Email
+	}
+	newEvent := func(kind EventKind, at time.Time) *DeliveryEvent {
+		event := newDeliveryEvent(ProviderPostmark, kind, e.MessageID, at, body)
+		event.MessageRef = MessageRef{Token: e.MessageID, Subject: e.Subject, Tag: e.Tag}
+		event.Sender = e.From
+		event.Recipients = []string{recipient}
+		return event
+	}
+
+	switch e.RecordType {
+	case "Delivery":
+		return []*DeliveryEvent{withResponse(newEvent(KindDelivered, e.DeliveredAt), e.Details, e.Details)}, nil
+	case "Bounce":
+		status := "4.0.0"
+		if postmarkHardBounces[e.Type] {
+			status = "5.0.0"
+		}
+		return []*DeliveryEvent{withBounce(newEvent(KindBounced, e.BouncedAt), "Postmark", e.Description, mailparse.DeliveryStatus{
+			FinalRecipient: recipient,
+			Action:         "failed",
+			Status:         status,
+			DiagnosticCode: e.Details,
+		})}, nil
+	case "Open":
+		return []*DeliveryEvent{withClient(newEvent(KindOpened, e.ReceivedAt), e.Geo.IP, e.UserAgent, "")}, nil
+	case "Click":
+		return []*DeliveryEvent{withClient(newEvent(KindClicked, e.ReceivedAt), e.Geo.IP, e.UserAgent, e.OriginalLink)}, nil
+	}
+	return nil, nil
+}
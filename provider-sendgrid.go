@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+)
+
+// Headers of SendGrid's signed event webhook
+const (
+	sendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	sendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+// sendGridEvent is one element of the event webhook's JSON array
+type sendGridEvent struct {
+	Event       string  `json:"event"`
+	Email       string  `json:"email"`
+	Timestamp   float64 `json:"timestamp"`
+	SMTPID      string  `json:"smtp-id"`
+	EventID     string  `json:"sg_event_id"`
+	SGMessageID string  `json:"sg_message_id"`
+	Response    string  `json:"response"`
+	Reason      string  `json:"reason"`
+	Status      string  `json:"status"`
+	Type        string  `json:"type"` // bounce events: bounce or blocked
+	TLS         int     `json:"tls"`
+	URL         string  `json:"url"`
+	UserAgent   string  `json:"useragent"`
+	IP          string  `json:"ip"`
+}
+
+type sendGridAdapter struct {
+	// signatures are the signed timestamps and bodies of recently verified webhooks
+	signatures *usedLinks
+}
+
+// parseSendGridKey parses the base64 encoded verification key of the signed event webhook
+func parseSendGridKey(key string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("verification key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+func (sendGridAdapter) validate(v *configValidator, path string, config *ProviderConfig) {
+	if config.SigningKey == "" {
+		v.fail(field(path, "signing_key"), "verification key of the signed event webhook is required")
+		return
+	}
+	key, err := parseSendGridKey(config.SigningKey)
+	if err != nil {
+		v.fail(field(path, "signing_key"), "invalid verification key: %w", err)
+		return
+	}
+	config.publicKey = key
+}
+
+// verify checks the ECDSA signature of timestamp and body, that the timestamp is
+// recent and that the webhook was not received before
+func (sa sendGridAdapter) verify(r *http.Request, body []byte, config *ProviderConfig) error {
+	key, ok := config.publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("SendGrid verification key missing")
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(sendGridSignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return errors.New("SendGrid signature missing")
+	}
+	timestamp := r.Header.Get(sendGridTimestampHeader)
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.VerifyASN1(key, digest[:], signature) {
+		return errors.New("invalid SendGrid signature")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid SendGrid signature timestamp")
+	}
+	signed := time.Unix(seconds, 0)
+	if err := checkSignatureAge("SendGrid", signed); err != nil {
+		return err
+	}
+	// the digest identifies the webhook, ECDSA signatures of it are not unique
+	if !sa.signatures.claim(config.SigningKey+"\x00"+string(digest[:]), signed.Add(signatureMaxAge)) {
+		return errors.New("SendGrid webhook was received before")
+	}
+	return nil
+}
+
+func (sendGridAdapter) decode(body []byte, _ *ProviderConfig) ([]*DeliveryEvent, error) {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(body, &raws); err != nil {
+		return nil, err
+	}
+	var events []*DeliveryEvent
+	for _, raw := range raws {
+		var e sendGridEvent
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return nil, err
+		}
+		newEvent := func(kind EventKind) *DeliveryEvent {
+			event := newDeliveryEvent(ProviderSendGrid, kind, e.EventID, unixTime(e.Timestamp), raw)
+			event.MessageRef = MessageRef{Token: e.SGMessageID, MessageID: strings.Trim(e.SMTPID, "<>")}
+			event.Recipients = []string{e.Email}
+			return event
+		}
+
+		switch e.Event {
+		case "delivered":
+			event := withResponse(newEvent(KindDelivered), e.Response, e.Response)
+			event.Response.TLS = e.TLS == 1
+			events = append(events, event)
+		case "deferred":
+			events = append(events, withResponse(newEvent(KindDelayed), e.Response, e.Response))
+		case "dropped":
+			events = append(events, withResponse(newEvent(KindFailed), e.Reason, ""))
+		case "bounce":
+			events = append(events, withBounce(newEvent(KindBounced), "SendGrid", e.Reason, mailparse.DeliveryStatus{
+				FinalRecipient: e.Email,
+				Action:         "failed",
+				Status:         e.Status,
+				DiagnosticCode: e.Reason,
+			}))
+		case "open":
+			events = append(events, withClient(newEvent(KindOpened), e.IP, e.UserAgent, ""))
+		case "click":
+			events = append(events, withClient(newEvent(KindClicked), e.IP, e.UserAgent, e.URL))
+		}
+	}
+	return events, nil
+}
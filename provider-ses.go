@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+)
+
+// snsHostRegex matches the hosts SNS certificates and subscription URLs are served from
+var snsHostRegex = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var snsClient = &http.Client{Timeout: 10 * time.Second}
+
+// snsCertificates caches the signing certificates by URL
+var snsCertificates sync.Map
+
+// fetchSNSCertificate returns the certificate SNS messages are signed with. It is
+// a variable to allow tests to sign messages without AWS.
+var fetchSNSCertificate = func(certURL string) (*x509.Certificate, error) {
+	if cert, ok := snsCertificates.Load(certURL); ok {
+		return cert.(*x509.Certificate), nil
+	}
+	if err := checkSNSURL(certURL); err != nil {
+		return nil, err
+	}
+	resp, err := snsClient.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("SNS signing certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	snsCertificates.Store(certURL, cert)
+	return cert, nil
+}
+
+// checkSNSURL makes sure certificates and subscriptions are only fetched from AWS
+func checkSNSURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || !snsHostRegex.MatchString(u.Hostname()) {
+		return fmt.Errorf("untrusted SNS URL '%s'", rawURL)
+	}
+	return nil
+}
+
+// snsMessage is an Amazon SNS HTTP(S) notification
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+// stringToSign builds the canonical representation SNS signs
+func (m *snsMessage) stringToSign() string {
+	var fields []string
+	if m.Type == "Notification" {
+		fields = []string{"Message", m.Message, "MessageId", m.MessageID}
+		if m.Subject != "" {
+			fields = append(fields, "Subject", m.Subject)
+		}
+		fields = append(fields, "Timestamp", m.Timestamp, "TopicArn", m.TopicArn, "Type", m.Type)
+	} else {
+		fields = []string{"Message", m.Message, "MessageId", m.MessageID, "SubscribeURL", m.SubscribeURL,
+			"Timestamp", m.Timestamp, "Token", m.Token, "TopicArn", m.TopicArn, "Type", m.Type}
+	}
+	return strings.Join(fields, "\n") + "\n"
+}
+
+// sesMail is the mail object of SES event notifications
+type sesMail struct {
+	MessageID     string   `json:"messageId"`
+	Source        string   `json:"source"`
+	Destination   []string `json:"destination"`
+	CommonHeaders struct {
+		From      []string `json:"from"`
+		Subject   string   `json:"subject"`
+		MessageID string   `json:"messageId"`
+	} `json:"commonHeaders"`
+}
+
+type sesRecipientStatus struct {
+	EmailAddress   string `json:"emailAddress"`
+	Action         string `json:"action"`
+	Status         string `json:"status"`
+	DiagnosticCode string `json:"diagnosticCode"`
+}
+
+// sesNotification holds the fields of SES event publishing and notifications
+type sesNotification struct {
+	EventType        string  `json:"eventType"`
+	NotificationType string  `json:"notificationType"`
+	Mail             sesMail `json:"mail"`
+	Delivery         struct {
+		Timestamp            time.Time `json:"timestamp"`
+		ProcessingTimeMillis float64   `json:"processingTimeMillis"`
+		Recipients           []string  `json:"recipients"`
+		SMTPResponse         string    `json:"smtpResponse"`
+	} `json:"delivery"`
+	Bounce struct {
+		BounceType        string               `json:"bounceType"`
+		BounceSubType     string               `json:"bounceSubType"`
+		BouncedRecipients []sesRecipientStatus `json:"bouncedRecipients"`
+		Timestamp         time.Time            `json:"timestamp"`
+		FeedbackID        string               `json:"feedbackId"`
+	} `json:"bounce"`
+	DeliveryDelay struct {
+		DelayType         string               `json:"delayType"`
+		DelayedRecipients []sesRecipientStatus `json:"delayedRecipients"`
+		Timestamp         time.Time            `json:"timestamp"`
+	} `json:"deliveryDelay"`
+	Reject struct {
+		Reason string `json:"reason"`
+	} `json:"reject"`
+	Open struct {
+		IPAddress string    `json:"ipAddress"`
+		Timestamp time.Time `json:"timestamp"`
+		UserAgent string    `json:"userAgent"`
+	} `json:"open"`
+	Click struct {
+		IPAddress string    `json:"ipAddress"`
+		Timestamp time.Time `json:"timestamp"`
+		UserAgent string    `json:"userAgent"`
+		Link      string    `json:"link"`
+	} `json:"click"`
+}
+
+type sesAdapter struct {
+	// messages are the IDs of recently verified SNS messages
+	messages *usedLinks
+}
+
+func (sesAdapter) validate(v *configValidator, path string, config *ProviderConfig) {
+	// any AWS account can sign SNS messages, so the topics have to be known
+	if len(config.TopicARNs) == 0 {
+		v.fail(field(path, "topic_arns"), "SNS topics are required")
+	}
+	for i, arn := range config.TopicARNs {
+		if !strings.HasPrefix(arn, "arn:aws:sns:") && !strings.HasPrefix(arn, "arn:aws-cn:sns:") {
+			v.fail(index(field(path, "topic_arns"), i), "invalid SNS topic ARN '%s'", arn)
+		}
+	}
+}
+
+// verify checks the signature of the SNS message with the certificate of the
+// topic, that it was sent recently and that it was not received before
+func (sa sesAdapter) verify(_ *http.Request, body []byte, _ *ProviderConfig) error {
+	var m snsMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return err
+	}
+	cert, err := fetchSNSCertificate(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("SNS signing certificate has no RSA key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return errors.New("invalid SNS signature encoding")
+	}
+	var hash crypto.Hash
+	var digest []byte
+	switch m.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(m.stringToSign()))
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256([]byte(m.stringToSign()))
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return fmt.Errorf("unsupported SNS signature version '%s'", m.SignatureVersion)
+	}
+	if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+		return errors.New("invalid SNS signature")
+	}
+	signed, err := time.Parse(time.RFC3339, m.Timestamp)
+	if err != nil {
+		return errors.New("invalid SNS timestamp")
+	}
+	if err := checkSignatureAge("SNS", signed); err != nil {
+		return err
+	}
+	if !sa.messages.claim(m.TopicArn+"\x00"+m.MessageID, signed.Add(signatureMaxAge)) {
+		return errors.New("SNS message was received before")
+	}
+	return nil
+}
+
+// decode confirms subscriptions to allowed topics and converts SES notifications
+func (sesAdapter) decode(body []byte, config *ProviderConfig) ([]*DeliveryEvent, error) {
+	var m snsMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(config.TopicARNs, m.TopicArn) {
+		return nil, fmt.Errorf("SNS topic %s is not allowed", m.TopicArn)
+	}
+
+	switch m.Type {
+	case "SubscriptionConfirmation":
+		if err := checkSNSURL(m.SubscribeURL); err != nil {
+			return nil, err
+		}
+		resp, err := snsClient.Get(m.SubscribeURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not confirm SNS subscription: %w", err)
+		}
+		resp.Body.Close()
+		return nil, nil
+	case "Notification":
+	default:
+		return nil, nil
+	}
+
+	var n sesNotification
+	if err := json.Unmarshal([]byte(m.Message), &n); err != nil {
+		return nil, fmt.Errorf("invalid SES notification: %w", err)
+	}
+	eventType := n.EventType
+	if eventType == "" {
+		eventType = n.NotificationType
+	}
+	from := n.Mail.Source
+	if len(n.Mail.CommonHeaders.From) > 0 {
+		from = n.Mail.CommonHeaders.From[0]
+	}
+	newEvent := func(kind EventKind, recipient string, at time.Time) *DeliveryEvent {
+		event := newDeliveryEvent(ProviderSES, kind, m.MessageID, at, json.RawMessage(m.Message))
+		event.MessageRef = MessageRef{
+			Token:     n.Mail.MessageID,
+			MessageID: strings.Trim(n.Mail.CommonHeaders.MessageID, "<>"),
+			Subject:   n.Mail.CommonHeaders.Subject,
+		}
+		event.Sender = from
+		event.Recipients = []string{recipient}
+		return event
+	}
+
+	var events []*DeliveryEvent
+	switch eventType {
+	case "Delivery":
+		for _, recipient := range n.Delivery.Recipients {
+			event := withResponse(newEvent(KindDelivered, recipient, n.Delivery.Timestamp), n.Delivery.SMTPResponse, n.Delivery.SMTPResponse)
+			event.Timings.DeliveryTime = n.Delivery.ProcessingTimeMillis / 1000
+			events = append(events, event)
+		}
+	case "Bounce":
+		for _, recipient := range n.Bounce.BouncedRecipients {
+			status := recipient.Status
+			if status == "" && n.Bounce.BounceType == "Permanent" {
+				status = "5.0.0"
+			} else if status == "" {
+				status = "4.0.0"
+			}
+			events = append(events, withBounce(newEvent(KindBounced, recipient.EmailAddress, n.Bounce.Timestamp),
+				"Amazon SES", n.Bounce.BounceType+" "+n.Bounce.BounceSubType, mailparse.DeliveryStatus{
+					FinalRecipient: recipient.EmailAddress,
+					Action:         recipient.Action,
+					Status:         status,
+					DiagnosticCode: recipient.DiagnosticCode,
+				}))
+		}
+	case "DeliveryDelay":
+		for _, recipient := range n.DeliveryDelay.DelayedRecipients {
+			events = append(events, withResponse(newEvent(KindDelayed, recipient.EmailAddress, n.DeliveryDelay.Timestamp),
+				n.DeliveryDelay.DelayType, recipient.DiagnosticCode))
+		}
+	case "Reject", "Rendering Failure":
+		for _, recipient := range n.Mail.Destination {
+			events = append(events, withResponse(newEvent(KindFailed, recipient, timeNow()),
+				strings.TrimSpace(eventType+": "+n.Reject.Reason), ""))
+		}
+	case "Open":
+		for _, recipient := range n.Mail.Destination {
+			events = append(events, withClient(newEvent(KindOpened, recipient, n.Open.Timestamp), n.Open.IPAddress, n.Open.UserAgent, ""))
+		}
+	case "Click":
+		for _, recipient := range n.Mail.Destination {
+			events = append(events, withClient(newEvent(KindClicked, recipient, n.Click.Timestamp), n.Click.IPAddress, n.Click.UserAgent, n.Click.Link))
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+	"github.com/gin-gonic/gin"
+)
+
+// Supported mail providers besides Postal
+const (
+	ProviderMailgun  = "mailgun"
+	ProviderSendGrid = "sendgrid"
+	ProviderPostmark = "postmark"
+	ProviderSES      = "ses"
+)
+
+// ProviderConfig enables webhooks of another mail provider, which are received
+// at <webhook URL>/providers/<provider>
+type ProviderConfig struct {
+	Provider string `yaml:"provider"`
+	// Profile the events are associated with, defaults to the provider name
+	Profile string `yaml:"profile"`
+	// SigningKey is the Mailgun HTTP webhook signing key or the SendGrid verification key
+	SigningKey string `yaml:"signing_key"`
+	// Username and Password protect Postmark webhooks with basic authentication
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// TopicARNs are the SNS topics Amazon SES notifications are accepted from
+	TopicARNs []string `yaml:"topic_arns"`
+
+	publicKey crypto.PublicKey // parsed SigningKey of providers signing with public keys
+}
+
+func (pc *ProviderConfig) validate(v *configValidator, path string) {
+	adapter, ok := providerAdapters[pc.Provider]
+	if !ok {
+		v.fail(field(path, "provider"), "unknown provider '%s'", pc.Provider)
+		return
+	}
+	adapter.validate(v, path, pc)
+}
+
+func (pc *ProviderConfig) profile() string {
+	if pc.Profile != "" {
+		return pc.Profile
+	}
+	return pc.Provider
+}
+
+// validateProviders checks the provider configurations, each provider can be configured once
+func validateProviders(v *configValidator, providers []ProviderConfig) {
+	seen := map[string]bool{}
+	for i := range providers {
+		path := index("providers", i)
+		providers[i].validate(v, path)
+		if seen[providers[i].Provider] {
+			v.fail(field(path, "provider"), "provider %s is configured twice", providers[i].Provider)
+		}
+		seen[providers[i].Provider] = true
+	}
+}
+
+// provider returns the configuration of the provider or nil
+func (c *PluginConfig) provider(name string) *ProviderConfig {
+	for i := range c.Providers {
+		if c.Providers[i].Provider == name {
+			return &c.Providers[i]
+		}
+	}
+	return nil
+}
+
+// signatureMaxAge is how far the signed timestamp of provider webhooks may be
+// off. Verified webhooks are remembered as long to reject replays.
+const signatureMaxAge = 10 * time.Minute
+
+// checkSignatureAge rejects webhooks signed outside of signatureMaxAge
+func checkSignatureAge(provider string, signed time.Time) error {
+	if age := timeNow().Sub(signed); age > signatureMaxAge || age < -signatureMaxAge {
+		return fmt.Errorf("%s signature timestamp %s is not recent", provider, signed.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// providerAdapter maps the webhooks of a provider to delivery events
+type providerAdapter interface {
+	// validate checks the provider specific settings and parses the signing key
+	validate(v *configValidator, path string, config *ProviderConfig)
+	// verify authenticates the request with the provider's signature scheme
+	verify(r *http.Request, body []byte, config *ProviderConfig) error
+	// decode converts the body to events, skipping events without Postal equivalent
+	decode(body []byte, config *ProviderConfig) ([]*DeliveryEvent, error)
+}
+
+var providerAdapters = map[string]providerAdapter{
+	ProviderMailgun:  mailgunAdapter{tokens: newUsedLinks()},
+	ProviderSendGrid: sendGridAdapter{signatures: newUsedLinks()},
+	ProviderPostmark: postmarkAdapter{},
+	ProviderSES:      sesAdapter{messages: newUsedLinks()},
+}
+
+// providerHandler receives webhooks of other mail providers and handles them like Postal webhooks
+func (p *Plugin) providerHandler(c *gin.Context) {
+	name := c.Param("provider")
+	pluginConfig := p.config.Load()
+	config := pluginConfig.provider(name)
+	if config == nil {
+		c.String(http.StatusNotFound, "provider not configured")
+		return
+	}
+	adapter := providerAdapters[name]
+
+	body, err := readBody(c, maxWebhookBodySize)
+	if err != nil {
+		return
+	}
+	if pluginConfig.VerboseOutput {
+		printBody("Incoming "+name+" webhook", body)
+	}
+	if err := adapter.verify(c.Request, body, config); err != nil {
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+	events, err := adapter.decode(body, config)
+	if err != nil {
+		p.send(pluginConfig, &GotifyMessage{
+			Title:   fmt.Sprintf("Error handling %s webhook", name),
+			Message: err.Error(),
+		})
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	profileName := config.profile()
+	if notice := p.heartbeat.seen(pluginConfig.profileNames(), profileName); notice != nil {
+		p.send(pluginConfig, notice)
+	}
+	for _, event := range events {
+		event.Profile = profileName
+		notification := p.processWebhookMessage(event, nil)
+		p.dispatchEvent(pluginConfig, nil, event.Payload, event, notification)
+	}
+	c.Status(http.StatusOK)
+}
+
+// statusNames are the Postal message statuses of status events
+var statusNames = map[EventKind]string{
+	KindDelivered: "Sent",
+	KindDelayed:   "SoftFail",
+	KindFailed:    "HardFail",
+}
+
+// withResponse sets the response of a delivered, delayed or failed event
+func withResponse(event *DeliveryEvent, details, output string) *DeliveryEvent {
+	event.Response = ProviderResponse{Status: statusNames[event.Kind], Details: details, Output: output}
+	return event
+}
+
+// withBounce sets the delivery status of a bounce, the reporting provider is shown as sender of the bounce
+func withBounce(event *DeliveryEvent, provider, reason string, status mailparse.DeliveryStatus) *DeliveryEvent {
+	event.Response = ProviderResponse{Details: reason, ReportedBy: provider}
+	event.setDiagnosis(&bounceDiagnosis{Statuses: []mailparse.DeliveryStatus{status}})
+	return event
+}
+
+// withClient sets the client that opened the message or clicked the link
+func withClient(event *DeliveryEvent, ipAddress, userAgent, url string) *DeliveryEvent {
+	event.Client = &ClientInfo{IPAddress: ipAddress, UserAgent: userAgent, URL: url}
+	return event
+}
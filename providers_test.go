@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotify/plugin-api"
+)
+
+const providersPath = "/plugin/1/custom/abc/postal/providers/"
+
+func serveProvider(engine *gin.Engine, provider, body string, prepare func(*http.Request)) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, providersPath+provider, strings.NewReader(body))
+	if prepare != nil {
+		prepare(req)
+	}
+	engine.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestProviderNotConfigured(t *testing.T) {
+	_, engine, _ := newTestPlugin(t, nil)
+	if rec := serveProvider(engine, ProviderMailgun, "{}", nil); rec.Code != http.StatusNotFound {
+		t.Fatal("Expected 404 for unconfigured provider, got: ", rec.Code)
+	}
+}
+
+func TestProviderValidation(t *testing.T) {
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	for _, providers := range [][]ProviderConfig{
+		{{Provider: "sparkpost"}},
+		{{Provider: ProviderMailgun}},
+		{{Provider: ProviderSendGrid, SigningKey: "not a key"}},
+		{{Provider: ProviderPostmark, Username: "gotify"}},
+		{{Provider: ProviderSES}},
+		{{Provider: ProviderSES, TopicARNs: []string{"arn:aws:sns:eu-west-1:1:a"}}, {Provider: ProviderSES, TopicARNs: []string{"arn:aws:sns:eu-west-1:1:a"}}},
+	} {
+		config := p.DefaultConfig().(*PluginConfig)
+		config.Providers = providers
+		if err := p.ValidateAndSetConfig(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", providers)
+		}
+	}
+}
+
+func mailgunBody(key, timestamp, token, event string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	return `{"signature":{"timestamp":"` + timestamp + `","token":"` + token + `","signature":"` + hex.EncodeToString(mac.Sum(nil)) + `"},` +
+		`"event-data":` + event + `}`
+}
+
+func TestMailgunBounce(t *testing.T) {
+	p, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Providers = []ProviderConfig{{Provider: ProviderMailgun, SigningKey: "key-secret"}}
+	})
+	event := `{"event":"failed","id":"ev1","timestamp":1700000000.5,"recipient":"bob@example.com","severity":"permanent","reason":"bounce",` +
+		`"message":{"headers":{"from":"app@example.org","subject":"Welcome","message-id":"abc@example.org"}},` +
+		`"delivery-status":{"code":550,"enhanced-code":"5.1.1","message":"No such user"}}`
+
+	timestamp := strconv.FormatInt(timeNow().Unix(), 10)
+	// the adapter remembers tokens across tests
+	token := strconv.FormatInt(timeNow().UnixNano(), 36)
+	if rec := serveProvider(engine, ProviderMailgun, mailgunBody("wrong-key", timestamp, token, event), nil); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected forged signature to be rejected, got: ", rec.Code)
+	}
+	body := mailgunBody("key-secret", timestamp, token, event)
+	if rec := serveProvider(engine, ProviderMailgun, body, nil); rec.Code != http.StatusOK {
+		t.Fatal("Expected 200, got: ", rec.Code, rec.Body.String())
+	}
+	if rec := serveProvider(engine, ProviderMailgun, body, nil); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected replayed webhook to be rejected, got: ", rec.Code)
+	}
+	stale := strconv.FormatInt(timeNow().Add(-time.Hour).Unix(), 10)
+	if rec := serveProvider(engine, ProviderMailgun, mailgunBody("key-secret", stale, token+"-stale", event), nil); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected stale webhook to be rejected, got: ", rec.Code)
+	}
+	if len(handler.messages) != 1 || !strings.Contains(handler.messages[0].Title, "Hard bounce received") {
+		t.Fatalf("Expected a hard bounce notification, got: %+v", handler.messages)
+	}
+	if _, ok := p.suppressions.get("bob@example.com"); !ok {
+		t.Error("Expected bounced recipient to be suppressed")
+	}
+}
+
+func TestSendGridEvents(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Providers = []ProviderConfig{{Provider: ProviderSendGrid, SigningKey: base64.StdEncoding.EncodeToString(der), Profile: "marketing"}}
+	})
+	// the adapter remembers webhooks across tests
+	eventID := strconv.FormatInt(timeNow().UnixNano(), 36)
+	body := `[{"event":"delivered","email":"bob@example.com","timestamp":1700000000,"sg_event_id":"` + eventID + `","sg_message_id":"m1","response":"250 OK","tls":1},` +
+		`{"event":"processed","email":"bob@example.com","timestamp":1700000000,"sg_event_id":"e2"},` +
+		`{"event":"dropped","email":"eve@example.com","timestamp":1700000001,"sg_event_id":"e3","reason":"Bounced Address"}]`
+	signAt := func(at time.Time) func(*http.Request) {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		return func(req *http.Request) {
+			digest := sha256.Sum256([]byte(timestamp + body))
+			signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(sendGridTimestampHeader, timestamp)
+			req.Header.Set(sendGridSignatureHeader, base64.StdEncoding.EncodeToString(signature))
+		}
+	}
+	now := timeNow()
+	if rec := serveProvider(engine, ProviderSendGrid, body, nil); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected unsigned request to be rejected, got: ", rec.Code)
+	}
+	if rec := serveProvider(engine, ProviderSendGrid, body, signAt(now.Add(-time.Hour))); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected stale webhook to be rejected, got: ", rec.Code)
+	}
+	if rec := serveProvider(engine, ProviderSendGrid, body, signAt(now)); rec.Code != http.StatusOK {
+		t.Fatal("Expected 200, got: ", rec.Code, rec.Body.String())
+	}
+	if rec := serveProvider(engine, ProviderSendGrid, body, signAt(now)); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected replayed webhook to be rejected, got: ", rec.Code)
+	}
+	if len(handler.messages) != 2 {
+		t.Fatal("Expected two notifications, got: ", len(handler.messages))
+	}
+	if !strings.Contains(handler.messages[1].Message, "Bounced Address") {
+		t.Error("Expected drop reason in notification: ", handler.messages[1].Message)
+	}
+}
+
+func TestPostmarkBasicAuth(t *testing.T) {
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Providers = []ProviderConfig{{Provider: ProviderPostmark, Username: "gotify", Password: "secret"}}
+	})
+	body := `{"RecordType":"Bounce","ID":42,"Type":"SoftBounce","MessageID":"m1","Email":"bob@example.com","From":"app@example.org",` +
+		`"Subject":"Welcome","Description":"Mailbox full","Details":"452 4.2.2 Over quota","BouncedAt":"2023-11-14T22:13:20Z"}`
+
+	if rec := serveProvider(engine, ProviderPostmark, body, func(req *http.Request) { req.SetBasicAuth("gotify", "wrong") }); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected wrong password to be rejected, got: ", rec.Code)
+	}
+	if rec := serveProvider(engine, ProviderPostmark, body, func(req *http.Request) { req.SetBasicAuth("gotify", "secret") }); rec.Code != http.StatusOK {
+		t.Fatal("Expected 200, got: ", rec.Code, rec.Body.String())
+	}
+	if len(handler.messages) != 1 || !strings.Contains(handler.messages[0].Title, "Soft bounce received") {
+		t.Fatalf("Expected a soft bounce notification, got: %+v", handler.messages)
+	}
+}
+
+// signSNS returns a signed SNS notification and the certificate it is signed with
+func signSNS(t *testing.T, topic string, at time.Time, notification any) (string, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := json.Marshal(notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := snsMessage{
+		Type:             "Notification",
+		MessageID:        "sns-" + strconv.FormatInt(timeNow().UnixNano(), 36), // the adapter remembers messages across tests
+		TopicArn:         topic,
+		Message:          string(message),
+		Timestamp:        at.UTC().Format("2006-01-02T15:04:05.000Z"),
+		SignatureVersion: "2",
+		SigningCertURL:   "https://sns.eu-west-1.amazonaws.com/SimpleNotificationService-test.pem",
+	}
+	digest := sha256.Sum256([]byte(m.stringToSign()))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(signature)
+	body, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body), cert
+}
+
+func TestSESBounce(t *testing.T) {
+	topic := "arn:aws:sns:eu-west-1:123456789012:ses-events"
+	p, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Providers = []ProviderConfig{{Provider: ProviderSES, TopicARNs: []string{topic}}}
+	})
+	notification := map[string]any{
+		"eventType": "Bounce",
+		"mail": map[string]any{
+			"messageId":     "ses-1",
+			"source":        "app@example.org",
+			"destination":   []string{"bob@example.com"},
+			"commonHeaders": map[string]any{"from": []string{"App <app@example.org>"}, "subject": "Welcome"},
+		},
+		"bounce": map[string]any{
+			"bounceType":    "Permanent",
+			"bounceSubType": "General",
+			"timestamp":     "2023-11-14T22:13:20.000Z",
+			"bouncedRecipients": []map[string]string{
+				{"emailAddress": "bob@example.com", "action": "failed", "status": "5.1.1", "diagnosticCode": "smtp; 550 5.1.1 user unknown"},
+			},
+		},
+	}
+	body, cert := signSNS(t, topic, timeNow(), notification)
+	stale, staleCert := signSNS(t, topic, timeNow().Add(-time.Hour), notification)
+	original := fetchSNSCertificate
+	t.Cleanup(func() { fetchSNSCertificate = original })
+	fetchSNSCertificate = func(string) (*x509.Certificate, error) { return cert, nil }
+
+	if rec := serveProvider(engine, ProviderSES, strings.Replace(body, "Permanent", "Transient", 1), nil); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected tampered message to be rejected, got: ", rec.Code)
+	}
+	if rec := serveProvider(engine, ProviderSES, body, nil); rec.Code != http.StatusOK {
+		t.Fatal("Expected 200, got: ", rec.Code, rec.Body.String())
+	}
+	if rec := serveProvider(engine, ProviderSES, body, nil); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected replayed message to be rejected, got: ", rec.Code)
+	}
+	fetchSNSCertificate = func(string) (*x509.Certificate, error) { return staleCert, nil }
+	if rec := serveProvider(engine, ProviderSES, stale, nil); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected stale message to be rejected, got: ", rec.Code)
+	}
+	if len(handler.messages) != 1 || !strings.Contains(handler.messages[0].Title, "Hard bounce received") {
+		t.Fatalf("Expected a hard bounce notification, got: %+v", handler.messages)
+	}
+	if _, ok := p.suppressions.get("bob@example.com"); !ok {
+		t.Error("Expected bounced recipient to be suppressed")
+	}
+}
+
+func TestSNSURLs(t *testing.T) {
+	for url, trusted := range map[string]bool{
+		"https://sns.us-east-1.amazonaws.com/SimpleNotificationService-1.pem": true,
+		"https://sns.cn-north-1.amazonaws.com.cn/cert.pem":                    true,
+		"http://sns.us-east-1.amazonaws.com/cert.pem":                         false,
+		"https://sns.us-east-1.amazonaws.com.evil.com/cert.pem":               false,
+		"https://evil.com/sns.us-east-1.amazonaws.com/cert.pem":               false,
+	} {
+		if err := checkSNSURL(url); (err == nil) != trusted {
+			t.Errorf("Expected %s trusted=%v, got: %v", url, trusted, err)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const EmojiBellOff = "\xF0\x9F\x94\x95"
+
+// Policies that decide what happens with notifications inside a quiet window
+const (
+	QuietPolicyDeliver = "deliver"
+	QuietPolicyDrop    = "drop"
+	QuietPolicyDemote  = "demote" // deliver with priority 0
+	QuietPolicyHold    = "hold"   // send a summary once the window has ended
+)
+
+// pluginAlertEvent is the policy key for alerts generated by the plugin itself
+const pluginAlertEvent = "PluginAlert"
+
+// WindowPolicy decides what happens with notifications inside a window.
+// Policies maps event names (e.g. "MessageLoaded") to a policy and
+// overrides the default Policy.
+type WindowPolicy struct {
+	Policy   string            `yaml:"policy"`
+	Policies map[string]string `yaml:"policies"`
+}
+
+func (wp *WindowPolicy) policyFor(event string) string {
+	if event == "" {
+		event = pluginAlertEvent
+	}
+	if policy, ok := wp.Policies[event]; ok {
+		return policy
+	}
+	if wp.Policy == "" {
+		return QuietPolicyDeliver
+	}
+	return wp.Policy
+}
+
+func (wp *WindowPolicy) validate(v *configValidator, path string) {
+	check := func(path, policy string) {
+		switch policy {
+		case "", QuietPolicyDeliver, QuietPolicyDrop, QuietPolicyDemote, QuietPolicyHold:
+		default:
+			v.fail(path, "invalid quiet policy '%s'", policy)
+		}
+	}
+	check(field(path, "policy"), wp.Policy)
+	events := make([]string, 0, len(wp.Policies))
+	for event := range wp.Policies {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		check(field(field(path, "policies"), event), wp.Policies[event])
+	}
+}
+
+// QuietHours is a recurring window, e.g. every night
+type QuietHours struct {
+	TimeWindow   `yaml:",inline"`
+	WindowPolicy `yaml:",inline"`
+}
+
+// MaintenanceWindow is a one-off window given as RFC 3339 timestamps
+type MaintenanceWindow struct {
+	Start        string `yaml:"start"`
+	End          string `yaml:"end"`
+	WindowPolicy `yaml:",inline"`
+
+	start, end time.Time // parsed by validate
+}
+
+func (mw *MaintenanceWindow) bounds() (time.Time, time.Time, error) {
+	start, err := time.Parse(time.RFC3339, mw.Start)
+	if err != nil {
+		return start, start, fmt.Errorf("invalid maintenance start: %w", err)
+	}
+	end, err := time.Parse(time.RFC3339, mw.End)
+	if err != nil {
+		return start, end, fmt.Errorf("invalid maintenance end: %w", err)
+	}
+	if !end.After(start) {
+		return start, end, fmt.Errorf("maintenance window ends before it starts")
+	}
+	return start, end, nil
+}
+
+// QuietConfig configures quiet hours and maintenance windows
+type QuietConfig struct {
+	Hours       []QuietHours        `yaml:"hours"`
+	Maintenance []MaintenanceWindow `yaml:"maintenance"`
+}
+
+func (qc *QuietConfig) validate(v *configValidator, path string) {
+	for i := range qc.Hours {
+		hoursPath := index(field(path, "hours"), i)
+		qc.Hours[i].TimeWindow.validate(v, hoursPath)
+		qc.Hours[i].WindowPolicy.validate(v, hoursPath)
+	}
+	for i := range qc.Maintenance {
+		maintenancePath := index(field(path, "maintenance"), i)
+		var err error
+		qc.Maintenance[i].start, qc.Maintenance[i].end, err = qc.Maintenance[i].bounds()
+		v.check(maintenancePath, err)
+		if qc.Maintenance[i].Policy == "" && len(qc.Maintenance[i].Policies) == 0 {
+			v.fail(field(maintenancePath, "policy"), "policy or policies is required for maintenance windows")
+		}
+		qc.Maintenance[i].WindowPolicy.validate(v, maintenancePath)
+	}
+}
+
+// activeWindow returns a label and the policy of the window containing t.
+// Maintenance windows take precedence over quiet hours. It uses the windows
+// parsed by validate.
+func (qc *QuietConfig) activeWindow(t time.Time) (string, *WindowPolicy) {
+	for i := range qc.Maintenance {
+		mw := &qc.Maintenance[i]
+		if !t.Before(mw.start) && t.Before(mw.end) {
+			label := fmt.Sprintf("maintenance %s to %s", mw.start.Format("2006-01-02 15:04"), mw.end.Format("2006-01-02 15:04"))
+			return label, &mw.WindowPolicy
+		}
+	}
+	for i := range qc.Hours {
+		if qc.Hours[i].Contains(t) {
+			label := fmt.Sprintf("quiet hours %s to %s", qc.Hours[i].Start, qc.Hours[i].End)
+			return label, &qc.Hours[i].WindowPolicy
+		}
+	}
+	return "", nil
+}
+
+// maxHeldNotifications limits the notifications held per window. Further
+// notifications are only counted.
+const maxHeldNotifications = 500
+
+// heldNotification is the part of a held notification needed for the summary
+type heldNotification struct {
+	Title    string `json:"title"`
+	Priority int    `json:"priority"`
+}
+
+// heldWindow collects the notifications held during one window
+type heldWindow struct {
+	Notifications []heldNotification `json:"notifications"`
+	Overflow      int                `json:"overflow,omitempty"` // held beyond maxHeldNotifications
+}
+
+// quietFilter applies the quiet window policies and keeps held notifications
+type quietFilter struct {
+	mu   sync.Mutex
+	held map[string]*heldWindow // keyed by window label
+}
+
+func newQuietFilter() *quietFilter {
+	return &quietFilter{
+		held: map[string]*heldWindow{},
+	}
+}
+
+// apply returns the notification to send now, or nil if it was dropped or held
+func (qf *quietFilter) apply(config *QuietConfig, notification *GotifyMessage) *GotifyMessage {
+	qf.mu.Lock()
+	defer qf.mu.Unlock()
+
+	label, policy := config.activeWindow(timeNow())
+	if policy == nil {
+		return notification
+	}
+	switch policy.policyFor(notification.event) {
+	case QuietPolicyDrop:
+		return nil
+	case QuietPolicyDemote:
+		notification.Priority = 0
+		return notification
+	case QuietPolicyHold:
+		window := qf.held[label]
+		if window == nil {
+			window = &heldWindow{}
+			qf.held[label] = window
+		}
+		if len(window.Notifications) < maxHeldNotifications {
+			window.Notifications = append(window.Notifications, heldNotification{Title: notification.Title, Priority: notification.Priority})
+		} else {
+			window.Overflow++
+		}
+		return nil
+	default:
+		return notification
+	}
+}
+
+// flush returns one summary for each window that has ended and holds notifications
+func (qf *quietFilter) flush(config *QuietConfig) []*GotifyMessage {
+	qf.mu.Lock()
+	defer qf.mu.Unlock()
+
+	active, _ := config.activeWindow(timeNow())
+	labels := make([]string, 0, len(qf.held))
+	for label := range qf.held {
+		if label != active {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	var summaries []*GotifyMessage
+	for _, label := range labels {
+		summaries = append(summaries, summarizeHeld(label, qf.held[label]))
+		delete(qf.held, label)
+	}
+	return summaries
+}
+
+// snapshot returns a copy of the held notifications for the plugin storage
+func (qf *quietFilter) snapshot() map[string]heldWindow {
+	qf.mu.Lock()
+	defer qf.mu.Unlock()
+	held := make(map[string]heldWindow, len(qf.held))
+	for label, window := range qf.held {
+		held[label] = heldWindow{
+			Notifications: append([]heldNotification(nil), window.Notifications...),
+			Overflow:      window.Overflow,
+		}
+	}
+	return held
+}
+
+// restore adds the held notifications loaded from the plugin storage
+func (qf *quietFilter) restore(held map[string]heldWindow) {
+	qf.mu.Lock()
+	defer qf.mu.Unlock()
+	for label, window := range held {
+		if len(window.Notifications) > maxHeldNotifications {
+			window.Overflow += len(window.Notifications) - maxHeldNotifications
+			window.Notifications = window.Notifications[:maxHeldNotifications]
+		}
+		qf.held[label] = &window
+	}
+}
+
+// summarizeHeld combines held notifications into one message
+func summarizeHeld(label string, window *heldWindow) *GotifyMessage {
+	total := len(window.Notifications) + window.Overflow
+	summary := &GotifyMessage{
+		Title: fmt.Sprintf("%s %d notifications held during %s", EmojiBellOff, total, label),
+	}
+	titles := map[string]int{}
+	for _, notification := range window.Notifications {
+		titles[notification.Title]++
+		if notification.Priority > summary.Priority {
+			summary.Priority = notification.Priority
+		}
+	}
+	for _, title := range sortedByCount(titles) {
+		summary.Message += fmt.Sprintf("- %dx %s\n", titles[title], title)
+	}
+	if window.Overflow > 0 {
+		summary.Message += fmt.Sprintf("- %d more not listed\n", window.Overflow)
+	}
+	return summary
+}
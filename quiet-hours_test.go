@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+func TestQuietHoursPolicies(t *testing.T) {
+	fixed := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	config := QuietConfig{
+		Hours: []QuietHours{{
+			TimeWindow: TimeWindow{Start: "22:00", End: "07:00", Timezone: "UTC"},
+			WindowPolicy: WindowPolicy{
+				Policy: QuietPolicyDemote,
+				Policies: map[string]string{
+					string(postal.EventMessageLoaded):      QuietPolicyDrop,
+					string(postal.EventMessageLinkClicked): QuietPolicyHold,
+				},
+			},
+		}},
+	}
+	if err := validateSetting(config.validate, "quiet"); err != nil {
+		t.Fatal(err)
+	}
+	qf := newQuietFilter()
+
+	if qf.apply(&config, &GotifyMessage{Title: "opened", event: string(postal.EventMessageLoaded)}) != nil {
+		t.Fatal("Open notification was not dropped")
+	}
+	if qf.apply(&config, &GotifyMessage{Title: "clicked", event: string(postal.EventMessageLinkClicked)}) != nil {
+		t.Fatal("Click notification was not held")
+	}
+	demoted := qf.apply(&config, &GotifyMessage{Title: "failed", Priority: 5, event: string(postal.EventMessageDeliveryFailed)})
+	if demoted == nil || demoted.Priority != 0 {
+		t.Fatal("Failure notification was not demoted")
+	}
+
+	if summaries := qf.flush(&config); len(summaries) != 0 {
+		t.Fatal("Held notifications flushed within the window")
+	}
+	fixed = fixed.Add(5 * time.Hour)
+	summaries := qf.flush(&config)
+	if len(summaries) != 1 || !strings.Contains(summaries[0].Message, "1x clicked") {
+		t.Fatal("Expected one summary of held notifications")
+	}
+}
+
+func TestMaintenanceWindowTakesPrecedence(t *testing.T) {
+	fixed := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	config := QuietConfig{
+		Hours: []QuietHours{{
+			TimeWindow:   TimeWindow{Start: "22:00", End: "07:00", Timezone: "UTC"},
+			WindowPolicy: WindowPolicy{Policy: QuietPolicyDemote},
+		}},
+		Maintenance: []MaintenanceWindow{{
+			Start:        "2024-01-01T22:30:00Z",
+			End:          "2024-01-02T01:00:00Z",
+			WindowPolicy: WindowPolicy{Policy: QuietPolicyDrop},
+		}},
+	}
+	if err := validateSetting(config.validate, "quiet"); err != nil {
+		t.Fatal(err)
+	}
+	qf := newQuietFilter()
+
+	if qf.apply(&config, &GotifyMessage{Title: "heartbeat alert"}) != nil {
+		t.Fatal("Notification was not dropped during maintenance")
+	}
+}
+
+func TestQuietConfigValidation(t *testing.T) {
+	config := QuietConfig{
+		Hours: []QuietHours{{
+			TimeWindow:   TimeWindow{Start: "22:00", End: "07:00"},
+			WindowPolicy: WindowPolicy{Policy: "mute"},
+		}},
+	}
+	if err := validateSetting(config.validate, "quiet"); err == nil {
+		t.Fatal("Invalid policy was accepted")
+	}
+
+	config = QuietConfig{
+		Maintenance: []MaintenanceWindow{{Start: "2024-01-01T22:30:00Z", End: "2024-01-02T01:00:00Z"}},
+	}
+	if err := validateSetting(config.validate, "quiet"); err == nil || !strings.Contains(err.Error(), "quiet.maintenance[0].policy") {
+		t.Fatal("Maintenance window without policy was accepted: ", err)
+	}
+}
+
+func TestHeldNotificationsSurviveRestart(t *testing.T) {
+	fixed := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	config := QuietConfig{
+		Maintenance: []MaintenanceWindow{{
+			Start:        "2024-01-01T22:30:00Z",
+			End:          "2024-01-02T01:00:00Z",
+			WindowPolicy: WindowPolicy{Policy: QuietPolicyHold},
+		}},
+	}
+	configure := func(c *PluginConfig) { c.Quiet = config }
+	storage := &memoryStorage{}
+	p, _, _ := newTestPlugin(t, configure)
+	p.SetStorageHandler(storage)
+	for i := 0; i < maxHeldNotifications+2; i++ {
+		p.send(p.config.Load(), &GotifyMessage{Title: "failed", Priority: 5})
+	}
+	if err := p.flushState(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, _, _ := newTestPlugin(t, configure)
+	restarted.SetStorageHandler(storage)
+	if err := restarted.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if held := restarted.quiet.snapshot()["maintenance 2024-01-01 22:30 to 2024-01-02 01:00"]; len(held.Notifications) != maxHeldNotifications || held.Overflow != 2 {
+		t.Fatal("Held notifications were not capped and restored, got: ", len(held.Notifications), held.Overflow)
+	}
+
+	fixed = fixed.Add(3 * time.Hour)
+	summaries := restarted.quiet.flush(&restarted.config.Load().Quiet)
+	if len(summaries) != 1 || !strings.Contains(summaries[0].Title, fmt.Sprint(maxHeldNotifications+2)) || summaries[0].Priority != 5 {
+		t.Fatal("Unexpected summary of held notifications: ", summaries)
+	}
+}
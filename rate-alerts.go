@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultProfileName = "default"
+
+// Priorities used for alerts generated by the plugin itself
+const (
+	PriorityRecovered = 2
+	PriorityWarning   = 5
+	PriorityCritical  = 8
+)
+
+// RateAlertConfig configures alerts on rolling bounce and failure rates,
+// both per sender domain and per server profile. Thresholds are percentages.
+type RateAlertConfig struct {
+	Enabled                bool    `yaml:"enabled"`
+	Window                 string  `yaml:"window"`
+	MinMessages            int     `yaml:"min_messages"`
+	BounceWarningPercent   float64 `yaml:"bounce_warning_percent"`
+	BounceCriticalPercent  float64 `yaml:"bounce_critical_percent"`
+	FailureWarningPercent  float64 `yaml:"failure_warning_percent"`
+	FailureCriticalPercent float64 `yaml:"failure_critical_percent"`
+	HysteresisPercent      float64 `yaml:"hysteresis_percent"`
+
+	window time.Duration // parsed Window
+}
+
+func defaultRateAlertConfig() RateAlertConfig {
+	return RateAlertConfig{
+		Enabled:                false,
+		Window:                 "1h",
+		MinMessages:            20,
+		BounceWarningPercent:   2,
+		BounceCriticalPercent:  5,
+		FailureWarningPercent:  5,
+		FailureCriticalPercent: 10,
+		HysteresisPercent:      1,
+	}
+}
+
+func (rc *RateAlertConfig) validate(v *configValidator, path string) {
+	rc.window = v.duration(field(path, "window"), rc.Window)
+	if rc.MinMessages < 0 {
+		v.fail(field(path, "min_messages"), "must not be negative")
+	}
+	for _, threshold := range []struct {
+		name    string
+		percent float64
+	}{
+		{"bounce_warning_percent", rc.BounceWarningPercent},
+		{"bounce_critical_percent", rc.BounceCriticalPercent},
+		{"failure_warning_percent", rc.FailureWarningPercent},
+		{"failure_critical_percent", rc.FailureCriticalPercent},
+		{"hysteresis_percent", rc.HysteresisPercent},
+	} {
+		if threshold.percent < 0 || threshold.percent > 100 {
+			v.fail(field(path, threshold.name), "percentage must be between 0 and 100")
+		}
+	}
+	if rc.BounceCriticalPercent > 0 && rc.BounceWarningPercent > rc.BounceCriticalPercent {
+		v.fail(field(path, "bounce_warning_percent"), "warning threshold above critical threshold")
+	}
+	if rc.FailureCriticalPercent > 0 && rc.FailureWarningPercent > rc.FailureCriticalPercent {
+		v.fail(field(path, "failure_warning_percent"), "warning threshold above critical threshold")
+	}
+}
+
+type alertLevel int
+
+const (
+	alertLevelOK alertLevel = iota
+	alertLevelWarning
+	alertLevelCritical
+)
+
+func (l alertLevel) String() string {
+	switch l {
+	case alertLevelWarning:
+		return "warning"
+	case alertLevelCritical:
+		return "critical"
+	default:
+		return "back to normal"
+	}
+}
+
+// nextLevel determines the alert level for the given rate. Once a threshold
+// was crossed, the rate has to fall below threshold minus hysteresis before
+// the level is lowered again, so that alerts don't flap.
+func nextLevel(current alertLevel, rate, warning, critical, hysteresis float64) alertLevel {
+	switch {
+	case critical > 0 && rate >= critical:
+		return alertLevelCritical
+	case current == alertLevelCritical && critical > 0 && rate > critical-hysteresis:
+		return alertLevelCritical
+	case warning > 0 && rate >= warning:
+		return alertLevelWarning
+	case current >= alertLevelWarning && warning > 0 && rate > warning-hysteresis:
+		return alertLevelWarning
+	}
+	return alertLevelOK
+}
+
+// rateBucket holds the delivery outcomes of one minute
+type rateBucket struct {
+	start   time.Time
+	sent    int
+	failed  int
+	bounced int
+}
+
+// rateCounter holds the rolling window and alert state of one sender domain or profile
+type rateCounter struct {
+	buckets     []rateBucket
+	bounceLevel alertLevel
+	failLevel   alertLevel
+}
+
+func (rc *rateCounter) add(now time.Time, kind EventKind) {
+	start := now.Truncate(time.Minute)
+	if n := len(rc.buckets); n == 0 || !rc.buckets[n-1].start.Equal(start) {
+		rc.buckets = append(rc.buckets, rateBucket{start: start})
+	}
+	bucket := &rc.buckets[len(rc.buckets)-1]
+	switch kind {
+	case KindDelivered:
+		bucket.sent++
+	case KindFailed:
+		bucket.failed++
+	case KindBounced:
+		bucket.bounced++
+	}
+}
+
+func (rc *rateCounter) prune(cutoff time.Time) {
+	i := 0
+	for i < len(rc.buckets) && rc.buckets[i].start.Before(cutoff) {
+		i++
+	}
+	rc.buckets = rc.buckets[i:]
+}
+
+func (rc *rateCounter) totals() (sent, failed, bounced int) {
+	for _, b := range rc.buckets {
+		sent += b.sent
+		failed += b.failed
+		bounced += b.bounced
+	}
+	return
+}
+
+// rateMonitor keeps rolling bounce and failure rates and alerts when
+// the configured thresholds are crossed
+type rateMonitor struct {
+	mu       sync.Mutex
+	counters map[string]*rateCounter // keyed by scope ("domain"/"profile") and name
+}
+
+func newRateMonitor() *rateMonitor {
+	return &rateMonitor{
+		counters: map[string]*rateCounter{},
+	}
+}
+
+// observe records the delivery outcome of the webhook and returns the alerts
+// that have to be sent due to changed alert levels
+func (rm *rateMonitor) observe(config *RateAlertConfig, event *DeliveryEvent) []*GotifyMessage {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if !config.Enabled {
+		return nil
+	}
+	switch event.Kind {
+	case KindDelivered, KindFailed, KindBounced:
+	default:
+		return nil
+	}
+
+	alerts := rm.observeScope(config, "profile", event.Profile, event.Kind)
+	if domain := addressDomain(event.Sender); domain != "" {
+		alerts = append(alerts, rm.observeScope(config, "domain", domain, event.Kind)...)
+	}
+	return alerts
+}
+
+func (rm *rateMonitor) observeScope(c *RateAlertConfig, scope, name string, kind EventKind) []*GotifyMessage {
+	key := scope + ":" + name
+	rc, ok := rm.counters[key]
+	if !ok {
+		rc = &rateCounter{}
+		rm.counters[key] = rc
+	}
+
+	now := timeNow()
+	rc.add(now, kind)
+	return rc.evaluate(c, scope, name, now)
+}
+
+// prune evaluates all counters without a new outcome, so that a domain or
+// profile that stopped sending recovers once its window is empty, and removes
+// the counters of idle ones
+func (rm *rateMonitor) prune(config *RateAlertConfig) []*GotifyMessage {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if !config.Enabled {
+		clear(rm.counters)
+		return nil
+	}
+	keys := make([]string, 0, len(rm.counters))
+	for key := range rm.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := timeNow()
+	var alerts []*GotifyMessage
+	for _, key := range keys {
+		rc := rm.counters[key]
+		scope, name, _ := strings.Cut(key, ":")
+		alerts = append(alerts, rc.evaluate(config, scope, name, now)...)
+		if len(rc.buckets) == 0 {
+			delete(rm.counters, key)
+		}
+	}
+	return alerts
+}
+
+// evaluate updates the alert levels from the outcomes within the window and
+// returns alerts for changed levels. Without any outcome left in the window
+// both levels go back to normal.
+func (rc *rateCounter) evaluate(c *RateAlertConfig, scope, name string, now time.Time) []*GotifyMessage {
+	rc.prune(now.Add(-c.window))
+
+	sent, failed, bounced := rc.totals()
+	attempts := sent + failed
+	idle := len(rc.buckets) == 0
+	if !idle && (attempts < c.MinMessages || attempts == 0) {
+		return nil
+	}
+
+	var alerts []*GotifyMessage
+
+	bounceRate := 0.0
+	if sent > 0 {
+		bounceRate = float64(bounced) / float64(sent) * 100
+	}
+	level := alertLevelOK
+	if !idle {
+		level = nextLevel(rc.bounceLevel, bounceRate, c.BounceWarningPercent, c.BounceCriticalPercent, c.HysteresisPercent)
+	}
+	if alert := levelChange(rc.bounceLevel, level, "Bounce", scope, name, bounceRate, bounced, sent, c.window, c.BounceWarningPercent, c.BounceCriticalPercent); alert != nil {
+		alerts = append(alerts, alert)
+	}
+	rc.bounceLevel = level
+
+	failRate := 0.0
+	if attempts > 0 {
+		failRate = float64(failed) / float64(attempts) * 100
+	}
+	level = alertLevelOK
+	if !idle {
+		level = nextLevel(rc.failLevel, failRate, c.FailureWarningPercent, c.FailureCriticalPercent, c.HysteresisPercent)
+	}
+	if alert := levelChange(rc.failLevel, level, "Failure", scope, name, failRate, failed, attempts, c.window, c.FailureWarningPercent, c.FailureCriticalPercent); alert != nil {
+		alerts = append(alerts, alert)
+	}
+	rc.failLevel = level
+
+	return alerts
+}
+
+// levelChange returns an alert if the level was raised or went back to normal
+func levelChange(old, new alertLevel, metric, scope, name string, rate float64, count, total int, window time.Duration, warning, critical float64) *GotifyMessage {
+	if new == old || (new != alertLevelOK && new < old) {
+		return nil
+	}
+
+	message := &GotifyMessage{muteKeys: []string{scope + ":" + name}}
+	switch new {
+	case alertLevelCritical:
+		message.Title = EmojiExclamMark + " "
+		message.Priority = PriorityCritical
+	case alertLevelWarning:
+		message.Title = EmojiWarningSign + " "
+		message.Priority = PriorityWarning
+	default:
+		message.Title = EmojiCheckMark + " "
+		message.Priority = PriorityRecovered
+	}
+	message.Title += fmt.Sprintf("%s rate %s for %s %s", metric, new, scope, name)
+
+	message.Message += fmt.Sprintf("**%s rate:** %.1f%% (%d of %d messages in the last %s)\n\n", metric, rate, count, total, window)
+	message.Message += "---\n\n"
+	message.Message += fmt.Sprintf("Warning threshold: %.1f%%, critical threshold: %.1f%%", warning, critical)
+
+	return message
+}
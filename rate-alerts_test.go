@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+func makeStatusWebhook(event postal.EventType, from string) *DeliveryEvent {
+	webhook := newPostalDeliveryEvent(&postal.MessageStatusEvent{
+		Envelope: postal.Envelope{Event: event},
+		Status:   "x",
+		Message:  postal.Message{ID: 1, From: from, To: "test@example.com"},
+	})
+	webhook.Profile = "main"
+	return webhook
+}
+
+func TestRateMonitorHysteresis(t *testing.T) {
+	config := defaultRateAlertConfig()
+	config.Enabled = true
+	config.MinMessages = 10
+	config.FailureWarningPercent = 20
+	config.FailureCriticalPercent = 50
+	config.HysteresisPercent = 5
+	if err := validateSetting(config.validate, "rate_alerts"); err != nil {
+		t.Fatal(err)
+	}
+	rm := newRateMonitor()
+
+	fixed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	sent := makeStatusWebhook(postal.EventMessageSent, "App <sales@Example.com>")
+	failed := makeStatusWebhook(postal.EventMessageDeliveryFailed, "sales@example.com")
+
+	for i := 0; i < 8; i++ {
+		if alerts := rm.observe(&config, sent); len(alerts) != 0 {
+			t.Fatal("Unexpected alert below minimum volume: ", alerts[0].Title)
+		}
+	}
+	// 2 of 10 failed -> warning for both the profile and the domain
+	rm.observe(&config, failed)
+	alerts := rm.observe(&config, failed)
+	if len(alerts) != 2 {
+		t.Fatal("Expected 2 alerts, got: ", len(alerts))
+	}
+	if alerts[0].Title != EmojiWarningSign+" Failure rate warning for profile main" {
+		t.Fatal("Unexpected alert title: ", alerts[0].Title)
+	}
+	if !strings.Contains(alerts[1].Title, "domain example.com") || alerts[1].Priority != PriorityWarning {
+		t.Fatal("Unexpected domain alert: ", alerts[1].Title)
+	}
+
+	// 2 of 11 failed (18.2%) is within the hysteresis band, no recovery yet
+	if alerts := rm.observe(&config, sent); len(alerts) != 0 {
+		t.Fatal("Alert flapped: ", alerts[0].Title)
+	}
+
+	// 2 of 14 failed (14.3%) is below the band
+	rm.observe(&config, sent)
+	rm.observe(&config, sent)
+	alerts = rm.observe(&config, sent)
+	if len(alerts) != 2 || alerts[0].Priority != PriorityRecovered {
+		t.Fatal("Expected recovery notices, got: ", len(alerts))
+	}
+}
+
+func TestRateMonitorWindow(t *testing.T) {
+	config := defaultRateAlertConfig()
+	config.Enabled = true
+	config.MinMessages = 1
+	config.Window = "10m"
+	if err := validateSetting(config.validate, "rate_alerts"); err != nil {
+		t.Fatal(err)
+	}
+	rm := newRateMonitor()
+
+	fixed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	rm.observe(&config, makeStatusWebhook(postal.EventMessageDeliveryFailed, "a@example.com"))
+
+	fixed = fixed.Add(time.Hour)
+	rm.observe(&config, makeStatusWebhook(postal.EventMessageSent, "a@example.com"))
+	sent, failed, _ := rm.counters["profile:main"].totals()
+	if sent != 1 || failed != 0 {
+		t.Fatal("Old outcomes were not pruned, got sent/failed: ", sent, failed)
+	}
+}
+
+func TestRateMonitorIdleRecovery(t *testing.T) {
+	config := defaultRateAlertConfig()
+	config.Enabled = true
+	config.MinMessages = 1
+	config.Window = "10m"
+	if err := validateSetting(config.validate, "rate_alerts"); err != nil {
+		t.Fatal(err)
+	}
+	rm := newRateMonitor()
+
+	fixed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return fixed }
+	defer func() { timeNow = time.Now }()
+
+	if alerts := rm.observe(&config, makeStatusWebhook(postal.EventMessageDeliveryFailed, "a@example.com")); len(alerts) != 2 {
+		t.Fatal("Expected 2 alerts, got: ", len(alerts))
+	}
+	if alerts := rm.prune(&config); len(alerts) != 0 {
+		t.Fatal("Unexpected alert within the window: ", alerts[0].Title)
+	}
+
+	fixed = fixed.Add(11 * time.Minute)
+	alerts := rm.prune(&config)
+	if len(alerts) != 2 || alerts[0].Priority != PriorityRecovered || alerts[0].Title != EmojiCheckMark+" Failure rate back to normal for domain example.com" {
+		t.Fatal("Expected recovery notices for idle scopes, got: ", alerts)
+	}
+	if len(rm.counters) != 0 {
+		t.Fatal("Idle counters were not removed: ", len(rm.counters))
+	}
+	if alerts := rm.prune(&config); len(alerts) != 0 {
+		t.Fatal("Recovery was sent twice")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+const EmojiChart = "\xF0\x9F\x93\x8A"
+
+// ReportConfig configures the scheduled deliverability report
+type ReportConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Interval string `yaml:"interval"` // "daily" or "weekly"
+	Weekday  string `yaml:"weekday"`  // used for weekly reports, e.g. "mon"
+	Time     string `yaml:"time"`     // time of day, e.g. "08:00"
+	Timezone string `yaml:"timezone"` // IANA name, empty means local time
+	TopCount int    `yaml:"top_count"`
+
+	// parsed by validate
+	minutes  int // time of day in minutes since midnight
+	location *time.Location
+	weekday  time.Weekday
+}
+
+func defaultReportConfig() ReportConfig {
+	return ReportConfig{
+		Enabled:  false,
+		Interval: "daily",
+		Weekday:  "mon",
+		Time:     "08:00",
+		TopCount: 5,
+	}
+}
+
+func (rc *ReportConfig) validate(v *configValidator, path string) {
+	if rc.Interval != "daily" && rc.Interval != "weekly" {
+		v.fail(field(path, "interval"), "invalid report interval '%s', expected daily or weekly", rc.Interval)
+	}
+	weekday, ok := weekdayNames[strings.ToLower(rc.Weekday)]
+	if rc.Interval == "weekly" && !ok {
+		v.fail(field(path, "weekday"), "invalid report weekday '%s'", rc.Weekday)
+	}
+	rc.weekday = weekday
+	var err error
+	rc.minutes, err = parseClock(rc.Time)
+	v.check(field(path, "time"), err)
+	rc.location = validateTimezone(v, field(path, "timezone"), rc.Timezone)
+	if rc.TopCount < 0 {
+		v.fail(field(path, "top_count"), "must not be negative")
+	}
+}
+
+func (rc *ReportConfig) period() time.Duration {
+	if rc.Interval == "weekly" {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// lastSlot returns the most recent scheduled report time at or before now, using
+// the values parsed by validate
+func (rc *ReportConfig) lastSlot(now time.Time) time.Time {
+	loc := rc.location
+	if loc == nil {
+		loc = time.Local
+	}
+	now = now.In(loc)
+	slot := time.Date(now.Year(), now.Month(), now.Day(), rc.minutes/60, rc.minutes%60, 0, 0, loc)
+	if slot.After(now) {
+		slot = slot.AddDate(0, 0, -1)
+	}
+	if rc.Interval == "weekly" {
+		for slot.Weekday() != rc.weekday {
+			slot = slot.AddDate(0, 0, -1)
+		}
+	}
+	return slot
+}
+
+// reportScheduler decides when the next report is due
+type reportScheduler struct {
+	mu         sync.Mutex
+	lastReport time.Time
+}
+
+func newReportScheduler() *reportScheduler {
+	return &reportScheduler{}
+}
+
+func (rs *reportScheduler) setLastReport(t time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.lastReport = t
+}
+
+func (rs *reportScheduler) getLastReport() time.Time {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.lastReport
+}
+
+// due reports whether a report has to be sent now. Reports missed while Gotify
+// was down are sent once on the next check.
+func (rs *reportScheduler) due(config *ReportConfig, now time.Time) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if !config.Enabled {
+		return false
+	}
+	if rs.lastReport.IsZero() {
+		// first run, start counting from now
+		rs.lastReport = now
+		return false
+	}
+	if !rs.lastReport.Before(config.lastSlot(now)) {
+		return false
+	}
+	rs.lastReport = now
+	return true
+}
+
+// sendDueReport sends the report if it is due. The time of the last report is
+// saved whenever it changes, including the start of the first period, so that
+// a restart neither sends a report twice nor restarts the period.
+func (p *Plugin) sendDueReport(config *PluginConfig) {
+	now := timeNow()
+	lastReport := p.reports.getLastReport()
+	due := p.reports.due(&config.Report, now)
+	if !p.reports.getLastReport().Equal(lastReport) {
+		p.markDirty()
+	}
+	if !due {
+		return
+	}
+	summary := p.history.between(now.Add(-config.Report.period()), now)
+	p.send(config, buildReport(summary, config.Report))
+}
+
+// buildReport renders the deliverability report for the summed up history
+func buildReport(summary *historyBucket, config ReportConfig) *GotifyMessage {
+	message := &GotifyMessage{
+		Title: EmojiChart + " " + strings.ToUpper(config.Interval[:1]) + config.Interval[1:] + " deliverability report",
+	}
+
+	if summary.total() == 0 {
+		message.Message = "No webhooks were received in this period."
+		return message
+	}
+
+	totals := map[string]int{}
+	for event, count := range summary.Events {
+		totals[string(event)] = count
+	}
+	sent := summary.Events[postal.EventMessageSent]
+
+	message.Message += fmt.Sprintf("_%s to %s_\n\n", summary.First.Format("2006-01-02 15:04"), summary.Last.Format("2006-01-02 15:04"))
+	message.Message += "**Events:**\n\n"
+	for _, event := range sortedByCount(totals) {
+		message.Message += fmt.Sprintf("- %s: %d\n", event, totals[event])
+	}
+	message.Message += "\n---\n\n"
+
+	if sent > 0 {
+		message.Message += fmt.Sprintf("**Delivery time:** median %.2f s, p95 %.2f s\n\n", percentile(summary.DeliveryTimes, 50), percentile(summary.DeliveryTimes, 95))
+		message.Message += fmt.Sprintf("**Sent without TLS:** %.1f%% (%d of %d)\n\n", float64(summary.WithoutTLS)/float64(sent)*100, summary.WithoutTLS, sent)
+	}
+	message.Message += fmt.Sprintf("**Opens:** %d, **Clicks:** %d\n\n", totals[string(postal.EventMessageLoaded)], totals[string(postal.EventMessageLinkClicked)])
+
+	message.Message += topList("Top failing recipient domains", summary.FailingDomains, config.TopCount)
+	message.Message += topList("Top bounce reasons", summary.BounceReasons, config.TopCount)
+
+	message.Message = strings.TrimRight(message.Message, "\n")
+	return message
+}
+
+// topList renders the n most frequent keys as a markdown list
+func topList(title string, counts map[string]int, n int) string {
+	if len(counts) == 0 {
+		return ""
+	}
+	keys := sortedByCount(counts)
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	s := fmt.Sprintf("**%s:**\n\n", title)
+	for _, key := range keys {
+		s += fmt.Sprintf("- %s (%d)\n", key, counts[key])
+	}
+	return s + "\n"
+}
+
+// sortedByCount returns the keys ordered by descending count, then by name
+func sortedByCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// percentile returns the nearest-rank percentile in seconds of the delivery
+// times, counted per 10 ms
+func percentile(counts map[int]int, p float64) float64 {
+	centis := make([]int, 0, len(counts))
+	n := 0
+	for value, count := range counts {
+		centis = append(centis, value)
+		n += count
+	}
+	sort.Ints(centis)
+	rank := int(math.Ceil(p / 100 * float64(n)))
+	for _, value := range centis {
+		if rank -= counts[value]; rank <= 0 {
+			return float64(value) / 100
+		}
+	}
+	return 0
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/mailparse"
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+	"github.com/gotify/plugin-api"
+)
+
+type memoryStorage struct {
+	data  []byte
+	saves int
+}
+
+func (m *memoryStorage) Save(b []byte) error {
+	m.data = b
+	m.saves++
+	return nil
+}
+
+func (m *memoryStorage) Load() ([]byte, error) {
+	return m.data, nil
+}
+
+func TestBuildReport(t *testing.T) {
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	entries := []historyEntry{
+		{Time: at, Event: postal.EventMessageSent, DeliveryTime: 0.2, SentWithSSL: true},
+		{Time: at, Event: postal.EventMessageSent, DeliveryTime: 0.4, SentWithSSL: true},
+		{Time: at, Event: postal.EventMessageSent, DeliveryTime: 3.0, SentWithSSL: false},
+		{Time: at, Event: postal.EventMessageDeliveryFailed, RecipientDomain: "example.com"},
+		{Time: at, Event: postal.EventMessageBounced, RecipientDomain: "example.com", Reason: "Delivery Error"},
+		{Time: at, Event: postal.EventMessageLoaded},
+	}
+	summary := newHistoryBucket(at)
+	for _, entry := range entries {
+		summary.add(entry)
+	}
+	report := buildReport(summary, defaultReportConfig())
+
+	if report.Title != EmojiChart+" Daily deliverability report" {
+		t.Fatal("Unexpected report title: ", report.Title)
+	}
+	for _, expected := range []string{
+		"- MessageSent: 3\n",
+		"median 0.40 s, p95 3.00 s",
+		"**Sent without TLS:** 33.3% (1 of 3)",
+		"**Opens:** 1, **Clicks:** 0",
+		"- example.com (2)",
+		"- Delivery Error (1)",
+	} {
+		if !strings.Contains(report.Message, expected) {
+			t.Fatal("Report does not contain '"+expected+"', got: ", report.Message)
+		}
+	}
+}
+
+func TestReportSchedule(t *testing.T) {
+	config := defaultReportConfig()
+	config.Enabled = true
+	config.Interval = "weekly"
+	config.Weekday = "mon"
+	config.Time = "08:00"
+	config.Timezone = "UTC"
+	if err := validateSetting(config.validate, "report"); err != nil {
+		t.Fatal(err)
+	}
+	rs := newReportScheduler()
+
+	friday := time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)
+	if due := rs.due(&config, friday); due {
+		t.Fatal("Report must not be sent on first run")
+	}
+	if due := rs.due(&config, friday.Add(48*time.Hour)); due {
+		t.Fatal("Report sent before schedule")
+	}
+	if due := rs.due(&config, time.Date(2024, 1, 8, 8, 0, 0, 0, time.UTC)); !due {
+		t.Fatal("Report not sent on schedule")
+	}
+	if due := rs.due(&config, time.Date(2024, 1, 8, 8, 1, 0, 0, time.UTC)); due {
+		t.Fatal("Report sent twice")
+	}
+}
+
+func TestHistorySurvivesRestart(t *testing.T) {
+	storage := &memoryStorage{}
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	p.SetStorageHandler(storage)
+	p.history.add(newHistoryEntry(makeStatusWebhook(postal.EventMessageSent, "a@example.com")), 24*time.Hour)
+	p.markDirty()
+	if err := p.flushState(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	restarted.SetStorageHandler(storage)
+	if err := restarted.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if buckets := restarted.history.snapshot(); len(buckets) != 1 || buckets[0].Events[postal.EventMessageSent] != 1 {
+		t.Fatal("History was not restored, got: ", buckets)
+	}
+}
+
+func TestReportStartSurvivesRestart(t *testing.T) {
+	storage := &memoryStorage{}
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	p.SetStorageHandler(storage)
+	config := p.DefaultConfig().(*PluginConfig)
+	config.Report.Enabled = true
+	if err := validateSetting(config.Report.validate, "report"); err != nil {
+		t.Fatal(err)
+	}
+
+	p.sendDueReport(config)
+	if err := p.flushState(); err != nil {
+		t.Fatal(err)
+	}
+	if storage.saves != 1 {
+		t.Fatal("Start of the report period was not saved")
+	}
+	restarted := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	restarted.SetStorageHandler(storage)
+	if err := restarted.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.reports.getLastReport().Equal(p.reports.getLastReport()) {
+		t.Fatal("Start of the report period was not restored")
+	}
+}
+
+func TestLegacyHistoryIsAggregated(t *testing.T) {
+	at := timeNow()
+	storage := &memoryStorage{data: []byte(`{"history":[{"time":"` + at.Format(time.RFC3339Nano) + `","event":"MessageSent","sent_with_ssl":true}]}`)}
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	p.SetStorageHandler(storage)
+	if err := p.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if summary := p.history.between(at.Truncate(time.Hour), at.Add(time.Hour)); summary.Events[postal.EventMessageSent] != 1 {
+		t.Fatalf("Stored entries were not aggregated: %+v", summary)
+	}
+	if err := p.flushState(); err != nil || strings.Contains(string(storage.data), `"history":`) {
+		t.Fatal("Aggregated history was not saved: ", string(storage.data), err)
+	}
+}
+
+func TestBounceHistoryReason(t *testing.T) {
+	bounce := newPostalDeliveryEvent(&postal.MessageBounceEvent{
+		Envelope:        postal.Envelope{Event: postal.EventMessageBounced},
+		OriginalMessage: postal.Message{ID: 1, To: "test@example.com"},
+		Bounce:          postal.Message{ID: 2, Subject: "Mail delivery failed"},
+	})
+	if reason := newHistoryEntry(bounce).Reason; reason != "" {
+		t.Fatal("Subject of the bounce used as reason: ", reason)
+	}
+
+	bounce.setDiagnosis(&bounceDiagnosis{Statuses: []mailparse.DeliveryStatus{{Status: "5.1.1"}}})
+	if reason := newHistoryEntry(bounce).Reason; reason != "5.1.1" {
+		t.Fatal("Expected status code as reason, got: ", reason)
+	}
+	bounce.setDiagnosis(&bounceDiagnosis{Statuses: []mailparse.DeliveryStatus{{Status: "5.1.1", DiagnosticCode: "550 5.1.1 User unknown"}}})
+	if reason := newHistoryEntry(bounce).Reason; reason != "550 5.1.1 User unknown" {
+		t.Fatal("Expected diagnostic code as reason, got: ", reason)
+	}
+}
+
+func TestStateSavedOnlyWhenDirty(t *testing.T) {
+	storage := &memoryStorage{}
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	p.SetStorageHandler(storage)
+	p.markDirty()
+	for i := 0; i < 3; i++ {
+		if err := p.flushState(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if storage.saves != 1 {
+		t.Fatal("Unchanged state was saved again, saves: ", storage.saves)
+	}
+}
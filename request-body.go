@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxWebhookBodySize limits the body of event webhooks
+	maxWebhookBodySize = 4 << 20
+	// maxInboundBodySize limits inbound messages, which include attachments
+	maxInboundBodySize = 32 << 20
+	// maxVerboseOutput is the number of bytes of a body printed with verbose output
+	maxVerboseOutput = 4 << 10
+)
+
+// readBody reads the request body. It is not pooled, since the body is kept by
+// sinks and the event history after the request. Bodies larger than limit are
+// rejected with 413 and an error is returned.
+func readBody(c *gin.Context, limit int64) ([]byte, error) {
+	if c.Request.ContentLength > limit {
+		c.String(http.StatusRequestEntityTooLarge, "request body too large")
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+	var buf bytes.Buffer
+	if c.Request.ContentLength > 0 {
+		buf.Grow(int(c.Request.ContentLength))
+	}
+	if _, err := buf.ReadFrom(http.MaxBytesReader(c.Writer, c.Request.Body, limit)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.String(http.StatusRequestEntityTooLarge, "request body too large")
+		} else {
+			c.String(http.StatusBadRequest, err.Error())
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// printBody prints an incoming body for verbose output, cut off after
+// maxVerboseOutput bytes
+func printBody(title string, body []byte) {
+	if len(body) > maxVerboseOutput {
+		fmt.Printf("%s:\n%s\n... (truncated, %d bytes in total)\n", title, body[:maxVerboseOutput], len(body))
+		return
+	}
+	fmt.Printf("%s:\n%s\n", title, body)
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payload formats of outbound sinks
+const (
+	SinkFormatRaw        = "raw"        // the webhook body as received from Postal
+	SinkFormatNormalized = "normalized" // NormalizedEvent as JSON
+	SinkFormatSlack      = "slack"      // Slack incoming webhook message
+	SinkFormatMatrix     = "matrix"     // Matrix m.text message event content
+
+	SinkFormatCloudEvents       = "cloudevents"        // CloudEvent in structured content mode
+	SinkFormatCloudEventsBinary = "cloudevents-binary" // CloudEvent in binary content mode
+)
+
+const (
+	defaultSinkRetries  = 3
+	maxSinkRetries      = 10
+	sinkQueueSize       = 1000 // per sink
+	sinkTimeout         = 10 * time.Second
+	sinkMaxRetryBackoff = 5 * time.Minute
+)
+
+// sinkRetryBackoff is the delay before the first retry, it doubles with each attempt
+// up to sinkMaxRetryBackoff
+var sinkRetryBackoff = time.Second
+
+// SinkConfig configures an outbound HTTP endpoint that receives processed events
+type SinkConfig struct {
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Format  string            `yaml:"format"`
+	Events  []string          `yaml:"events"`  // event names to forward, empty means all
+	Retries int               `yaml:"retries"` // defaults to 3, at most 10, negative disables retries
+}
+
+func (sc *SinkConfig) validate(v *configValidator, path string) {
+	if sc.Name == "" {
+		v.fail(field(path, "name"), "name is required")
+	}
+	v.httpURL(field(path, "url"), sc.URL, false)
+	if sc.Retries > maxSinkRetries {
+		v.fail(field(path, "retries"), "must be at most %d", maxSinkRetries)
+	}
+	switch sc.Format {
+	case "", SinkFormatRaw, SinkFormatNormalized, SinkFormatSlack, SinkFormatMatrix, SinkFormatCloudEvents, SinkFormatCloudEventsBinary:
+	default:
+		v.fail(field(path, "format"), "invalid format '%s'", sc.Format)
+	}
+	for i, event := range sc.Events {
+		if event == "" {
+			v.fail(index(field(path, "events"), i), "empty event name")
+		}
+	}
+}
+
+// validateSinks checks the sinks, their names must be unique
+func validateSinks(v *configValidator, sinks []SinkConfig) {
+	names := map[string]bool{}
+	for i := range sinks {
+		path := index("sinks", i)
+		sinks[i].validate(v, path)
+		if names[sinks[i].Name] {
+			v.fail(field(path, "name"), "duplicate sink name '%s'", sinks[i].Name)
+		}
+		names[sinks[i].Name] = true
+	}
+}
+
+func (sc *SinkConfig) accepts(event string) bool {
+	if len(sc.Events) == 0 {
+		return true
+	}
+	for _, e := range sc.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *SinkConfig) retries() int {
+	if sc.Retries == 0 {
+		return defaultSinkRetries
+	}
+	return max(sc.Retries, 0)
+}
+
+// sinkRetryDelay returns the backoff before the given retry, starting at 1
+func sinkRetryDelay(retry int) time.Duration {
+	backoff := sinkRetryBackoff
+	for i := 1; i < retry && backoff < sinkMaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, sinkMaxRetryBackoff)
+}
+
+// NormalizedEvent is the delivery event along with the rendered notification
+type NormalizedEvent struct {
+	*DeliveryEvent
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+	ClickURL string `json:"click_url,omitempty"`
+}
+
+// outboundEvent is handed to the sinks
+type outboundEvent struct {
+	normalized NormalizedEvent
+	raw        []byte
+	cloud      *CloudEvent // nil if the event could not be converted
+}
+
+// newOutboundEvent prepares the event for the sinks, source is the CloudEvents source
+func newOutboundEvent(raw []byte, event *DeliveryEvent, notification *GotifyMessage, source string) *outboundEvent {
+	cloud, err := newCloudEvent(event, raw, source)
+	if err != nil {
+		cloud = nil
+	}
+	normalized := NormalizedEvent{
+		DeliveryEvent: event,
+		Title:         notification.Title,
+		Message:       notification.Message,
+		Priority:      notification.Priority,
+	}
+	if notification.clickURL != nil {
+		normalized.ClickURL = *notification.clickURL
+	}
+	return &outboundEvent{normalized: normalized, raw: raw, cloud: cloud}
+}
+
+// sinkPayload is the request body and its headers
+type sinkPayload struct {
+	body    []byte
+	headers map[string]string
+}
+
+// payload renders the event in the given format
+func (oe *outboundEvent) payload(format string) (*sinkPayload, error) {
+	var body []byte
+	var err error
+	headers := map[string]string{"Content-Type": "application/json"}
+
+	switch format {
+	case SinkFormatRaw:
+		body = oe.raw
+	case SinkFormatSlack:
+		body, err = json.Marshal(map[string]string{
+			"text": "*" + oe.normalized.Title + "*\n" + markdownToSlack(oe.normalized.Message),
+		})
+	case SinkFormatMatrix:
+		body, err = json.Marshal(map[string]string{
+			"msgtype":        "m.text",
+			"body":           oe.normalized.Title + "\n\n" + oe.normalized.Message,
+			"format":         "org.matrix.custom.html",
+			"formatted_body": "<b>" + html.EscapeString(oe.normalized.Title) + "</b><br>" + strings.ReplaceAll(html.EscapeString(oe.normalized.Message), "\n", "<br>"),
+		})
+	case SinkFormatCloudEvents:
+		if oe.cloud == nil {
+			return nil, fmt.Errorf("%s event can't be sent as CloudEvent", oe.normalized.Event)
+		}
+		headers["Content-Type"] = cloudEventsContentType
+		body, err = json.Marshal(oe.cloud)
+	case SinkFormatCloudEventsBinary:
+		if oe.cloud == nil {
+			return nil, fmt.Errorf("%s event can't be sent as CloudEvent", oe.normalized.Event)
+		}
+		headers = oe.cloud.binaryHeaders()
+		body = oe.cloud.Data
+	default:
+		body, err = json.Marshal(oe.normalized)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sinkPayload{body: body, headers: headers}, nil
+}
+
+var (
+	markdownBoldRegex = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	markdownLinkRegex = regexp.MustCompile(`\[([^\]]+)\]\(([^)]+)\)`)
+)
+
+// markdownToSlack converts bold text and links to Slack's mrkdwn
+func markdownToSlack(s string) string {
+	s = markdownBoldRegex.ReplaceAllString(s, "*$1*")
+	return markdownLinkRegex.ReplaceAllString(s, "<$2|$1>")
+}
+
+// sinkStatus is the delivery status of one sink shown in GetDisplay
+type sinkStatus struct {
+	delivered   int
+	failed      int
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// sinkDispatcher delivers events to the configured sinks asynchronously. Each sink
+// has its own queue and worker, so that a slow or failing sink doesn't delay the others.
+type sinkDispatcher struct {
+	config func() *PluginConfig // current configuration, nil until configured
+	mu     sync.Mutex
+	status map[string]*sinkStatus
+	queues map[string]chan *sinkPayload // keyed by sink name
+	added  chan struct{}                // tells run that a queue was added
+	client *http.Client
+}
+
+func newSinkDispatcher(config func() *PluginConfig) *sinkDispatcher {
+	return &sinkDispatcher{
+		config: config,
+		status: map[string]*sinkStatus{},
+		queues: map[string]chan *sinkPayload{},
+		added:  make(chan struct{}, 1),
+		client: &http.Client{Timeout: sinkTimeout},
+	}
+}
+
+// sink returns the sink with the given name from the current configuration
+func (sd *sinkDispatcher) sink(name string) (SinkConfig, bool) {
+	config := sd.config()
+	if config == nil {
+		return SinkConfig{}, false
+	}
+	for _, sink := range config.Sinks {
+		if sink.Name == name {
+			return sink, true
+		}
+	}
+	return SinkConfig{}, false
+}
+
+// dispatch queues the event for all sinks accepting it
+func (sd *sinkDispatcher) dispatch(sinks []SinkConfig, event *outboundEvent) {
+	for _, sink := range sinks {
+		if !sink.accepts(event.normalized.Event) {
+			continue
+		}
+		payload, err := event.payload(sink.Format)
+		if err != nil {
+			sd.record(sink.Name, err)
+			continue
+		}
+		sd.enqueue(sink.Name, payload)
+	}
+}
+
+func (sd *sinkDispatcher) enqueue(name string, payload *sinkPayload) {
+	sd.mu.Lock()
+	queue, ok := sd.queues[name]
+	if !ok {
+		queue = make(chan *sinkPayload, sinkQueueSize)
+		sd.queues[name] = queue
+		select {
+		case sd.added <- struct{}{}:
+		default:
+		}
+	}
+	sd.mu.Unlock()
+
+	select {
+	case queue <- payload:
+	default:
+		sd.record(name, fmt.Errorf("queue is full, event dropped"))
+	}
+}
+
+// run starts a worker for each sink queue and waits for them once stop is closed
+func (sd *sinkDispatcher) run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	started := map[string]bool{}
+	for {
+		sd.mu.Lock()
+		for name, queue := range sd.queues {
+			if started[name] {
+				continue
+			}
+			started[name] = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sd.work(name, queue, stop)
+			}()
+		}
+		sd.mu.Unlock()
+
+		select {
+		case <-sd.added:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// work delivers the queued events of one sink until stop is closed
+func (sd *sinkDispatcher) work(name string, queue <-chan *sinkPayload, stop <-chan struct{}) {
+	for {
+		select {
+		case payload := <-queue:
+			sd.deliver(name, payload, stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// deliver sends the payload and retries with exponential backoff on failure
+func (sd *sinkDispatcher) deliver(name string, payload *sinkPayload, stop <-chan struct{}) {
+	for attempt := 0; ; attempt++ {
+		sink, ok := sd.sink(name)
+		if !ok {
+			return // sink was removed in the meantime
+		}
+		err := sd.post(sink, payload)
+		if err == nil || attempt >= sink.retries() {
+			sd.record(name, err)
+			return
+		}
+		select {
+		case <-time.After(sinkRetryDelay(attempt + 1)):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (sd *sinkDispatcher) post(sink SinkConfig, payload *sinkPayload) error {
+	req, err := http.NewRequest(http.MethodPost, sink.URL, bytes.NewReader(payload.body))
+	if err != nil {
+		return err
+	}
+	for name, value := range payload.headers {
+		req.Header.Set(name, value)
+	}
+	for name, value := range sink.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := sd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// record updates the delivery status, err is nil for successful deliveries
+func (sd *sinkDispatcher) record(name string, err error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	status, ok := sd.status[name]
+	if !ok {
+		status = &sinkStatus{}
+		sd.status[name] = status
+	}
+	if err == nil {
+		status.delivered++
+		status.lastSuccess = timeNow()
+		return
+	}
+	status.failed++
+	status.lastError = err.Error()
+	status.lastErrorAt = timeNow()
+}
+
+// display returns a markdown list of the delivery status of the given sinks
+func (sd *sinkDispatcher) display(sinks []SinkConfig) string {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if len(sinks) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(sinks))
+	for _, sink := range sinks {
+		names = append(names, sink.Name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("**Outbound sinks:**\n\n")
+	for _, name := range names {
+		status, ok := sd.status[name]
+		if !ok {
+			fmt.Fprintf(&sb, "- %s: nothing sent yet\n", name)
+			continue
+		}
+		fmt.Fprintf(&sb, "- %s: %d delivered, %d failed", name, status.delivered, status.failed)
+		if !status.lastSuccess.IsZero() {
+			fmt.Fprintf(&sb, ", last success %s", formatLastSeen(status.lastSuccess))
+		}
+		if status.lastError != "" {
+			fmt.Fprintf(&sb, ", last error at %s: %s", formatLastSeen(status.lastErrorAt), status.lastError)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.leon.wtf/leon/gotify-postal-webhooks-plugin/postal"
+)
+
+func TestSinkDeliveryWithRetry(t *testing.T) {
+	sinkRetryBackoff = time.Millisecond
+	defer func() { sinkRetryBackoff = time.Second }()
+
+	var mu sync.Mutex
+	var attempts int
+	received := make(chan []byte, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer abc" {
+			t.Error("Sink header missing")
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	}))
+	defer endpoint.Close()
+
+	p, engine, _ := newTestPlugin(t, func(c *PluginConfig) {
+		c.Sinks = []SinkConfig{
+			{Name: "incidents", URL: endpoint.URL, Format: SinkFormatNormalized, Headers: map[string]string{"Authorization": "Bearer abc"}},
+			{Name: "opens-only", URL: endpoint.URL, Events: []string{string(postal.EventMessageLoaded)}},
+		}
+	})
+	if err := p.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disable()
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal?profile=main", string(domainDNSErrorEvent))
+
+	select {
+	case body := <-received:
+		var event NormalizedEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Event != "DomainDNSError" || event.Profile != "main" || event.Title != EmojiExclamMark+" DNS setup check failed" {
+			t.Fatal("Unexpected event: ", string(body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was not delivered")
+	}
+
+	// the retried delivery is recorded after the request was answered
+	for i := 0; i < 100 && !strings.Contains(p.sinks.display(p.config.Load().Sinks), "incidents: 1 delivered"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	display := p.sinks.display(p.config.Load().Sinks)
+	if !strings.Contains(display, "incidents: 1 delivered, 0 failed") || !strings.Contains(display, "opens-only: nothing sent yet") {
+		t.Fatal("Unexpected sink status: ", display)
+	}
+}
+
+func TestSlackPayload(t *testing.T) {
+	event := newOutboundEvent(nil, newDeliveryEvent("postal", KindFailed, "", timeNow(), nil), &GotifyMessage{
+		Title:   "Title",
+		Message: "**Status:** failed, see [dashboard](https://example.com)",
+	}, "/postal")
+	payload, err := event.payload(SinkFormatSlack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slack map[string]string
+	json.Unmarshal(payload.body, &slack)
+	if slack["text"] != "*Title*\n*Status:* failed, see <https://example.com|dashboard>" {
+		t.Fatal("Unexpected slack text: ", slack["text"])
+	}
+}
+
+func TestSlowSinkDoesNotDelayOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	received := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer fast.Close()
+
+	p, engine, _ := newTestPlugin(t, func(c *PluginConfig) {
+		c.Sinks = []SinkConfig{
+			{Name: "slow", URL: slow.URL},
+			{Name: "fast", URL: fast.URL},
+		}
+	})
+	if err := p.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disable()
+	defer close(release)
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", string(domainDNSErrorEvent))
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was not delivered while another sink was blocked")
+	}
+}
+
+func TestSinkRetryDelay(t *testing.T) {
+	for retry, expected := range map[int]time.Duration{
+		1:   time.Second,
+		2:   2 * time.Second,
+		4:   8 * time.Second,
+		10:  sinkMaxRetryBackoff,
+		100: sinkMaxRetryBackoff,
+	} {
+		if delay := sinkRetryDelay(retry); delay != expected {
+			t.Errorf("Unexpected delay before retry %d: %s", retry, delay)
+		}
+	}
+}
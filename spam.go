@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Actions for inbound messages classified as spam
+const (
+	SpamActionDeliver = "deliver"
+	SpamActionTag     = "tag"    // prefix the title with [SPAM]
+	SpamActionDemote  = "demote" // tag and send with priority 0
+	SpamActionDrop    = "drop"
+)
+
+// PriorityInbound is used for notifications of incoming mail
+const PriorityInbound = 5
+
+// SpamPolicy decides how spam is handled for a server profile. Inbound messages
+// are spam if Postal marked them as such or if their score reaches ScoreThreshold.
+type SpamPolicy struct {
+	Action         string  `yaml:"action"`          // defaults to "tag"
+	ScoreThreshold float64 `yaml:"score_threshold"` // 0 disables the score check
+	IgnoreOutgoing bool    `yaml:"ignore_outgoing"` // don't alert on outgoing spam
+}
+
+func (sp *SpamPolicy) validate(v *configValidator, path string) {
+	switch sp.Action {
+	case "", SpamActionDeliver, SpamActionTag, SpamActionDemote, SpamActionDrop:
+	default:
+		v.fail(field(path, "action"), "invalid spam action '%s'", sp.Action)
+	}
+	if sp.ScoreThreshold < 0 {
+		v.fail(field(path, "score_threshold"), "score threshold must not be negative")
+	}
+}
+
+// isSpam reports whether an inbound message is spam according to the policy
+func (sp *SpamPolicy) isSpam(spamStatus string, spamScore float64) bool {
+	if strings.EqualFold(spamStatus, "Spam") {
+		return true
+	}
+	return sp.ScoreThreshold > 0 && spamScore >= sp.ScoreThreshold
+}
+
+// apply returns the notification to send for an inbound message, or nil if it is dropped
+func (sp *SpamPolicy) apply(notification *GotifyMessage, spamStatus string, spamScore float64) *GotifyMessage {
+	if !sp.isSpam(spamStatus, spamScore) {
+		return notification
+	}
+	switch sp.Action {
+	case SpamActionDeliver:
+	case SpamActionDrop:
+		return nil
+	case SpamActionDemote:
+		notification.Title = "[SPAM] " + notification.Title
+		notification.Priority = 0
+	default:
+		notification.Title = "[SPAM] " + notification.Title
+	}
+	return notification
+}
+
+// spamPolicy returns the spam policy of the profile, or the default policy
+func (c *PluginConfig) spamPolicy(profileName string) *SpamPolicy {
+	if profile := c.profile(profileName); profile != nil {
+		return &profile.Spam
+	}
+	return &SpamPolicy{}
+}
+
+// outgoingSpamAlert returns an alert if Postal flagged an outgoing message as spam,
+// which usually points to compromised credentials or bad content
+func outgoingSpamAlert(event *DeliveryEvent, msInfo *PostalMailserverInfo) *GotifyMessage {
+	switch event.Kind {
+	case KindDelivered, KindDelayed, KindFailed, KindHeld:
+	default:
+		return nil
+	}
+	if event.MessageRef.Direction != "outgoing" || !strings.EqualFold(event.MessageRef.SpamStatus, "Spam") {
+		return nil
+	}
+
+	alert := &GotifyMessage{
+		Title:    EmojiExclamMark + " Outgoing message flagged as spam",
+		Priority: PriorityCritical,
+		problem:  "outgoing-spam:" + bareAddress(event.Sender),
+		muteKeys: event.muteKeys(),
+	}
+	alert.clickURL = messageClickURL(event, msInfo, "")
+	alert.Message += renderMessageLine(event)
+	alert.Message += "Postal classified an outgoing message as spam. " +
+		"Check whether the credentials of the sender were compromised or the content triggers spam filters.\n\n"
+	alert.Message += "---\n\n"
+	alert.Message += fmt.Sprintf("**Status:** %s", event.Event)
+	return alert
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestInboundSpamPolicy(t *testing.T) {
+	_, engine, handler := newTestPlugin(t, func(c *PluginConfig) {
+		c.Profiles = []ServerProfile{
+			{Name: defaultProfileName, InboundSecret: "s3cret"},
+			{Name: "dropping", InboundSecret: "s3cret", Spam: SpamPolicy{Action: SpamActionDrop}},
+			{Name: "demoting", InboundSecret: "s3cret", Spam: SpamPolicy{Action: SpamActionDemote, ScoreThreshold: 5}},
+		}
+	})
+	spam := strings.Replace(string(inboundHashMessage), `"spam_status":"NotSpam"`, `"spam_status":"Spam"`, 1)
+	scored := strings.Replace(string(inboundHashMessage), `"spam_status":"NotSpam"`, `"spam_status":"NotSpam","spam_score":6.2`, 1)
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal/inbound?profile=dropping&secret=s3cret", spam)
+	if len(handler.messages) != 0 {
+		t.Fatal("Spam was not dropped")
+	}
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal/inbound?profile=demoting&secret=s3cret", scored)
+	if len(handler.messages) != 1 || handler.messages[0].Priority != 0 || !strings.HasPrefix(handler.messages[0].Title, "[SPAM] ") {
+		t.Fatal("Spam above score threshold was not demoted")
+	}
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal/inbound?secret=s3cret", spam)
+	if len(handler.messages) != 2 || !strings.HasPrefix(handler.messages[1].Title, "[SPAM] ") || handler.messages[1].Priority != PriorityInbound {
+		t.Fatal("Spam was not tagged by default")
+	}
+}
+
+func TestOutgoingSpamAlert(t *testing.T) {
+	_, engine, handler := newTestPlugin(t, nil)
+	spam := strings.Replace(string(messageSentEvent), `"spam_status":"NotSpam"`, `"spam_status":"Spam"`, 1)
+
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", spam)
+	if len(handler.messages) != 2 {
+		t.Fatal("Expected notification and spam alert, got: ", len(handler.messages))
+	}
+	if alert := handler.messages[1]; alert.Title != EmojiExclamMark+" Outgoing message flagged as spam" || alert.Priority != PriorityCritical {
+		t.Fatal("Unexpected spam alert: ", alert.Title)
+	}
+}
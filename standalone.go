@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotify/plugin-api"
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables of the standalone mode, they take precedence over the config file
+const (
+	envConfigFile  = "POSTAL_WEBHOOKS_CONFIG"
+	envListen      = "POSTAL_WEBHOOKS_LISTEN"
+	envGotifyURL   = "POSTAL_WEBHOOKS_GOTIFY_URL"
+	envGotifyToken = "POSTAL_WEBHOOKS_GOTIFY_TOKEN"
+	envStateFile   = "POSTAL_WEBHOOKS_STATE_FILE"
+	envPublicURL   = "POSTAL_WEBHOOKS_PUBLIC_URL"
+	envSecret      = "POSTAL_WEBHOOKS_SECRET"
+)
+
+const gotifyRequestTimeout = 10 * time.Second
+
+// minSecretLength makes the secret path segment hard to guess
+const minSecretLength = 16
+
+// StandaloneConfig configures the standalone mode. The plugin configuration is
+// read from the same file, next to the standalone settings.
+type StandaloneConfig struct {
+	Listen string `yaml:"listen"`
+	// GotifyURL is the base URL of the Gotify server, e.g. https://gotify.example.com
+	GotifyURL string `yaml:"gotify_url"`
+	// GotifyToken is the token of the application messages are sent to
+	GotifyToken string `yaml:"gotify_token"`
+	// StateFile stores history, snoozes and suppressions across restarts, empty keeps them in memory
+	StateFile string `yaml:"state_file"`
+	// Secret is the first path segment of all routes except /health, like the
+	// token in the URLs of Gotify plugins
+	Secret string       `yaml:"secret"`
+	Plugin PluginConfig `yaml:",inline"`
+}
+
+func (sc *StandaloneConfig) validate() error {
+	if u, err := url.Parse(sc.GotifyURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid Gotify URL '%s'", sc.GotifyURL)
+	}
+	if sc.GotifyToken == "" {
+		return errors.New("Gotify application token is missing")
+	}
+	if len(sc.Secret) < minSecretLength || strings.ContainsAny(sc.Secret, "/?#%") {
+		return fmt.Errorf("secret must have at least %d characters and must not contain any of /?#%%", minSecretLength)
+	}
+	return nil
+}
+
+// loadStandaloneConfig reads the optional config file and applies the environment variables
+func loadStandaloneConfig(p *Plugin, path string) (*StandaloneConfig, error) {
+	config := &StandaloneConfig{
+		Listen: ":8080",
+		Plugin: *p.DefaultConfig().(*PluginConfig),
+	}
+	if path == "" {
+		path = os.Getenv(envConfigFile)
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", path, err)
+		}
+	}
+
+	for env, field := range map[string]*string{
+		envListen:      &config.Listen,
+		envGotifyURL:   &config.GotifyURL,
+		envGotifyToken: &config.GotifyToken,
+		envStateFile:   &config.StateFile,
+		envPublicURL:   &config.Plugin.PublicURL,
+		envSecret:      &config.Secret,
+	} {
+		if value, ok := os.LookupEnv(env); ok {
+			*field = value
+		}
+	}
+	return config, config.validate()
+}
+
+// gotifyClient sends messages to a Gotify server through its REST API
+type gotifyClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// gotifyMessage is the body of POST /message
+type gotifyMessage struct {
+	Title    string                 `json:"title"`
+	Message  string                 `json:"message"`
+	Priority int                    `json:"priority"`
+	Extras   map[string]interface{} `json:"extras,omitempty"`
+}
+
+// SendMessage implements plugin.MessageHandler
+func (gc *gotifyClient) SendMessage(msg plugin.Message) error {
+	body, err := json.Marshal(gotifyMessage{
+		Title:    msg.Title,
+		Message:  msg.Message,
+		Priority: msg.Priority,
+		Extras:   msg.Extras,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(gc.url, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", gc.token)
+	resp, err := gc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Gotify responded with status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// loggingMessageHandler reports messages that could not be sent, since there is nobody else to tell
+type loggingMessageHandler struct {
+	plugin.MessageHandler
+}
+
+func (lh loggingMessageHandler) SendMessage(msg plugin.Message) error {
+	err := lh.MessageHandler.SendMessage(msg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not send message '%s' to Gotify: %v\n", msg.Title, err)
+	}
+	return err
+}
+
+// fileStorage implements plugin.StorageHandler with a file, an empty path keeps the state in memory
+type fileStorage struct {
+	path   string
+	memory []byte
+}
+
+func (fs *fileStorage) Save(b []byte) error {
+	if fs.path == "" {
+		fs.memory = append([]byte(nil), b...)
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+func (fs *fileStorage) Load() ([]byte, error) {
+	if fs.path == "" {
+		return fs.memory, nil
+	}
+	b, err := os.ReadFile(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// newStandaloneHandler sets up the plugin like Gotify does and returns its HTTP handler
+func newStandaloneHandler(p *Plugin, config *StandaloneConfig) (http.Handler, error) {
+	p.SetMessageHandler(loggingMessageHandler{&gotifyClient{
+		url:    config.GotifyURL,
+		token:  config.GotifyToken,
+		client: &http.Client{Timeout: gotifyRequestTimeout},
+	}})
+	p.SetStorageHandler(&fileStorage{path: config.StateFile})
+	if err := p.ValidateAndSetConfig(&config.Plugin); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	// the display includes the API token, so it is only served below the secret path
+	basePath := "/" + config.Secret + "/"
+	p.RegisterWebhook(basePath, engine.Group(basePath))
+	engine.GET(basePath, func(c *gin.Context) {
+		location := &url.URL{Scheme: "http", Host: c.Request.Host}
+		if c.Request.TLS != nil {
+			location.Scheme = "https"
+		}
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(p.GetDisplay(location)))
+	})
+	engine.GET("/health", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	return engine, nil
+}
+
+// runStandalone runs the plugin on its own HTTP server until SIGINT or SIGTERM
+func runStandalone(args []string) error {
+	flags := flag.NewFlagSet("gotify-postal-webhooks", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path to the YAML config file (or $"+envConfigFile+")")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	p := NewGotifyPluginInstance(plugin.UserContext{ID: 1, Name: "standalone"}).(*Plugin)
+	config, err := loadStandaloneConfig(p, *configFile)
+	if err != nil {
+		return err
+	}
+	handler, err := newStandaloneHandler(p, config)
+	if err != nil {
+		return err
+	}
+	if err := p.Enable(); err != nil {
+		return err
+	}
+	defer p.Disable()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	server := &http.Server{Addr: config.Listen, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	fmt.Printf("Listening on %s, webhook path /<secret>/%s\n", config.Listen, routeName)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	return server.Shutdown(shutdownCtx)
+}
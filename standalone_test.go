@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotify/plugin-api"
+)
+
+func TestStandaloneConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`
+gotify_url: https://gotify.example.com
+gotify_token: from-file
+secret: 0123456789abcdef
+profiles:
+  - name: main
+    host: postal.example.com
+heartbeat:
+  enabled: true
+`), 0o600)
+	t.Setenv(envGotifyToken, "from-env")
+
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	config, err := loadStandaloneConfig(p, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":8080" || config.GotifyURL != "https://gotify.example.com" || config.GotifyToken != "from-env" {
+		t.Fatal("Unexpected standalone settings: ", config)
+	}
+	if len(config.Plugin.Profiles) != 1 || !config.Plugin.Heartbeat.Enabled || config.Plugin.Heartbeat.Timeout != "1h" {
+		t.Fatal("Plugin config not read or defaults lost: ", config.Plugin)
+	}
+
+	t.Setenv(envGotifyURL, "gotify.example.com")
+	if _, err := loadStandaloneConfig(p, path); err == nil {
+		t.Fatal("Gotify URL without scheme accepted")
+	}
+	t.Setenv(envGotifyURL, "https://gotify.example.com")
+	t.Setenv(envSecret, "short")
+	if _, err := loadStandaloneConfig(p, path); err == nil {
+		t.Fatal("Short secret accepted")
+	}
+}
+
+func TestStandaloneForwardsToGotify(t *testing.T) {
+	received := make(chan gotifyMessage, 1)
+	gotify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/message" || r.Header.Get("X-Gotify-Key") != "app-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var msg gotifyMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		received <- msg
+	}))
+	defer gotify.Close()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	p := NewGotifyPluginInstance(plugin.UserContext{}).(*Plugin)
+	handler, err := newStandaloneHandler(p, &StandaloneConfig{
+		GotifyURL:   gotify.URL + "/",
+		GotifyToken: "app-token",
+		StateFile:   stateFile,
+		Secret:      "0123456789abcdef",
+		Plugin:      *p.DefaultConfig().(*PluginConfig),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/0123456789abcdef/postal", strings.NewReader(string(domainDNSErrorEvent))))
+	select {
+	case msg := <-received:
+		if msg.Title != EmojiExclamMark+" DNS setup check failed" {
+			t.Fatal("Unexpected message: ", msg)
+		}
+		if _, ok := msg.Extras["client::display"]; !ok {
+			t.Fatal("Extras missing: ", msg.Extras)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message was not forwarded")
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/0123456789abcdef/", nil))
+	if !strings.Contains(recorder.Body.String(), "http://example.com/0123456789abcdef/postal") {
+		t.Fatal("Unexpected display: ", recorder.Body.String())
+	}
+
+	for _, target := range []string{"/", "/postal", "/wrong-secret-0123/postal"} {
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		if recorder.Code != http.StatusNotFound || strings.Contains(recorder.Body.String(), p.apiToken()) {
+			t.Fatal("Display or webhook available without the secret at ", target)
+		}
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, target, strings.NewReader(string(domainDNSErrorEvent))))
+		if recorder.Code != http.StatusNotFound {
+			t.Fatal("Webhook accepted without the secret at ", target)
+		}
+	}
+
+	if err := p.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := os.ReadFile(stateFile); err != nil || !strings.Contains(string(state), "DomainDNSError") {
+		t.Fatal("State was not saved: ", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gotify/plugin-api"
+)
+
+// storedState is persisted in Gotify's plugin storage
+type storedState struct {
+	History    []*historyBucket      `json:"history_hours"`
+	Entries    []historyEntry        `json:"history,omitempty"` // history saved before it was aggregated
+	LastReport time.Time             `json:"last_report"`
+	Secret     string                `json:"secret"`
+	Snoozes    map[string]time.Time  `json:"snoozes"`
+	Suppressed []Suppression         `json:"suppressed"`
+	Held       map[string]heldWindow `json:"held"` // notifications held during quiet windows
+}
+
+// SetStorageHandler implements plugin.Storager
+func (p *Plugin) SetStorageHandler(h plugin.StorageHandler) {
+	p.storage = h
+}
+
+// loadState restores the persisted state, if any
+func (p *Plugin) loadState() error {
+	if p.storage == nil {
+		return nil
+	}
+	bytes, err := p.storage.Load()
+	if err != nil {
+		return err
+	}
+	if len(bytes) == 0 {
+		return nil
+	}
+	var state storedState
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return fmt.Errorf("could not read plugin storage: %w", err)
+	}
+	var retention time.Duration // entries are kept until the configuration is set
+	if config := p.config.Load(); config != nil {
+		retention = config.historyRetention
+	}
+	p.history.restore(state.History, retention)
+	if len(state.Entries) > 0 {
+		for _, entry := range state.Entries {
+			p.history.add(entry, retention)
+		}
+		p.markDirty()
+	}
+	p.reports.setLastReport(state.LastReport)
+	p.snoozes.restore(state.Snoozes)
+	p.suppressions.restore(state.Suppressed)
+	p.quiet.restore(state.Held)
+	if state.Secret == "" {
+		// keep the generated secret
+		p.markDirty()
+		return nil
+	}
+	return p.signer.setSecret(state.Secret)
+}
+
+// markDirty schedules the state to be saved with the next flush
+func (p *Plugin) markDirty() {
+	p.stateDirty.Store(true)
+}
+
+// flushState saves the state if it changed since the last save
+func (p *Plugin) flushState() error {
+	if !p.stateDirty.Swap(false) {
+		return nil
+	}
+	if err := p.saveState(); err != nil {
+		p.stateDirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+// saveState persists the current state
+func (p *Plugin) saveState() error {
+	if p.storage == nil {
+		return nil
+	}
+	p.storageMu.Lock()
+	defer p.storageMu.Unlock()
+	state := storedState{
+		History:    p.history.snapshot(),
+		LastReport: p.reports.getLastReport(),
+		Secret:     p.signer.getSecret(),
+		Snoozes:    p.snoozes.active(),
+		Suppressed: p.suppressions.list(),
+		Held:       p.quiet.snapshot(),
+	}
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return p.storage.Save(bytes)
+}
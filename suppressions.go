@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiTokenHeader authenticates requests to the plugin's API, e.g. the suppression list
+const apiTokenHeader = "X-Plugin-Token"
+
+// Suppression is an address that should not be sent to anymore
+type Suppression struct {
+	Address   string    `json:"address"`
+	Reason    string    `json:"reason"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int       `json:"count"`
+}
+
+// suppressionList holds suppressed addresses, keyed by lower-cased address
+type suppressionList struct {
+	mu      sync.Mutex
+	entries map[string]*Suppression
+}
+
+func newSuppressionList() *suppressionList {
+	return &suppressionList{entries: map[string]*Suppression{}}
+}
+
+// add records a hard bounce or permanent failure for the address
+func (sl *suppressionList) add(address, reason string) {
+	address = bareAddress(address)
+	if address == "" {
+		return
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	now := timeNow()
+	entry, ok := sl.entries[address]
+	if !ok {
+		entry = &Suppression{Address: address, FirstSeen: now}
+		sl.entries[address] = entry
+	}
+	entry.Reason = reason
+	entry.LastSeen = now
+	entry.Count++
+}
+
+func (sl *suppressionList) remove(address string) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	address = bareAddress(address)
+	if _, ok := sl.entries[address]; !ok {
+		return false
+	}
+	delete(sl.entries, address)
+	return true
+}
+
+func (sl *suppressionList) get(address string) (Suppression, bool) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	entry, ok := sl.entries[bareAddress(address)]
+	if !ok {
+		return Suppression{}, false
+	}
+	return *entry, true
+}
+
+// list returns all entries ordered by address
+func (sl *suppressionList) list() []Suppression {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	result := make([]Suppression, 0, len(sl.entries))
+	for _, entry := range sl.entries {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+func (sl *suppressionList) restore(entries []Suppression) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.entries = map[string]*Suppression{}
+	for i := range entries {
+		entry := entries[i]
+		sl.entries[entry.Address] = &entry
+	}
+}
+
+// recordSuppressions adds recipients of hard bounces and permanent failures to the list
+func (p *Plugin) recordSuppressions(event *DeliveryEvent) {
+	switch event.Kind {
+	case KindFailed:
+		response := event.Response
+		if strings.HasPrefix(smtpStatus(response.Output, response.Details), "5") {
+			reason := response.Details
+			if response.Output != "" {
+				reason = response.Output
+			}
+			for _, recipient := range event.Recipients {
+				p.suppressions.add(recipient, reason)
+			}
+			p.markDirty()
+		}
+	case KindBounced:
+		for _, status := range event.Response.Statuses {
+			if !status.Hard() {
+				continue
+			}
+			recipient := status.FinalRecipient
+			if recipient == "" {
+				recipient = event.recipient()
+			}
+			reason := status.Status
+			if status.DiagnosticCode != "" {
+				reason = status.DiagnosticCode
+			}
+			p.suppressions.add(recipient, reason)
+			p.markDirty()
+		}
+	}
+}
+
+// apiToken returns the token required for the plugin's API
+func (p *Plugin) apiToken() string {
+	return p.signer.sign("api", "")
+}
+
+func (p *Plugin) authorizeAPI(c *gin.Context) bool {
+	token := c.GetHeader(apiTokenHeader)
+	if token == "" {
+		token = c.Query("token")
+	}
+	if !p.signer.verify("api", "", token) {
+		c.String(http.StatusForbidden, "invalid token")
+		return false
+	}
+	return true
+}
+
+// listSuppressionsHandler returns the list as JSON or, with ?format=csv, as CSV.
+// With ?address=, only that address is returned or 404 if it is not suppressed.
+func (p *Plugin) listSuppressionsHandler(c *gin.Context) {
+	if !p.authorizeAPI(c) {
+		return
+	}
+
+	entries := p.suppressions.list()
+	if address := c.Query("address"); address != "" {
+		entry, ok := p.suppressions.get(address)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "address is not suppressed"})
+			return
+		}
+		entries = []Suppression{entry}
+	}
+
+	if c.Query("format") == "csv" || c.GetHeader("Accept") == "text/csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"address", "reason", "first_seen", "last_seen", "count"})
+		for _, entry := range entries {
+			w.Write([]string{
+				entry.Address,
+				entry.Reason,
+				entry.FirstSeen.Format(time.RFC3339),
+				entry.LastSeen.Format(time.RFC3339),
+				strconv.Itoa(entry.Count),
+			})
+		}
+		w.Flush()
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+func (p *Plugin) addSuppressionHandler(c *gin.Context) {
+	if !p.authorizeAPI(c) {
+		return
+	}
+	var request struct {
+		Address string `json:"address"`
+		Reason  string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || addressDomain(request.Address) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expected JSON with a valid address"})
+		return
+	}
+	if request.Reason == "" {
+		request.Reason = "added manually"
+	}
+	p.suppressions.add(request.Address, request.Reason)
+	p.markDirty()
+	entry, _ := p.suppressions.get(request.Address)
+	c.JSON(http.StatusOK, entry)
+}
+
+func (p *Plugin) deleteSuppressionHandler(c *gin.Context) {
+	if !p.authorizeAPI(c) {
+		return
+	}
+	if !p.suppressions.remove(c.Param("address")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "address is not suppressed"})
+		return
+	}
+	p.markDirty()
+	c.Status(http.StatusNoContent)
+}
+
+// apiDisplay explains how to use the plugin's API
+func (p *Plugin) apiDisplay(webhookURL string) string {
+	return fmt.Sprintf("**API:** send the header `%s: %s` with each request.\n\n"+
+		"- Suppression list (%d addresses): query it with `GET %s/suppressions` (add `?format=csv` for CSV or `?address=` to check a single address), "+
+		"add addresses with `POST` and remove them with `DELETE %s/suppressions/<address>`.\n"+
+		"- Recent events as CloudEvents: `GET %s/events` (supports `?type=com.postal.MessageSent` and `?limit=`).",
+		apiTokenHeader, p.apiToken(), len(p.suppressions.list()), webhookURL, webhookURL, webhookURL)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serveWithToken(p *Plugin, engine http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(apiTokenHeader, p.apiToken())
+	engine.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestSuppressionFromPermanentFailure(t *testing.T) {
+	p, engine, _ := newTestPlugin(t, nil)
+	failed := strings.Replace(failedEvent, `"output":"250 2.0.0 OK`, `"output":"550 5.1.1 unknown user`, 1)
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", failed)
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", failed)
+
+	if rec := serve(engine, http.MethodGet, "/plugin/1/custom/abc/postal/suppressions", ""); rec.Code != http.StatusForbidden {
+		t.Fatal("Suppression list is accessible without token")
+	}
+
+	rec := serveWithToken(p, engine, http.MethodGet, "/plugin/1/custom/abc/postal/suppressions?address=Test@Example.com", "")
+	var entries []Suppression
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Count != 2 || !strings.HasPrefix(entries[0].Reason, "550 5.1.1") {
+		t.Fatal("Unexpected suppression list: ", rec.Body.String())
+	}
+}
+
+func TestNoSuppressionFromMisleadingNumbers(t *testing.T) {
+	p, engine, _ := newTestPlugin(t, nil)
+	failed := strings.Replace(failedEvent, `"output":"250 2.0.0 OK`, `"output":"Connection to mx.example.com:587 timed out after 512 seconds`, 1)
+	serve(engine, http.MethodPost, "/plugin/1/custom/abc/postal", failed)
+
+	if _, ok := p.suppressions.get("test@example.com"); ok {
+		t.Fatal("Recipient was suppressed for a temporary failure")
+	}
+}
+
+func TestSuppressionAPI(t *testing.T) {
+	p, engine, _ := newTestPlugin(t, nil)
+
+	rec := serveWithToken(p, engine, http.MethodPost, "/plugin/1/custom/abc/postal/suppressions", `{"address":"spamtrap@example.com"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Adding address failed, status: ", rec.Code)
+	}
+
+	rec = serveWithToken(p, engine, http.MethodGet, "/plugin/1/custom/abc/postal/suppressions?format=csv", "")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "spamtrap@example.com,added manually,") {
+		t.Fatal("Unexpected CSV: ", rec.Body.String())
+	}
+
+	rec = serveWithToken(p, engine, http.MethodDelete, "/plugin/1/custom/abc/postal/suppressions/spamtrap@example.com", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatal("Deleting address failed, status: ", rec.Code)
+	}
+	rec = serveWithToken(p, engine, http.MethodGet, "/plugin/1/custom/abc/postal/suppressions?address=spamtrap@example.com", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatal("Address was not deleted")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a recurring daily time range like 08:00-18:00 on weekdays.
+// If End is before Start, the window spans midnight.
+type TimeWindow struct {
+	Days     []string `yaml:"days"` // e.g. ["mon", "tue"], empty means every day
+	Start    string   `yaml:"start"`
+	End      string   `yaml:"end"`
+	Timezone string   `yaml:"timezone"` // IANA name, empty means local time
+
+	// parsed by validate
+	start, end int // minutes since midnight
+	location   *time.Location
+	weekdays   []time.Weekday
+}
+
+// parseClock parses "HH:MM" to minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s', expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// locations caches loaded time zones, which are read from the time zone database otherwise
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+func (tw *TimeWindow) validate(v *configValidator, path string) {
+	var err error
+	tw.start, err = parseClock(tw.Start)
+	v.check(field(path, "start"), err)
+	tw.end, err = parseClock(tw.End)
+	v.check(field(path, "end"), err)
+	tw.location = validateTimezone(v, field(path, "timezone"), tw.Timezone)
+	tw.weekdays = nil
+	for i, day := range tw.Days {
+		weekday, ok := weekdayNames[strings.ToLower(day)]
+		if !ok {
+			v.fail(index(field(path, "days"), i), "invalid day '%s'", day)
+		}
+		tw.weekdays = append(tw.weekdays, weekday)
+	}
+}
+
+// validateTimezone checks an IANA time zone name like Europe/Berlin and returns
+// the location
+func validateTimezone(v *configValidator, path, name string) *time.Location {
+	loc, err := loadLocation(name)
+	if err != nil {
+		v.fail(path, "unknown timezone '%s'", name)
+	}
+	return loc
+}
+
+// Contains reports whether t lies within the window. It uses the values parsed
+// by validate, windows that were not validated never match.
+func (tw *TimeWindow) Contains(t time.Time) bool {
+	if tw.location == nil {
+		return false
+	}
+	t = t.In(tw.location)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if tw.start > tw.end && minute < tw.end {
+		// we are in the part after midnight, which belongs to the previous day
+		day = (day + 6) % 7
+	}
+	if len(tw.weekdays) > 0 && !slices.Contains(tw.weekdays, day) {
+		return false
+	}
+
+	if tw.start <= tw.end {
+		return minute >= tw.start && minute < tw.end
+	}
+	return minute >= tw.start || minute < tw.end
+}
@@ -2,10 +2,18 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gotify/plugin-api"
 )
 
+// timeNow is replaced in tests
+var timeNow = time.Now
+
 func makeMarkdownMessage(title, message string, clickURL *string) plugin.Message {
 	extras := map[string]interface{}{}
 	extras["client::display"] = map[string]interface{}{
@@ -31,3 +39,38 @@ func makeClickURL(messageID int, host, org, name, appendix string) *string {
 	s := fmt.Sprintf(clickURLTeml, host, org, name, messageID, appendix)
 	return &s
 }
+
+// bareAddress returns the lower-cased address of "Name <user@example.com>"
+func bareAddress(address string) string {
+	if addr, err := mail.ParseAddress(address); err == nil {
+		address = addr.Address
+	}
+	return strings.ToLower(strings.Trim(address, "<> "))
+}
+
+// addressDomain returns the lower-cased domain part of an address like
+// "Name <user@example.com>" or "user@example.com"
+func addressDomain(address string) string {
+	address = bareAddress(address)
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return address[at+1:]
+}
+
+// parseDuration parses a Go duration, additionally allowing whole days like "7d"
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// unixTime converts Postal's fractional unix timestamps
+func unixTime(timestamp float64) time.Time {
+	sec, frac := math.Modf(timestamp)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}